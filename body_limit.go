@@ -0,0 +1,97 @@
+package replay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// newLimitedRecording returns a new Recording of res, like NewRecording, or like
+// newChunkedRecording if chunked is true, unless max is greater than zero and
+// the body is larger than max bytes. In that case, it returns a nil Recording,
+// and the body of res is replaced with one that returns the whole body, of
+// which at most max+1 bytes are held in memory.
+func newLimitedRecording(res *http.Response, chunked bool, max int64) (*Recording, error) {
+	if max <= 0 {
+		if chunked {
+			return newChunkedRecording(res)
+		}
+		return NewRecording(res)
+	}
+	if res.ContentLength > max {
+		return nil, nil
+	}
+	upstream := res.Body
+	limited := io.LimitReader(upstream, max+1)
+	var (
+		body   []byte
+		chunks []RecordedChunk
+		err    error
+	)
+	if chunked {
+		chunks, err = readChunks(limited, time.Now())
+		for i := range chunks {
+			body = append(body, chunks[i].bytes()...)
+		}
+	} else {
+		body, err = ioutil.ReadAll(limited)
+	}
+	if err != nil {
+		upstream.Close()
+		return nil, err
+	}
+	if int64(len(body)) > max {
+		res.Body = &prefixedBody{
+			Reader:     io.MultiReader(bytes.NewReader(body), upstream),
+			ReadCloser: upstream,
+		}
+		return nil, nil
+	}
+	upstream.Close()
+	if upstream != http.NoBody {
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	rec := newRecording(res)
+	if chunked {
+		rec.Chunks = chunks
+	} else {
+		rec.Body = body
+	}
+	return rec, nil
+}
+
+// prefixedBody is the body of a response that was partly read into memory.
+// Read returns what was read first, and then the rest of the ReadCloser.
+type prefixedBody struct {
+	io.Reader
+	io.ReadCloser
+}
+
+func (b *prefixedBody) Read(p []byte) (int, error) {
+	return b.Reader.Read(p)
+}
+
+// tooLarge reports that the live response res for req wasn't recorded to path
+// because its body is larger than MaxBodySize, and returns any error from
+// OnRecordError.
+func (r *RoundTripper) tooLarge(req *http.Request, res *http.Response, path string) error {
+	err := &Error{
+		Request:  req,
+		Response: res,
+		Err:      fmt.Errorf("%w: body is larger than MaxBodySize (%d bytes)", ErrRecordingTooLarge, r.MaxBodySize),
+		Path:     path,
+	}
+	r.counters.passthrough.Add(1)
+	if r.Logger != nil {
+		r.Logger.WarnContext(req.Context(), "replay too large", "path", path, "limit", r.MaxBodySize)
+	}
+	if r.OnRecordError == nil {
+		return nil
+	}
+	return r.callHook(req, "OnRecordError", func() {
+		r.OnRecordError(req, path, err)
+	})
+}
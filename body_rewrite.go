@@ -0,0 +1,107 @@
+package replay
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A BodyRewrite replaces text in response bodies. See
+// RoundTripper.BodyRewrites.
+type BodyRewrite struct {
+	// Old is the text to replace, unless Pattern is set.
+	Old string
+	// Pattern, if not nil, matches the text to replace instead of Old.
+	// New may then refer to submatches, as for Regexp.Expand, e.g. "$1".
+	Pattern *regexp.Regexp
+	// New is the replacement text.
+	New string
+}
+
+// apply returns body with the replacements made.
+func (w *BodyRewrite) apply(body []byte) []byte {
+	if w.Pattern != nil {
+		return w.Pattern.ReplaceAll(body, []byte(w.New))
+	}
+	if w.Old == "" {
+		return body
+	}
+	return bytes.ReplaceAll(body, []byte(w.Old), []byte(w.New))
+}
+
+// rewriteBody returns body with each of rewrites applied in order.
+func rewriteBody(body []byte, rewrites []BodyRewrite) []byte {
+	for i := range rewrites {
+		body = rewrites[i].apply(body)
+	}
+	return body
+}
+
+// isRewritable reports whether the body of a response with header can be
+// rewritten: its Content-Type is textual, and it has no Content-Encoding.
+func isRewritable(header http.Header) bool {
+	if enc := header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"), isJSON(mediaType),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/xml", "application/javascript",
+		"application/x-www-form-urlencoded", "application/x-ndjson":
+		return true
+	}
+	return false
+}
+
+// rewritePlaybackBody applies BodyRewrites to body, which is read and closed, if
+// the body of rec can be rewritten. It returns the new body and its size.
+func (r *RoundTripper) rewritePlaybackBody(
+	rec *Recording, body io.ReadCloser, size int64,
+) (io.ReadCloser, int64, error) {
+	if !isRewritable(rec.Headers) {
+		return body, size, nil
+	}
+	content, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+	content = rewriteBody(content, r.BodyRewrites)
+	return ioutil.NopCloser(bytes.NewReader(content)), int64(len(content)), nil
+}
+
+// rewriteRecordedBody applies RecordBodyRewrites to the body of rec, which is
+// read from body if it is not nil, if it can be rewritten. The recorded length
+// of the body is updated. It returns the reader for the new body.
+func (r *RoundTripper) rewriteRecordedBody(rec *Recording, body io.Reader) (io.Reader, error) {
+	if !isRewritable(rec.Headers) {
+		return body, nil
+	}
+	if body != nil {
+		content, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		rec.Body = content
+	}
+	rec.Body = rewriteBody(rec.Body, r.RecordBodyRewrites)
+	if rec.ContentLength > 0 {
+		rec.ContentLength = int64(len(rec.Body))
+	}
+	if rec.Headers.Get("Content-Length") != "" {
+		rec.Headers.Set("Content-Length", strconv.Itoa(len(rec.Body)))
+	}
+	return bytes.NewReader(rec.Body), nil
+}
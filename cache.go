@@ -0,0 +1,109 @@
+package replay
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+)
+
+// recordingCache is a least recently used cache of loaded recordings, keyed by
+// path. It is not safe for concurrent use.
+type recordingCache struct {
+	// max is the maximum total size of the cached bodies, or zero if there
+	// is no limit.
+	max     int64
+	size    int64
+	entries map[string]*list.Element
+	lru     list.List
+}
+
+type cacheEntry struct {
+	path string
+	rec  *Recording
+}
+
+func newRecordingCache(max int64) *recordingCache {
+	return &recordingCache{max: max, entries: make(map[string]*list.Element)}
+}
+
+// get returns the cached recording for path, or nil if there isn't one.
+func (c *recordingCache) get(path string) *Recording {
+	e, ok := c.entries[path]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).rec
+}
+
+// add caches rec for path, evicting the least recently used recordings if
+// necessary. A recording with a body larger than the cache isn't cached.
+func (c *recordingCache) add(path string, rec *Recording) {
+	c.remove(path)
+	size := int64(len(rec.Body))
+	if c.max > 0 && size > c.max {
+		return
+	}
+	c.entries[path] = c.lru.PushFront(&cacheEntry{path: path, rec: rec})
+	c.size += size
+	for c.max > 0 && c.size > c.max {
+		c.remove(c.lru.Back().Value.(*cacheEntry).path)
+	}
+}
+
+// remove removes the recording for path from the cache, if it is there.
+func (c *recordingCache) remove(path string) {
+	e, ok := c.entries[path]
+	if !ok {
+		return
+	}
+	c.lru.Remove(e)
+	delete(c.entries, path)
+	c.size -= int64(len(e.Value.(*cacheEntry).rec.Body))
+}
+
+// loadRecording returns the recording at path, except for its body, which is
+// returned as an io.ReadCloser along with its size. If CacheRecordings is true,
+// the recording is served from the cache if possible, and the returned
+// Recording is a copy that can be modified independently. If Store is set, the
+// recording is loaded from it instead.
+func (r *RoundTripper) loadRecording(path string) (*Recording, io.ReadCloser, int64, error) {
+	if r.Store != nil {
+		return r.loadStored(path)
+	}
+	if !r.CacheRecordings {
+		return loadRecordingStream(path)
+	}
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = newRecordingCache(r.CacheSize)
+	}
+	rec := r.cache.get(path)
+	r.mu.Unlock()
+	if rec == nil {
+		var err error
+		if rec, err = LoadRecording(path); err != nil {
+			return nil, nil, 0, err
+		}
+		r.mu.Lock()
+		r.cache.add(path, rec)
+		r.mu.Unlock()
+	}
+	copied := *rec
+	copied.Headers = rec.Headers.Clone()
+	copied.Trailers = rec.Trailers.Clone()
+	copied.Body = nil
+	body := ioutil.NopCloser(bytes.NewReader(rec.Body))
+	return &copied, body, int64(len(rec.Body)), nil
+}
+
+// uncache removes the recording for path from the cache, after it has been
+// saved.
+func (r *RoundTripper) uncache(path string) {
+	r.mu.Lock()
+	if r.cache != nil {
+		r.cache.remove(path)
+	}
+	r.mu.Unlock()
+}
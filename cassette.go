@@ -0,0 +1,283 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store holds recordings in place of the files under the directories of a
+// RoundTripper. See the Store field of RoundTripper, and Cassette.
+type Store interface {
+	// Load returns the recording with the given key, including its body,
+	// or an error for which os.IsNotExist is true if there isn't one. The
+	// returned Recording must not be modified.
+	Load(key string) (*Recording, error)
+	// Save saves rec, including its body, with the given key, replacing any
+	// existing recording. rec must not be modified afterwards.
+	Save(key string, rec *Recording) error
+}
+
+// storeKey returns the key of the recording at path in a Store.
+func storeKey(path string) string {
+	return filepath.ToSlash(path)
+}
+
+// validKey reports whether key is a clean, relative path that stays within the
+// directory it is relative to, so that it can be unpacked safely.
+func validKey(key string) bool {
+	return key != "" && !path.IsAbs(key) && path.Clean(key) == key &&
+		key != ".." && !strings.HasPrefix(key, "../") && !strings.Contains(key, `\`)
+}
+
+// loadStored returns the recording at path in Store as for loadRecording.
+func (r *RoundTripper) loadStored(path string) (*Recording, io.ReadCloser, int64, error) {
+	rec, err := r.Store.Load(storeKey(path))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	copied := *rec
+	copied.Headers = rec.Headers.Clone()
+	copied.Trailers = rec.Trailers.Clone()
+	copied.Body = nil
+	body := ioutil.NopCloser(bytes.NewReader(rec.Body))
+	return &copied, body, int64(len(rec.Body)), nil
+}
+
+// saveTo saves rec, with the body read from body, to path, or to Store if it
+// is set. It returns the size of the body.
+func (r *RoundTripper) saveTo(path string, rec *Recording, body io.Reader) (int64, error) {
+	if r.Store == nil {
+		return rec.save(path, body)
+	}
+	stored := rec.Clone()
+	stored.FormatVersion = FormatVersion
+	stored.Body = nil
+	if !bodylessStatus(rec.StatusCode) {
+		var err error
+		if stored.Body, err = ioutil.ReadAll(body); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(stored.Body)), r.Store.Save(storeKey(path), stored)
+}
+
+// cassetteEntry is a line of a cassette file.
+type cassetteEntry struct {
+	Key string `json:"key"`
+	*Recording
+	Body []byte `json:"body,omitempty"`
+}
+
+// Cassette is a Store that keeps recordings in a single file, with one JSON
+// object per line: the key of the recording, its fields, as in a recording
+// file, and its body, base64 encoded in a "body" field. Recordings are held in
+// memory. Saving a recording appends a line to the file, and Close rewrites the
+// file with only the latest recording for each key, sorted by key. A Cassette
+// is safe for concurrent use.
+//
+// Keys are the paths of the recordings, with forward slashes, as they would be
+// saved by a RoundTripper with the cassette as its Store, so its Dir is
+// normally empty. Pack and Unpack convert between cassettes and directories.
+type Cassette struct {
+	path       string
+	mu         sync.Mutex
+	recordings map[string]*Recording
+	// file is the cassette file opened for appending, once a recording has
+	// been saved.
+	file   *os.File
+	closed bool
+}
+
+// OpenCassette returns the Cassette at path, which is created when the first
+// recording is saved if it doesn't exist. If a key appears more than once, the
+// last recording is used. An invalid line is reported as a *ParseError, and a
+// recording with a newer format version as a *FormatVersionError.
+func OpenCassette(path string) (*Cassette, error) {
+	c := &Cassette{path: path, recordings: make(map[string]*Recording)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(f)
+	for {
+		var entry cassetteEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, newParseError(f, info.Size(), path, dec.InputOffset(), err)
+		}
+		if !validKey(entry.Key) {
+			return nil, fmt.Errorf("%sinvalid key %q", pathPrefix(path), entry.Key)
+		}
+		if entry.Recording == nil {
+			// The line has no fields other than the key and body.
+			entry.Recording = &Recording{}
+		}
+		if entry.FormatVersion > FormatVersion {
+			return nil, &FormatVersionError{Path: path, Version: entry.FormatVersion}
+		}
+		entry.Recording.Body = entry.Body
+		c.recordings[entry.Key] = entry.Recording
+	}
+	return c, nil
+}
+
+// Load returns the recording with the given key. It implements Store.
+func (c *Cassette) Load(key string) (*Recording, error) {
+	c.mu.Lock()
+	rec, ok := c.recordings[key]
+	c.mu.Unlock()
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: c.path + "#" + key, Err: os.ErrNotExist}
+	}
+	return rec, nil
+}
+
+// Save saves rec with the given key, and appends it to the cassette file. It
+// implements Store.
+func (c *Cassette) Save(key string, rec *Recording) error {
+	if !validKey(key) {
+		return fmt.Errorf("%sinvalid key %q", pathPrefix(c.path), key)
+	}
+	line, err := json.Marshal(&cassetteEntry{Key: key, Recording: rec, Body: rec.Body})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return fmt.Errorf("%scassette is closed", pathPrefix(c.path))
+	}
+	if c.file == nil {
+		if dir := filepath.Dir(c.path); dir != "" {
+			if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+				return err
+			}
+		}
+		c.file, err = os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err = c.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	c.recordings[key] = rec
+	return nil
+}
+
+// Keys returns the keys of the recordings in the cassette, sorted.
+func (c *Cassette) Keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.keys()
+}
+
+func (c *Cassette) keys() []string {
+	keys := make([]string, 0, len(c.recordings))
+	for key := range c.recordings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Close rewrites the cassette file atomically, with only the latest recording
+// for each key, if any recordings were saved. Recordings can still be loaded
+// afterwards, but not saved.
+func (c *Cassette) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	if rewriteErr := c.rewrite(); err == nil {
+		err = rewriteErr
+	}
+	return err
+}
+
+// rewrite writes all of the recordings to the cassette file, replacing it
+// atomically.
+func (c *Cassette) rewrite() error {
+	if dir := filepath.Dir(c.path); dir != "." {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(c.path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, key := range c.keys() {
+			rec := c.recordings[key]
+			if err := enc.Encode(&cassetteEntry{Key: key, Recording: rec, Body: rec.Body}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Pack writes the recordings under dir to a new cassette file at cassettePath,
+// replacing any existing file, with their paths relative to dir as keys.
+func Pack(dir, cassettePath string) error {
+	c := &Cassette{path: cassettePath, recordings: make(map[string]*Recording)}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isRecordingFile(info.Name()) {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rec, err := LoadRecording(path)
+		if err != nil {
+			return err
+		}
+		rec.FormatVersion = FormatVersion
+		c.recordings[filepath.ToSlash(rel)] = rec
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.rewrite()
+}
+
+// Unpack saves each of the recordings in the cassette file at cassettePath
+// under dir, with its key as its path relative to dir.
+func Unpack(cassettePath, dir string) error {
+	if _, err := os.Stat(cassettePath); err != nil {
+		return err
+	}
+	c, err := OpenCassette(cassettePath)
+	if err != nil {
+		return err
+	}
+	for _, key := range c.Keys() {
+		if err = c.recordings[key].Save(filepath.Join(dir, filepath.FromSlash(key))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// RecordedChunk is a part of a response body, with the time at which it was
+// received. Recordings made with RecordChunks have chunks in place of a body,
+// and are played back with the same timing.
+type RecordedChunk struct {
+	// OffsetMS is the time at which the chunk was received, in milliseconds
+	// after the response headers.
+	OffsetMS int64 `json:"offset_ms"`
+	// Text is the content of the chunk, if it is valid UTF-8.
+	Text string `json:"text,omitempty"`
+	// Data is the content of the chunk, if it isn't valid UTF-8. It is
+	// base64 encoded in JSON.
+	Data []byte `json:"data,omitempty"`
+}
+
+func newRecordedChunk(offset time.Duration, p []byte) RecordedChunk {
+	chunk := RecordedChunk{OffsetMS: offset.Milliseconds()}
+	if utf8.Valid(p) {
+		chunk.Text = string(p)
+	} else {
+		chunk.Data = append([]byte(nil), p...)
+	}
+	return chunk
+}
+
+func (c *RecordedChunk) bytes() []byte {
+	if c.Data != nil {
+		return c.Data
+	}
+	return []byte(c.Text)
+}
+
+// IsEventStream reports whether res is a stream of server-sent events, with
+// the media type text/event-stream. It can be used as the RecordChunks
+// function of a RoundTripper.
+func IsEventStream(res *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// readChunks reads r until EOF, and returns what each call to Read returned,
+// with the time since start that it returned.
+func readChunks(r io.Reader, start time.Time) ([]RecordedChunk, error) {
+	var chunks []RecordedChunk
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			chunks = append(chunks, newRecordedChunk(time.Since(start), buf[:n]))
+		}
+		if err == io.EOF {
+			return chunks, nil
+		}
+		if err != nil {
+			return chunks, err
+		}
+	}
+}
+
+// newChunkedRecording returns a new Recording of res, like NewRecording, but
+// with the body recorded as chunks. The body of res is read and replaced.
+func newChunkedRecording(res *http.Response) (*Recording, error) {
+	chunks, err := readChunks(res.Body, time.Now())
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	for i := range chunks {
+		body = append(body, chunks[i].bytes()...)
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	rec := newRecording(res)
+	rec.Chunks = chunks
+	return rec, nil
+}
+
+// chunksSize returns the total size of chunks.
+func chunksSize(chunks []RecordedChunk) int64 {
+	var size int64
+	for i := range chunks {
+		size += int64(len(chunks[i].bytes()))
+	}
+	return size
+}
+
+// chunkBody is a response body that plays back chunks with their recorded
+// timing.
+type chunkBody struct {
+	*io.PipeReader
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newChunkBody returns a body that returns each of chunks once its offset has
+// passed. Reads fail with the error of ctx once it is done.
+func newChunkBody(ctx context.Context, chunks []RecordedChunk) *chunkBody {
+	pr, pw := io.Pipe()
+	b := &chunkBody{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		start := time.Now()
+		for i := range chunks {
+			due := start.Add(time.Duration(chunks[i].OffsetMS) * time.Millisecond)
+			if wait := time.Until(due); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					pw.CloseWithError(ctx.Err())
+					return
+				case <-b.done:
+					timer.Stop()
+					return
+				}
+			}
+			if _, err := pw.Write(chunks[i].bytes()); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return b
+}
+
+func (b *chunkBody) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
+	return b.PipeReader.Close()
+}
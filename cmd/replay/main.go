@@ -0,0 +1,85 @@
+// Command replay runs an HTTP forward proxy that records responses from remote
+// servers, and plays them back on later requests. Point a client's HTTP_PROXY
+// at it to create or use recordings with clients that aren't written in Go:
+//
+//	replay -addr localhost:8080 -dir testdata &
+//	curl -x http://localhost:8080 http://api.ipify.org?format=json
+//
+// By default, recordings are played back if they exist and recorded if they
+// don't. Use -playback-only to act as a fully offline mock server, or
+// -record-only to record new responses even if recordings exist.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/richshaffer/replay"
+)
+
+// stringSetFlag is a flag.Value that adds each occurrence of a flag to a
+// StringSet.
+type stringSetFlag struct {
+	replay.StringSet
+}
+
+func (f stringSetFlag) String() string {
+	values := make([]string, 0, len(f.StringSet))
+	for k := range f.StringSet {
+		values = append(values, k)
+	}
+	return strings.Join(values, ",")
+}
+
+func (f stringSetFlag) Set(value string) error {
+	f.Add(value)
+	return nil
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "address to listen on")
+	dir := flag.String("dir", "testdata", "directory to store recordings in")
+	playbackOnly := flag.Bool("playback-only", false,
+		"only play back recordings; fail requests without one")
+	recordOnly := flag.Bool("record-only", false,
+		"record all responses, even if a recording exists")
+	strict := flag.Bool("strict", false,
+		"don't fall back to recordings without a checksum")
+	gen := replay.NewPathGenerator()
+	gen.OmitQuery = replay.NewStringSet()
+	flag.Var(stringSetFlag{gen.OmitHeaders}, "omit-header",
+		"header to exclude from recording paths (repeatable)")
+	flag.Var(stringSetFlag{gen.OmitQuery}, "omit-query",
+		"query parameter to exclude from recording paths (repeatable)")
+	flag.Parse()
+
+	if *playbackOnly && *recordOnly {
+		log.Fatal("-playback-only and -record-only are mutually exclusive")
+	}
+	rt := &replay.RoundTripper{
+		Dir:           *dir,
+		PathGenerator: gen,
+		StrictPath:    *strict,
+		OnReplay: func(req *http.Request, path string, rec *replay.Recording) {
+			log.Printf("%s %s: replayed %s", req.Method, req.URL, path)
+		},
+		OnRecord: func(req *http.Request, path string, rec *replay.Recording) {
+			log.Printf("%s %s: recorded %s", req.Method, req.URL, path)
+		},
+		OnMiss: func(req *http.Request, err *replay.NotFoundError) {
+			log.Printf("%s %s: no recording at %s", req.Method, req.URL,
+				strings.Join(err.Paths, ", "))
+		},
+	}
+	switch {
+	case *playbackOnly:
+		rt.Mode = replay.ModePlaybackOnly
+	case *recordOnly:
+		rt.Mode = replay.ModeRecordOnly
+	}
+
+	log.Printf("proxy listening on %s, recording to %s", *addr, *dir)
+	log.Fatal(http.ListenAndServe(*addr, replay.NewProxyHandler(rt)))
+}
@@ -0,0 +1,43 @@
+package replay
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Collision is a pair of recordings whose paths differ only in letter case, as
+// reported by CheckCollisions.
+type Collision struct {
+	// Path and Other are the paths of the recordings, including the
+	// directory passed to CheckCollisions, in lexical order.
+	Path  string
+	Other string
+}
+
+// CheckCollisions returns the pairs of recordings under dir whose paths differ
+// only in letter case, and so would collide on a case-insensitive filesystem:
+// one would overwrite or shadow the other. It only reads directory entries, so
+// it is cheap enough to run in CI, where the filesystem is usually case
+// sensitive. Such collisions can be avoided with the EscapeUppercase field of
+// PathGenerator.
+func CheckCollisions(dir string) ([]Collision, error) {
+	var collisions []Collision
+	seen := make(map[string][]string)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !isRecordingFile(fi.Name()) {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := strings.ToLower(rel)
+		for _, other := range seen[key] {
+			collisions = append(collisions, Collision{Path: other, Other: path})
+		}
+		seen[key] = append(seen[key], path)
+		return nil
+	})
+	return collisions, err
+}
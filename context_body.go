@@ -0,0 +1,55 @@
+package replay
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// contextReader is an io.Reader that returns the error of ctx instead of
+// reading, once ctx is done, so that a large recording isn't saved after its
+// request has been cancelled.
+type contextReader struct {
+	io.Reader
+	ctx context.Context
+}
+
+// newContextReader returns r, stopped by ctx if it can be done.
+func newContextReader(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		return r
+	}
+	return &contextReader{Reader: r, ctx: ctx}
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+// contextBody is the body of a recording that is played back for req. Once
+// the context of req is done, it returns an *Error wrapping the error of the
+// context instead of reading.
+type contextBody struct {
+	io.ReadCloser
+	req  *http.Request
+	path string
+}
+
+// newContextBody returns body, loaded from path for req, stopped by the context
+// of req if it can be done.
+func newContextBody(req *http.Request, path string, body io.ReadCloser) io.ReadCloser {
+	if req.Context().Done() == nil {
+		return body
+	}
+	return &contextBody{ReadCloser: body, req: req, path: path}
+}
+
+func (b *contextBody) Read(p []byte) (int, error) {
+	if err := b.req.Context().Err(); err != nil {
+		return 0, &Error{Request: b.req, Err: err, Path: b.path}
+	}
+	return b.ReadCloser.Read(p)
+}
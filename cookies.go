@@ -0,0 +1,58 @@
+package replay
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CookieRewrite describes changes to make to Set-Cookie headers in played back
+// responses, so that a client's cookie jar accepts cookies that were recorded
+// for a different host, have since expired, or require HTTPS. Recordings on
+// disk are not changed.
+type CookieRewrite struct {
+	// Domain, if not empty, replaces the Domain attribute of cookies that
+	// have one.
+	Domain string
+	// StripExpiry removes the Expires and Max-Age attributes, making cookies
+	// session cookies.
+	StripExpiry bool
+	// StripSecure removes the Secure attribute, so that cookies are sent over
+	// plain HTTP.
+	StripSecure bool
+}
+
+// Rewrite rewrites the Set-Cookie headers in header.
+func (c *CookieRewrite) Rewrite(header http.Header) {
+	values := header["Set-Cookie"]
+	for i, v := range values {
+		values[i] = c.rewriteCookie(v)
+	}
+}
+
+func (c *CookieRewrite) rewriteCookie(v string) string {
+	parts := strings.Split(v, ";")
+	kept := parts[:1]
+	for _, part := range parts[1:] {
+		attr := strings.TrimSpace(part)
+		name := attr
+		if i := strings.IndexByte(attr, '='); i >= 0 {
+			name = strings.TrimSpace(attr[:i])
+		}
+		switch strings.ToLower(name) {
+		case "domain":
+			if c.Domain != "" {
+				part = " Domain=" + c.Domain
+			}
+		case "expires", "max-age":
+			if c.StripExpiry {
+				continue
+			}
+		case "secure":
+			if c.StripSecure {
+				continue
+			}
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, ";")
+}
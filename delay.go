@@ -0,0 +1,51 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// delay waits for d, or until ctx is done, in which case it returns a
+// *delayError wrapping the error of ctx, for the recording at path.
+func delay(ctx context.Context, d time.Duration, path string) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return &delayError{path: path, err: ctx.Err()}
+	}
+}
+
+// delayError is returned by RoundTripper when the context of a request is done
+// while it waits for the DelayMS of a recording. Like the errors of the
+// transports of the http package, it is a timeout if the context's deadline
+// was exceeded, so the *url.Error returned by an *http.Client reports a
+// timeout.
+type delayError struct {
+	path string
+	err  error
+}
+
+func (e *delayError) Error() string {
+	return e.err.Error() + " (while delaying playback of " + e.path + ")"
+}
+
+// Timeout reports whether the deadline of the context was exceeded. It allows
+// the error to satisfy the net.Error interface.
+func (e *delayError) Timeout() bool {
+	return errors.Is(e.err, context.DeadlineExceeded)
+}
+
+// Temporary reports whether the error is a timeout. It allows the error to
+// satisfy the net.Error interface.
+func (e *delayError) Temporary() bool {
+	return e.Timeout()
+}
+
+// Unwrap returns the error of the context.
+func (e *delayError) Unwrap() error {
+	return e.err
+}
@@ -12,7 +12,9 @@ created and edited manually for simple cases.
 Recordings are identified uniquely by a pathname derived from HTTP request
 contents. Paths are constructed as a series of intermediate directories and a
 file as follows:
-	HTTP scheme / host(:port) / HTTP method / path / ... / request (. CRC) .json
+	(HTTP scheme /) host(:port) / HTTP method / path / ... / request (. CRC) .json
+The scheme directory is left out if the IgnoreScheme field of PathGenerator is
+true, so that http and https requests share recordings.
 The period and CRC beteen "request" and ".json" may not be present if a request
 contained no excluded query parameters, no excluded headers and also no body.
 Each component is also URL-encoded, if necessary, with url.QueryEscape, to avoid
@@ -21,19 +23,55 @@ for the URL
 	http://www.example.com/path/to/easy+street
 generates the path name
 	http/www.example.com/GET/path/to/easy%2bstreet/request.json
+If the Encoding field of PathGenerator is EncodingReadable, directory
+components are instead escaped only where necessary: the characters
+/ \ : * ? " < > |, control characters, and '%', '+' and '=' are
+percent-encoded, and everything else, including spaces and non-ASCII
+characters, is left alone. For example, a GET request for the URL
+	http://www.example.com/a%20file,%20v2
+generates the path name
+	http/www.example.com/GET/a file, v2/request.json
+rather than
+	http/www.example.com/GET/a+file%2C+v2/request.json
+Recording and playback use the same PathGenerator, so they always agree, but
+changing the Encoding changes the paths of existing recordings whose
+components contain escaped characters.
+Components that would be "." or "..", or a device name reserved by Windows,
+such as "aux", "nul" or "com1.txt" in any letter case, have their first
+character percent-encoded, e.g. "%61ux", on every platform, so that recordings
+made elsewhere can still be used on Windows.
+If the EscapeUppercase field of PathGenerator is true, uppercase letters are
+percent-encoded as well, except in the method, so that paths differing only in
+case don't collide on case-insensitive filesystems. CheckCollisions reports
+recordings that would.
+The CRC is a decimal CRC32 checksum by default. The Hash field of PathGenerator
+can be set to use a different algorithm, such as SHA-256, in which case the
+digest is hex encoded.
 The RoundTripper will first try to load a canned response from the path with the
 CRC extension, if a CRC is calculated. If no response is found, it will by
 default attempt to load the content from a path without the CRC extension. This
 behavior can be disabled by setting StrictPath to true.
+PathGenerator.Explain reports how a request maps to its paths: which headers,
+query parameters and body went into the CRC, and which were left out. If the
+Verbose field of RoundTripper is true, this report is included in the error
+returned when playback finds no recording.
 
 The paths above are relative to the Dir field of RoundTripper, which is also
 taken as a parameter to the NewClient and NewRecordingClient functions.
+For full control over the paths, the KeyFunc field of RoundTripper can return
+a short key for each request, such as "users/list", which is used as the path
+of its recording, "users/list.json", instead of a generated one. Requests for
+which it returns an empty key use the generated paths.
+The layout can also be replaced entirely by setting the Pather field of
+RoundTripper to any implementation of the Pather interface, which
+*PathGenerator implements; NewRecordingPath returns its results.
 
 The format of the recording files is also intended to be easily human-readable.
 The first part of the file is a JSON object with fields that will be mapped to
 the *http.Response object. The JSON object is followed by one newline. Any
 content after that is the body of the recorded response:
 	{
+	  "format_version": 2,
 	  "status": "404 Not Found",
 	  "status_code": 301,
 	  "proto": "HTTP/1.1",
@@ -47,10 +85,51 @@ content after that is the body of the recorded response:
 	}
 	The requested content was not found.
 
+If the RecordErrors field of RoundTripper is true, transport errors returned by
+the wrapped RoundTripper are recorded as well. Such a recording has an "error"
+object with a "message" and an optional "category" in place of the response
+fields, and playing it back returns a *RecordedError from RoundTrip.
+
+Streamed responses, such as server-sent events, can be recorded with the timing
+of each part of the body by setting the RecordChunks field of RoundTripper. Such
+a recording has a "chunks" array in place of the body, with the "offset_ms" and
+"text" of each part, and is played back at the same pace.
+
+The RecordDir field of RoundTripper can be set to save new recordings
+somewhere other than the directories they are played back from. For example,
+recordings can be regenerated into a staging directory, reviewed, and then
+moved into testdata deliberately:
+	rt := client.Transport.(*replay.RoundTripper)
+	rt.Mode = replay.ModeRecordOnly
+	rt.PlaybackDir = "testdata"
+	rt.RecordDir = "testdata.new"
+	// Run the tests, compare testdata.new with testdata, and then:
+	//	cp -R testdata.new/. testdata
+
+Recordings can also be kept in a single file, a cassette, with one recording
+per line, by setting the Store field of RoundTripper to the *Cassette returned
+by OpenCassette, and closing it when done. Pack and Unpack convert between a
+cassette and a directory of recordings. Similarly, ZipDir archives a directory
+of recordings reproducibly, and OpenZip returns a read-only Store for playing
+them back from the archive.
+
 A simple example use case may look something like this:
 	client := replay.NewClient("testdata")
 	// If allowRecording is false, this will only succeed if a recorded response
 	// exists under the "testdata" directory:
 	res, err := client.Get("https://api.ipify.org?format=json")
+
+In tests, NewTestClient keeps recordings for each test in its own directory,
+plays them back only unless REPLAY_MODE is set, and fails the test if a
+recording is missing:
+	func TestIPify(t *testing.T) {
+		client := replay.NewTestClient(t)
+		res, err := client.Get("https://api.ipify.org?format=json")
+		...
+	}
+
+Outside of tests, NewClientFromEnv reads the mode from REPLAY_MODE in the same
+way, e.g. REPLAY_MODE=auto records missing responses, and plays back only if it
+is unset. ModeFromEnv parses the mode from any environment variable.
 */
 package replay
@@ -1,6 +1,17 @@
 package replay
 
-import "net/http"
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+)
 
 // Error is an error that may be returned by RoundTripper, and thus by the
 // *http.Client returned by NewClient or NewRecordingClient. It can be used to
@@ -18,8 +29,256 @@ type Error struct {
 	// Err is the underlying error that was encountered while attempting to
 	// manipulate a recording.
 	Err error
+	// Path is the path of the recording that was being loaded or saved when
+	// the error occurred, if there was one.
+	Path string
 }
 
+// Error returns the message of Err, preceded by Path if it is set and the
+// message doesn't already include it.
 func (r *Error) Error() string {
-	return r.Err.Error()
+	msg := r.Err.Error()
+	if r.Path != "" && !strings.Contains(msg, r.Path) {
+		msg = r.Path + ": " + msg
+	}
+	return msg
+}
+
+// Unwrap returns Err.
+func (r *Error) Unwrap() error {
+	return r.Err
+}
+
+// ErrRecordingNotFound is matched by errors.Is for the error returned by
+// RoundTripper when there is no recording for a request in ModePlaybackOnly.
+// The error also matches fs.ErrNotExist.
+var ErrRecordingNotFound = errors.New("recording not found")
+
+// MismatchError is wrapped by the *Error returned by RoundTripper when
+// VerifyRequest is true and a request doesn't match the fingerprint saved with
+// its recording.
+type MismatchError struct {
+	// Path is the path of the recording.
+	Path string
+	// Field is the first part of the request that differs: "method", "url",
+	// "body", or "header " followed by the header name.
+	Field string
+	// Expected is the value in the recording, and Actual is the value for
+	// the request. Header values are quoted lists, and bodies are digests.
+	Expected, Actual string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("request doesn't match recording %s: %s: expected %s, got %s",
+		e.Path, e.Field, e.Expected, e.Actual)
+}
+
+// NotFoundError is wrapped by the *Error returned by RoundTripper when there is
+// no recording for a request in ModePlaybackOnly. It matches
+// ErrRecordingNotFound with errors.Is.
+type NotFoundError struct {
+	// Method is the method of the request.
+	Method string
+	// URL is the URL of the request.
+	URL string
+	// Paths are the paths that were searched for a recording, in order.
+	Paths []string
+	// Checksum is the checksum calculated for the request, which is part of
+	// the filename of the first path. It is empty if there is none.
+	Checksum string
+	// Err is the error returned when opening the last of Paths.
+	Err error
+	// Explanation, if not nil, explains how the request maps to the paths.
+	// It is set if the Verbose field of RoundTripper is true.
+	Explanation *Explanation
+}
+
+func (e *NotFoundError) Error() string {
+	msg := fmt.Sprintf("%v for %s %s (searched %s", ErrRecordingNotFound,
+		e.Method, e.URL, strings.Join(e.Paths, ", "))
+	if e.Checksum != "" {
+		msg += "; checksum " + e.Checksum
+	}
+	msg += ")"
+	if e.Explanation != nil {
+		msg += "\n" + e.Explanation.String()
+	}
+	return msg
+}
+
+// Unwrap returns ErrRecordingNotFound and Err.
+func (e *NotFoundError) Unwrap() []error {
+	return []error{ErrRecordingNotFound, e.Err}
+}
+
+// ErrUnsupportedVersion is matched by errors.Is for a *FormatVersionError.
+var ErrUnsupportedVersion = errors.New("unsupported recording format version")
+
+// FormatVersionError is returned by LoadRecording for a recording with a newer
+// format version than this package supports.
+type FormatVersionError struct {
+	// Path is the path of the recording.
+	Path string
+	// Version is the format version of the recording.
+	Version int
+}
+
+func (e *FormatVersionError) Error() string {
+	return fmt.Sprintf("%s%v %d (newest supported is %d)",
+		pathPrefix(e.Path), ErrUnsupportedVersion, e.Version, FormatVersion)
+}
+
+// Unwrap returns ErrUnsupportedVersion.
+func (e *FormatVersionError) Unwrap() error {
+	return ErrUnsupportedVersion
+}
+
+// ErrRecordingTooLarge is wrapped by the *Error passed to the OnRecordError hook
+// of a RoundTripper when a live response isn't recorded because its body is
+// larger than MaxBodySize.
+var ErrRecordingTooLarge = errors.New("recording is too large")
+
+// ErrCorruptRecording is matched by errors.Is for a *ParseError or a
+// *TruncatedError.
+var ErrCorruptRecording = errors.New("corrupt recording")
+
+// ParseError is returned by LoadRecording, and wrapped by the *Error returned
+// by RoundTripper, if the JSON of a recording can't be parsed, e.g. after it
+// was edited by hand.
+type ParseError struct {
+	// Path is the path of the recording, or empty for ReadRecording.
+	Path string
+	// Offset is the byte offset in the file at which the error was found.
+	Offset int64
+	// Excerpt is the text of the file around Offset.
+	Excerpt string
+	// Err is the error returned by encoding/json, such as a
+	// *json.SyntaxError.
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%sinvalid recording at offset %d near %q: %v",
+		pathPrefix(e.Path), e.Offset, e.Excerpt, e.Err)
+}
+
+// Unwrap returns Err.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrCorruptRecording.
+func (e *ParseError) Is(target error) bool {
+	return target == ErrCorruptRecording
+}
+
+// TruncatedError is returned by LoadRecording, and wrapped by the *Error
+// returned by RoundTripper, if the body of a recording is shorter than its
+// Content-Length header. This is typically the result of a recording that was
+// cut off while it was being written. A body that was shortened by hand should
+// have its Content-Length header corrected or removed.
+type TruncatedError struct {
+	// Path is the path of the recording, or empty for ReadRecording.
+	Path string
+	// Expected is the length from the Content-Length header, and Actual is
+	// the length of the body in the file.
+	Expected, Actual int64
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("%struncated recording: body is %d bytes, but Content-Length is %d",
+		pathPrefix(e.Path), e.Actual, e.Expected)
+}
+
+// Is reports whether target is ErrCorruptRecording.
+func (e *TruncatedError) Is(target error) bool {
+	return target == ErrCorruptRecording
+}
+
+// Categories for RecordedError. They describe the general class of a transport
+// error so that playback can reproduce errors that behave like the original.
+const (
+	ErrorCategoryTimeout           = "timeout"
+	ErrorCategoryConnectionRefused = "connection_refused"
+	ErrorCategoryDNS               = "dns"
+	ErrorCategoryTLS               = "tls"
+	// ErrorCategoryCanceled is never recorded by a RoundTripper, since errors
+	// caused by the context of a request aren't, but it can be used in
+	// hand-written recordings, or with NewRecordedError, to simulate a
+	// canceled request.
+	ErrorCategoryCanceled = "canceled"
+)
+
+// RecordedError is a transport error stored in a Recording in place of a
+// response. It is saved when the RecordErrors field of RoundTripper is true and
+// the wrapped http.RoundTripper returns an error. On playback, it is returned
+// from RoundTrip, so the *http.Client will wrap it in a *url.Error just as it
+// would the original error.
+type RecordedError struct {
+	// Message is the text of the original error.
+	Message string `json:"message"`
+	// Category is one of the ErrorCategory constants, or empty if the error
+	// didn't fall into a known category.
+	Category string `json:"category,omitempty"`
+}
+
+// NewRecordedError returns a RecordedError describing err.
+func NewRecordedError(err error) *RecordedError {
+	return &RecordedError{Message: err.Error(), Category: errorCategory(err)}
+}
+
+func (e *RecordedError) Error() string {
+	return e.Message
+}
+
+// Timeout reports whether the recorded error was a timeout. It allows the error
+// to satisfy the net.Error interface.
+func (e *RecordedError) Timeout() bool {
+	return e.Category == ErrorCategoryTimeout
+}
+
+// Temporary reports whether the recorded error was a timeout. It allows the
+// error to satisfy the net.Error interface.
+func (e *RecordedError) Temporary() bool {
+	return e.Timeout()
+}
+
+// Unwrap returns a standard library error corresponding to Category, if there
+// is one, so that errors.Is works as it would have with the original error.
+func (e *RecordedError) Unwrap() error {
+	switch e.Category {
+	case ErrorCategoryTimeout:
+		return os.ErrDeadlineExceeded
+	case ErrorCategoryConnectionRefused:
+		return syscall.ECONNREFUSED
+	case ErrorCategoryCanceled:
+		return context.Canceled
+	}
+	return nil
+}
+
+func errorCategory(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordHeaderErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certInvalidErr x509.CertificateInvalidError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorCategoryCanceled
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorCategoryTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorCategoryConnectionRefused
+	case errors.As(err, &dnsErr):
+		return ErrorCategoryDNS
+	case errors.As(err, &recordHeaderErr), errors.As(err, &certErr),
+		errors.As(err, &unknownAuthErr), errors.As(err, &hostnameErr),
+		errors.As(err, &certInvalidErr):
+		return ErrorCategoryTLS
+	}
+	return ""
 }
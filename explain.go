@@ -0,0 +1,200 @@
+package replay
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Explanation describes how a PathGenerator maps a request to the path of its
+// recording. See PathGenerator.Explain.
+type Explanation struct {
+	// Method and URL are those of the request.
+	Method string
+	URL    string
+	// Custom reports whether the path wasn't generated by a PathGenerator,
+	// but by the KeyFunc or Pather of a RoundTripper, in which case only
+	// Components, Checksum and the paths are set. Key is the key returned
+	// by KeyFunc, if any.
+	Custom bool
+	Key    string
+	// Components are the directory components of the path, escaped.
+	Components []string
+	// IncludedHeaders are the headers that are part of the checksum, and
+	// OmittedHeaders are those that aren't, as canonicalized for the
+	// checksum.
+	IncludedHeaders http.Header
+	OmittedHeaders  http.Header
+	// IncludedQuery are the query parameters that are part of the checksum,
+	// or of the path if QueryInPath is true, and OmittedQuery are those that
+	// aren't.
+	IncludedQuery url.Values
+	OmittedQuery  url.Values
+	// QueryInPath reports whether the included query parameters are a
+	// directory of the path, rather than part of the checksum.
+	QueryInPath bool
+	// BodySize is the number of bytes of the body that are part of the
+	// checksum, after MungeRequestBody, OmitFormParams or IgnoreJSONFields
+	// are applied, or zero if the body isn't part of it.
+	BodySize int64
+	// BodyIgnored reports whether the body was left out because IgnoreBody
+	// is true.
+	BodyIgnored bool
+	// Checksum is the checksum of the request, or empty if nothing is part
+	// of it.
+	Checksum string
+	// Path and GenericPath are the candidate paths of the recording, as
+	// returned by RecordingPath.Path and RecordingPath.GenericPath.
+	Path        string
+	GenericPath string
+}
+
+// Explain returns an Explanation of how req maps to the path of its recording,
+// to help find out why a request doesn't match a recording. Like RecordingPath,
+// it reads the body of req, which is replaced or rewound so that it can still
+// be sent.
+func (p *PathGenerator) Explain(req *http.Request) (Explanation, error) {
+	rp, err := p.RecordingPath(req)
+	if err != nil {
+		return Explanation{}, err
+	}
+	e := Explanation{
+		Method:          req.Method,
+		URL:             req.URL.String(),
+		Components:      strings.Split(rp.dir, string(os.PathSeparator)),
+		IncludedHeaders: http.Header{},
+		OmittedHeaders:  http.Header{},
+		IncludedQuery:   url.Values{},
+		OmittedQuery:    url.Values{},
+		Checksum:        rp.checksum,
+		Path:            rp.Path(),
+		GenericPath:     rp.GenericPath(),
+	}
+
+	header := req.Header
+	var foldHeader func(string) string
+	if !p.ExactNames {
+		header = canonicalHeader(header)
+		foldHeader = textproto.CanonicalMIMEHeaderKey
+	}
+	header = p.hostHeader(header)
+	for _, k := range hashableMap(header).keys(p.AllowHeaders, p.OmitHeaders, foldHeader) {
+		e.IncludedHeaders[k] = header[k]
+	}
+	for k, v := range header {
+		if _, ok := e.IncludedHeaders[k]; !ok {
+			e.OmittedHeaders[k] = v
+		}
+	}
+
+	_, e.QueryInPath = p.queryComponent(req)
+	q := p.query(req)
+	for _, k := range q.keys(p.AllowQuery, p.OmitQuery, p.foldQuery()) {
+		e.IncludedQuery[k] = q[k]
+	}
+	for k, v := range req.URL.Query() {
+		if _, ok := e.IncludedQuery[k]; !ok {
+			e.OmittedQuery[k] = v
+		}
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		if p.IgnoreBody {
+			e.BodyIgnored = true
+		} else if e.BodySize, err = p.hashRequestBody(crc32.NewIEEE(), req); err != nil {
+			return Explanation{}, err
+		}
+	}
+	return e, nil
+}
+
+// explainPath returns the Explanation of rp, the path of req, which wasn't
+// generated by a PathGenerator.
+func explainPath(req *http.Request, rp *RecordingPath) Explanation {
+	var components []string
+	if rp.dir != "" {
+		components = strings.Split(rp.dir, string(os.PathSeparator))
+	}
+	return Explanation{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		Custom:      true,
+		Components:  components,
+		Checksum:    rp.checksum,
+		Path:        rp.Path(),
+		GenericPath: rp.GenericPath(),
+	}
+}
+
+// redactedHeaders are the headers whose values String doesn't show, since
+// they are typically credentials.
+var redactedHeaders = NewStringSet("Authorization", "Cookie", "Proxy-Authorization")
+
+// String returns a readable report of e, with one item per line. The values of
+// credential headers, such as Authorization, are redacted.
+func (e Explanation) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "request: %s %s\n", e.Method, e.URL)
+	if e.Key != "" {
+		fmt.Fprintf(&b, "key: %q\n", e.Key)
+		fmt.Fprintf(&b, "path: %s", e.Path)
+		return b.String()
+	}
+	if e.Custom {
+		fmt.Fprintf(&b, "directory: %s\n", strings.Join(e.Components, " / "))
+		fmt.Fprintf(&b, "checksum: %s\n", orNone(e.Checksum))
+		fmt.Fprintf(&b, "path: %s\n", e.Path)
+		fmt.Fprintf(&b, "generic path: %s", e.GenericPath)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "directory: %s\n", strings.Join(e.Components, " / "))
+	writeValues(&b, "header", "included", e.IncludedHeaders)
+	writeValues(&b, "header", "omitted", e.OmittedHeaders)
+	where := "checksum"
+	if e.QueryInPath {
+		where = "path"
+	}
+	writeValues(&b, "query", "included in "+where, e.IncludedQuery)
+	writeValues(&b, "query", "omitted", e.OmittedQuery)
+	switch {
+	case e.BodyIgnored:
+		b.WriteString("body: ignored\n")
+	case e.BodySize > 0:
+		fmt.Fprintf(&b, "body: %d bytes included\n", e.BodySize)
+	default:
+		b.WriteString("body: none\n")
+	}
+	fmt.Fprintf(&b, "checksum: %s\n", orNone(e.Checksum))
+	fmt.Fprintf(&b, "path: %s\n", e.Path)
+	fmt.Fprintf(&b, "generic path: %s", e.GenericPath)
+	return b.String()
+}
+
+// orNone returns s, or "none" if it is empty.
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// writeValues writes a line to b for each of the keys of values, in order.
+func writeValues(b *strings.Builder, kind, status string, values map[string][]string) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := values[k]
+		if _, ok := redactedHeaders[textproto.CanonicalMIMEHeaderKey(k)]; ok && kind == "header" {
+			v = []string{"<redacted>"}
+		}
+		fmt.Fprintf(b, "%s %s: %q (%s)\n", kind, k, v, status)
+	}
+}
@@ -0,0 +1,120 @@
+package replay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"reflect"
+)
+
+// RecordedRequest is a fingerprint of the request a Recording was made for. It
+// contains the parts of the request that the PathGenerator considers when
+// calculating the checksum. See RoundTripper.SaveRequest and VerifyRequest.
+type RecordedRequest struct {
+	Method string `json:"method"`
+	// URL is the URL of the request, with HostAliases and IgnorePort applied
+	// to the host, and only the query parameters that are considered.
+	URL string `json:"url"`
+	// Headers are the headers that are considered.
+	Headers http.Header `json:"headers,omitempty"`
+	// BodySHA256 is the hex encoded SHA-256 digest of the body as it is
+	// hashed, after MungeRequestBody, IgnoreJSONFields and OmitFormParams
+	// are applied. It is empty if there is no body, or if IgnoreBody is
+	// true.
+	BodySHA256 string `json:"body_sha256,omitempty"`
+}
+
+// RequestFingerprint returns the fingerprint of req. As for RequestCRC, the
+// body of req is replaced or rewound so that it can still be sent.
+func (p *PathGenerator) RequestFingerprint(req *http.Request) (*RecordedRequest, error) {
+	u := *req.URL
+	u.User = nil
+	u.Fragment = ""
+	u.Host = p.host(u.Host)
+	q := p.query(req)
+	query := url.Values{}
+	for _, k := range q.keys(p.AllowQuery, p.OmitQuery, p.foldQuery()) {
+		query[k] = q[k]
+	}
+	u.RawQuery = query.Encode()
+	fp := &RecordedRequest{Method: req.Method, URL: u.String()}
+
+	header := req.Header
+	var foldHeader func(string) string
+	if !p.ExactNames {
+		header = canonicalHeader(header)
+		foldHeader = textproto.CanonicalMIMEHeaderKey
+	}
+	header = p.hostHeader(header)
+	for _, k := range hashableMap(header).keys(p.AllowHeaders, p.OmitHeaders, foldHeader) {
+		if fp.Headers == nil {
+			fp.Headers = make(http.Header)
+		}
+		fp.Headers[k] = header[k]
+	}
+
+	if req.Body != nil && !p.IgnoreBody {
+		h := sha256.New()
+		n, err := p.hashRequestBody(h, req)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			fp.BodySHA256 = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+	return fp, nil
+}
+
+// mismatch returns a *MismatchError describing the first difference between
+// the fingerprint of the recording at path and that of the live request, or
+// nil if they are the same.
+func (f *RecordedRequest) mismatch(path string, live *RecordedRequest) *MismatchError {
+	e := &MismatchError{Path: path}
+	switch {
+	case f.Method != live.Method:
+		e.Field, e.Expected, e.Actual = "method", f.Method, live.Method
+	case f.URL != live.URL:
+		e.Field, e.Expected, e.Actual = "url", f.URL, live.URL
+	case f.BodySHA256 != live.BodySHA256:
+		e.Field, e.Expected, e.Actual = "body", f.BodySHA256, live.BodySHA256
+	default:
+		for _, k := range hashableMap(f.Headers).keys(nil, nil, nil) {
+			if !reflect.DeepEqual(f.Headers[k], live.Headers[k]) {
+				e.Field = "header " + k
+				e.Expected = fmt.Sprintf("%q", f.Headers[k])
+				e.Actual = fmt.Sprintf("%q", live.Headers[k])
+				return e
+			}
+		}
+		for _, k := range hashableMap(live.Headers).keys(nil, nil, nil) {
+			if _, ok := f.Headers[k]; !ok {
+				e.Field = "header " + k
+				e.Expected = "[]"
+				e.Actual = fmt.Sprintf("%q", live.Headers[k])
+				return e
+			}
+		}
+		return nil
+	}
+	return e
+}
+
+// verifyRequest returns an *Error wrapping a *MismatchError if rec, loaded from
+// path, has a fingerprint that doesn't match req.
+func (r *RoundTripper) verifyRequest(req *http.Request, path string, rec *Recording) error {
+	if rec.Request == nil {
+		return nil
+	}
+	live, err := r.fingerprint(req)
+	if err != nil {
+		return &Error{Request: req, Err: err, Path: path}
+	}
+	if mismatch := rec.Request.mismatch(path, live); mismatch != nil {
+		return &Error{Request: req, Err: mismatch, Path: path}
+	}
+	return nil
+}
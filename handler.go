@@ -0,0 +1,101 @@
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// handler is a responder registered with RoundTripper.Handle.
+type handler struct {
+	pattern string
+	fn      func(*http.Request) (*Recording, error)
+}
+
+// match reports whether the handler handles requests whose recordings are in
+// dir, a slash-separated path relative to the recording directory.
+func (h *handler) match(dir string) bool {
+	if strings.ContainsAny(h.pattern, `*?[\`) {
+		ok, _ := path.Match(h.pattern, dir)
+		return ok
+	}
+	prefix := strings.TrimSuffix(h.pattern, "/")
+	return dir == prefix || strings.HasPrefix(dir, prefix+"/")
+}
+
+// Handle registers fn to respond to requests whose recordings would be in a
+// directory matching pattern, instead of looking for a recording on disk.
+// The directory is the slash-separated path generated by the PathGenerator,
+// without the filename, e.g. "http/example.com/POST/echo". If pattern contains
+// any of the characters "*?[\", it is matched as with path.Match; otherwise it
+// matches the directory and any of its subdirectories. Handlers are consulted
+// in the order they were registered, in all modes except ModeRecordOnly.
+//
+// The Recording returned by fn is served like one loaded from disk, as if from
+// the path generated for the request: OnReplay is called, usage is tracked,
+// and MaxReplays, DelayMS, EnableTemplates, BodyRewrites and the other
+// playback settings apply. If it has an Error, that is returned instead. Once
+// its MaxReplays are used up, the request is handled as if there were no
+// handler. If SaveHandled is true and the Mode allows recording, it is also
+// saved. If fn returns an error, or no Recording, it is returned as an *Error.
+func (r *RoundTripper) Handle(pattern string, fn func(*http.Request) (*Recording, error)) {
+	r.mu.Lock()
+	r.handlers = append(r.handlers, &handler{pattern: pattern, fn: fn})
+	r.mu.Unlock()
+}
+
+// handler returns the first registered handler that matches rp, or nil.
+func (r *RoundTripper) handler(rp *RecordingPath) *handler {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.handlers) == 0 {
+		return nil
+	}
+	dir := filepath.ToSlash(rp.dir)
+	for _, h := range r.handlers {
+		if h.match(dir) {
+			return h
+		}
+	}
+	return nil
+}
+
+// handle responds to req with h, saving the Recording to path if SaveHandled
+// is true. The Recording is played back like one loaded from path, so it
+// returns errReplaysUsedUp once its MaxReplays are used up.
+func (r *RoundTripper) handle(req *http.Request, h *handler, path string) (*http.Response, error) {
+	rec, err := h.fn(req)
+	if err != nil {
+		return nil, &Error{Request: req, Err: err}
+	}
+	if rec == nil {
+		return nil, &Error{Request: req, Err: errors.New("replay: handler returned no recording")}
+	}
+	if r.SaveHandled && r.Mode != ModePlaybackOnly && r.Mode != ModeVerify {
+		// The recording is saved like a live response, so that
+		// OmitResponseHeaders, FilterResponse and RecordBodyRewrites apply
+		// to the saved copy, but not to the response.
+		saved := *rec
+		unlock := r.lockPath(path)
+		err := r.saveRecording(req, nil, &saved, path, nil)
+		unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.Logger != nil {
+		r.Logger.DebugContext(req.Context(), "replay handled", "pattern", h.pattern)
+	}
+	// Playing back may change the recording, e.g. its headers if
+	// EnableTemplates is true, so a copy is played back, in case the
+	// handler returns the same one each time.
+	played := *rec
+	played.Headers = rec.Headers.Clone()
+	body := newContextBody(req, path, ioutil.NopCloser(bytes.NewReader(rec.Body)))
+	res, _, err := r.replay(req, path, &played, body, int64(len(rec.Body)), false)
+	return res, err
+}
@@ -0,0 +1,138 @@
+package replay
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// harLog is the subset of the HAR 1.2 format used by ImportHAR.
+type harLog struct {
+	Log struct {
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	Request struct {
+		Method      string      `json:"method"`
+		URL         string      `json:"url"`
+		HTTPVersion string      `json:"httpVersion"`
+		Headers     []harHeader `json:"headers"`
+		PostData    *struct {
+			MimeType string `json:"mimeType"`
+			Text     string `json:"text"`
+		} `json:"postData"`
+	} `json:"request"`
+	Response struct {
+		Status      int         `json:"status"`
+		StatusText  string      `json:"statusText"`
+		HTTPVersion string      `json:"httpVersion"`
+		Headers     []harHeader `json:"headers"`
+		Content     struct {
+			Text     string `json:"text"`
+			Encoding string `json:"encoding"`
+		} `json:"content"`
+	} `json:"response"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// ImportHAR reads an HTTP Archive (HAR) file from r, and saves a Recording
+// under dir for each entry, at the path generated for the entry's request by
+// gen. If gen is nil, NewPathGenerator is used. It returns the number of
+// recordings that were saved. Entries that can't be converted are skipped, and
+// the errors for all of them are returned together once the rest have been
+// imported.
+func ImportHAR(r io.Reader, dir string, gen *PathGenerator) (int, error) {
+	if gen == nil {
+		gen = NewPathGenerator()
+	}
+	var har harLog
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return 0, err
+	}
+	var errs []error
+	n := 0
+	for i := range har.Log.Entries {
+		if err := importHAREntry(&har.Log.Entries[i], dir, gen); err != nil {
+			errs = append(errs, fmt.Errorf("entry %d: %v", i, err))
+			continue
+		}
+		n++
+	}
+	return n, errors.Join(errs...)
+}
+
+func importHAREntry(entry *harEntry, dir string, gen *PathGenerator) error {
+	var body io.Reader
+	if entry.Request.PostData != nil && entry.Request.PostData.Text != "" {
+		body = strings.NewReader(entry.Request.PostData.Text)
+	}
+	req, err := http.NewRequest(entry.Request.Method, entry.Request.URL, body)
+	if err != nil {
+		return err
+	}
+	for _, h := range entry.Request.Headers {
+		// Skip HTTP/2 pseudo-headers, and headers that http.Request keeps in
+		// other fields.
+		name := http.CanonicalHeaderKey(h.Name)
+		if strings.HasPrefix(name, ":") || name == "Host" {
+			continue
+		}
+		req.Header.Add(h.Name, h.Value)
+	}
+	if entry.Request.PostData != nil && req.Header.Get("Content-Type") == "" &&
+		entry.Request.PostData.MimeType != "" {
+		req.Header.Set("Content-Type", entry.Request.PostData.MimeType)
+	}
+	path, err := gen.RecordingPath(req)
+	if err != nil {
+		return err
+	}
+
+	res := &entry.Response
+	if res.Status == 0 {
+		return errors.New("missing response status")
+	}
+	rec := &Recording{
+		Status:     strings.TrimSpace(strconv.Itoa(res.Status) + " " + res.StatusText),
+		StatusCode: res.Status,
+		Headers:    make(http.Header),
+		Body:       []byte(res.Content.Text),
+	}
+	major, minor, ok := http.ParseHTTPVersion(strings.ToUpper(res.HTTPVersion))
+	if ok {
+		rec.Proto = fmt.Sprintf("HTTP/%d.%d", major, minor)
+		rec.ProtoMajor, rec.ProtoMinor = major, minor
+	} else {
+		rec.Proto = res.HTTPVersion
+	}
+	for _, h := range res.Headers {
+		if !strings.HasPrefix(h.Name, ":") {
+			rec.Headers.Add(h.Name, h.Value)
+		}
+	}
+	if res.Content.Encoding == "base64" {
+		if rec.Body, err = base64.StdEncoding.DecodeString(res.Content.Text); err != nil {
+			return err
+		}
+	}
+	// HAR content is stored decoded, so the headers describing the encoding on
+	// the wire no longer apply.
+	if rec.Headers.Get("Content-Encoding") != "" {
+		rec.Headers.Del("Content-Encoding")
+		rec.Headers.Del("Content-Length")
+		rec.Uncompressed = true
+	}
+	return rec.Save(filepath.Join(dir, path.Path()))
+}
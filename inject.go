@@ -0,0 +1,139 @@
+package replay
+
+import (
+	"context"
+	"io"
+	"os"
+	"syscall"
+)
+
+// Types of InjectedError.
+const (
+	InjectTimeout         = "timeout"
+	InjectConnectionReset = "connection_reset"
+	InjectEOF             = "eof"
+)
+
+// InjectedError is a transport error that a hand-written recording makes
+// RoundTripper return in place of a response, e.g. to simulate a timeout for
+// one request. It is written as the "inject_error" object of the recording:
+//
+//	{"inject_error": {"type": "timeout", "message": "upstream timed out"}}
+//
+// Type is one of the Inject constants; loading a recording with any other type
+// fails. Recordings are never saved with an InjectedError, unless one is set
+// explicitly. A RoundTripper with IgnoreFaults set plays back the rest of the
+// recording instead.
+type InjectedError struct {
+	Type string `json:"type"`
+	// Message, if not empty, replaces the default message for Type.
+	Message string `json:"message,omitempty"`
+}
+
+func (e *InjectedError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	switch e.Type {
+	case InjectTimeout:
+		return "i/o timeout"
+	case InjectConnectionReset:
+		return syscall.ECONNRESET.Error()
+	}
+	return io.EOF.Error()
+}
+
+// Timeout reports whether the error is a timeout. It allows the error to
+// satisfy the net.Error interface.
+func (e *InjectedError) Timeout() bool {
+	return e.Type == InjectTimeout
+}
+
+// Temporary reports whether the error is a timeout. It allows the error to
+// satisfy the net.Error interface.
+func (e *InjectedError) Temporary() bool {
+	return e.Timeout()
+}
+
+// Unwrap returns the standard library errors that the error matches with
+// errors.Is: os.ErrDeadlineExceeded and context.DeadlineExceeded for timeouts,
+// syscall.ECONNRESET for connection resets, and io.EOF for EOFs.
+func (e *InjectedError) Unwrap() []error {
+	switch e.Type {
+	case InjectTimeout:
+		return []error{os.ErrDeadlineExceeded, context.DeadlineExceeded}
+	case InjectConnectionReset:
+		return []error{syscall.ECONNRESET}
+	case InjectEOF:
+		return []error{io.EOF}
+	}
+	return nil
+}
+
+// valid reports whether Type is one of the Inject constants.
+func (e *InjectedError) valid() bool {
+	switch e.Type {
+	case InjectTimeout, InjectConnectionReset, InjectEOF:
+		return true
+	}
+	return false
+}
+
+// Values of the BodyError of a Recording.
+const (
+	BodyErrorUnexpectedEOF = "unexpected_eof"
+	BodyErrorReset         = "reset"
+)
+
+// bodyError returns the error for the BodyError of r, or nil if it has none.
+func (r *Recording) bodyError() error {
+	switch r.BodyError {
+	case "":
+		if r.TruncateBodyAt > 0 {
+			return io.ErrUnexpectedEOF
+		}
+	case BodyErrorUnexpectedEOF:
+		return io.ErrUnexpectedEOF
+	case BodyErrorReset:
+		return &InjectedError{Type: InjectConnectionReset}
+	}
+	return nil
+}
+
+// validBodyError reports whether the BodyError of r is empty or one of the
+// BodyError constants.
+func (r *Recording) validBodyError() bool {
+	switch r.BodyError {
+	case "", BodyErrorUnexpectedEOF, BodyErrorReset:
+		return true
+	}
+	return false
+}
+
+// faultyBody is a response body that fails with err after n bytes.
+type faultyBody struct {
+	io.ReadCloser
+	n   int64
+	err error
+}
+
+// newFaultyBody returns body, which fails with err after n bytes.
+func newFaultyBody(body io.ReadCloser, n int64, err error) *faultyBody {
+	return &faultyBody{ReadCloser: body, n: n, err: err}
+}
+
+func (b *faultyBody) Read(p []byte) (int, error) {
+	if b.n <= 0 {
+		return 0, b.err
+	}
+	if int64(len(p)) > b.n {
+		p = p[:b.n]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n -= int64(n)
+	if err == io.EOF {
+		// The body is shorter than n, so it fails at its end.
+		b.n, err = 0, b.err
+	}
+	return n, err
+}
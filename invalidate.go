@@ -0,0 +1,77 @@
+package replay
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Invalidate removes the recording for req, i.e. the file with the checksum
+// that new recordings of req are saved to, so that it is recorded again in
+// ModeRecordIfMissing. Recordings are removed from the directory new
+// recordings are saved to, never from Dirs or BaseDir. Any cached copy is
+// evicted. If there is no recording, an *Error wrapping a *NotFoundError is
+// returned, which matches ErrRecordingNotFound. See InvalidateGeneric.
+func (r *RoundTripper) Invalidate(req *http.Request) error {
+	return r.invalidate(req, false)
+}
+
+// InvalidateGeneric is like Invalidate, but also removes the generic recording
+// for req, without a checksum. It only returns an error matching
+// ErrRecordingNotFound if neither exists.
+func (r *RoundTripper) InvalidateGeneric(req *http.Request) error {
+	return r.invalidate(req, true)
+}
+
+func (r *RoundTripper) invalidate(req *http.Request, generic bool) error {
+	r.defaults.Do(r.setDefaults)
+	recordingPath, err := r.recordingPath(req)
+	if err != nil {
+		return &Error{Request: req, Err: err}
+	}
+	dir := r.recordDir(r.subdir(req))
+	paths := []string{filepath.Join(dir, recordingPath.Path())}
+	if genericPath := filepath.Join(dir, recordingPath.GenericPath()); generic && genericPath != paths[0] {
+		paths = append(paths, genericPath)
+	}
+	removed := false
+	var notExist error
+	for _, path := range paths {
+		unlock := r.lockPath(path)
+		err := os.Remove(path)
+		r.uncache(path)
+		unlock()
+		if os.IsNotExist(err) {
+			notExist = err
+		} else if err != nil {
+			return &Error{Request: req, Err: err, Path: path}
+		} else {
+			removed = true
+		}
+	}
+	if !removed {
+		return &Error{Request: req, Err: &NotFoundError{
+			Method:   req.Method,
+			URL:      req.URL.String(),
+			Paths:    paths,
+			Checksum: recordingPath.checksum,
+			Err:      notExist,
+		}}
+	}
+	return nil
+}
+
+// Refresh fetches the response for req with the wrapped RoundTripper, whatever
+// the Mode, and saves it to the path that new recordings of req are saved to,
+// replacing any existing recording. The recording is filtered, and hooks are
+// called, as for any other new recording. It can be used to update a single
+// recording without re-recording all of them in ModeRecordOnly.
+func (r *RoundTripper) Refresh(req *http.Request) (*http.Response, error) {
+	r.defaults.Do(r.setDefaults)
+	recordingPath, err := r.recordingPath(req)
+	if err != nil {
+		return nil, &Error{Request: req, Err: err}
+	}
+	path := filepath.Join(r.recordDir(r.subdir(req)), recordingPath.Path())
+	return r.record(req, path, r.lockPath(path))
+}
@@ -0,0 +1,83 @@
+package replay
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// keyPath returns the recording path for a key returned by KeyFunc. The key is
+// split into components at slashes, and each is escaped as by p, so that it is
+// a safe filename. ".json" is appended to the last component unless it already
+// ends with it.
+func (p *PathGenerator) keyPath(key string) *RecordingPath {
+	var parts []string
+	for _, component := range strings.Split(key, "/") {
+		if component == "" {
+			continue
+		}
+		component = p.escape(component)
+		if p.EscapeUppercase {
+			component = escapeUppercase(component)
+		}
+		parts = append(parts, component)
+	}
+	if len(parts) == 0 {
+		// The key is all slashes.
+		parts = append(parts, "%2F")
+	}
+	name := parts[len(parts)-1]
+	parts = parts[:len(parts)-1]
+	if strings.HasPrefix(name, ".") {
+		// Recordings can't be hidden files.
+		name = "%2E" + name[1:]
+	}
+	if !strings.HasSuffix(name, ".json") {
+		name += ".json"
+	}
+	return &RecordingPath{
+		dir:         strings.Join(parts, string(os.PathSeparator)),
+		name:        name,
+		genericName: name,
+	}
+}
+
+// noteKey records that key was returned by KeyFunc for req, for DuplicateKeys,
+// if TrackUsage is true.
+func (r *RoundTripper) noteKey(key string, req *http.Request) {
+	if !r.TrackUsage {
+		return
+	}
+	r.mu.Lock()
+	if r.keys == nil {
+		r.keys = make(map[string]StringSet)
+	}
+	if r.keys[key] == nil {
+		r.keys[key] = NewStringSet()
+	}
+	r.keys[key].Add(req.Method + " " + req.URL.String())
+	r.mu.Unlock()
+}
+
+// DuplicateKeys returns the keys returned by KeyFunc for more than one distinct
+// request, i.e. method and URL, mapped to those requests, sorted. Requests that
+// differ only in headers or body aren't told apart. Keys are only tracked if
+// TrackUsage is true.
+func (r *RoundTripper) DuplicateKeys() map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	duplicates := make(map[string][]string)
+	for key, requests := range r.keys {
+		if len(requests) < 2 {
+			continue
+		}
+		list := make([]string, 0, len(requests))
+		for req := range requests {
+			list = append(list, req)
+		}
+		sort.Strings(list)
+		duplicates[key] = list
+	}
+	return duplicates
+}
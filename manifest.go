@@ -0,0 +1,191 @@
+package replay
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ManifestFileName is the name of the manifest written by WriteManifest. Files
+// with this name aren't treated as recordings.
+const ManifestFileName = "manifest.json"
+
+// A Manifest summarizes the recordings in a directory tree, e.g. for reviewing
+// changes to them. See WriteManifest.
+type Manifest struct {
+	// Recordings are sorted by Path.
+	Recordings []ManifestEntry `json:"recordings"`
+}
+
+// A ManifestEntry summarizes a recording.
+type ManifestEntry struct {
+	// Path is the slash-separated path of the recording, relative to the
+	// directory of the manifest.
+	Path string `json:"path"`
+	// Method and URL are those of the request, reconstructed from Path as
+	// for ToVCRCassette. They are empty if Path isn't in the layout
+	// generated by the PathGenerator.
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+	// Error is the message of a recorded transport error.
+	Error       string `json:"error,omitempty"`
+	StatusCode  int    `json:"status_code,omitempty"`
+	BodySize    int64  `json:"body_size"`
+	ContentType string `json:"content_type,omitempty"`
+	// RecordedAt is the time from the Date header of the response, if there
+	// is one.
+	RecordedAt *time.Time `json:"recorded_at,omitempty"`
+}
+
+// WriteManifest writes a Manifest of the recordings under dir, in the layout
+// generated by NewPathGenerator, to dir/manifest.json. See
+// WriteManifestWithGenerator.
+func WriteManifest(dir string) error {
+	return WriteManifestWithGenerator(dir, nil)
+}
+
+// WriteManifestWithGenerator writes a Manifest of the recordings under dir to
+// dir/manifest.json. The manifest is deterministic, so that it changes only
+// when the recordings do. The requests are reconstructed from the paths of the
+// recordings as by ToVCRCassette, in the layout generated by gen, or by
+// NewPathGenerator if gen is nil.
+func WriteManifestWithGenerator(dir string, gen *PathGenerator) error {
+	if gen == nil {
+		gen = NewPathGenerator()
+	}
+	var m Manifest
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isRecordingFile(info.Name()) {
+			return err
+		}
+		entry, err := newManifestEntry(dir, path, gen)
+		if err != nil {
+			return err
+		}
+		m.Recordings = append(m.Recordings, *entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return m.save(filepath.Join(dir, ManifestFileName))
+}
+
+// ReadManifest reads the manifest at path, e.g. one written by WriteManifest.
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// newManifestEntry returns the entry for the recording at path, in the layout
+// generated by gen, for a manifest in dir. If gen is nil, the layout is
+// unknown, and the method and URL are left empty.
+func newManifestEntry(dir, path string, gen *PathGenerator) (*ManifestEntry, error) {
+	rec, body, size, err := loadRecordingStream(path)
+	if err != nil {
+		return nil, err
+	}
+	body.Close()
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return nil, err
+	}
+	entry := &ManifestEntry{
+		Path:        filepath.ToSlash(rel),
+		StatusCode:  rec.StatusCode,
+		BodySize:    size,
+		ContentType: rec.Headers.Get("Content-Type"),
+	}
+	if len(rec.Chunks) > 0 {
+		entry.BodySize = chunksSize(rec.Chunks)
+	}
+	if gen != nil {
+		if method, u, err := requestFromPath(rel, gen); err == nil {
+			entry.Method, entry.URL = method, u.String()
+		}
+	}
+	if rec.Error != nil {
+		entry.Error = rec.Error.Message
+	}
+	if date, err := http.ParseTime(rec.Headers.Get("Date")); err == nil {
+		date = date.UTC()
+		entry.RecordedAt = &date
+	}
+	return entry, nil
+}
+
+// update adds or replaces entry.
+func (m *Manifest) update(entry *ManifestEntry) {
+	i := sort.Search(len(m.Recordings), func(i int) bool {
+		return m.Recordings[i].Path >= entry.Path
+	})
+	if i < len(m.Recordings) && m.Recordings[i].Path == entry.Path {
+		m.Recordings[i] = *entry
+		return
+	}
+	m.Recordings = append(m.Recordings, ManifestEntry{})
+	copy(m.Recordings[i+1:], m.Recordings[i:])
+	m.Recordings[i] = *entry
+}
+
+// save writes m to path, sorted and indented, replacing the file atomically.
+func (m *Manifest) save(path string) error {
+	sort.Slice(m.Recordings, func(i, j int) bool {
+		return m.Recordings[i].Path < m.Recordings[j].Path
+	})
+	if m.Recordings == nil {
+		m.Recordings = []ManifestEntry{}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
+
+// updateManifest adds the recording saved to path to the manifest at
+// ManifestPath, if it is set.
+func (r *RoundTripper) updateManifest(req *http.Request, path string) error {
+	if r.ManifestPath == "" {
+		return nil
+	}
+	r.manifestMu.Lock()
+	defer r.manifestMu.Unlock()
+	m, err := ReadManifest(r.ManifestPath)
+	if os.IsNotExist(err) {
+		m, err = &Manifest{}, nil
+	}
+	// Paths from KeyFunc or a Pather aren't in the layout of the
+	// PathGenerator.
+	gen := r.PathGenerator
+	if r.KeyFunc != nil || r.Pather != nil {
+		gen = nil
+	}
+	var entry *ManifestEntry
+	if err == nil {
+		entry, err = newManifestEntry(filepath.Dir(r.ManifestPath), path, gen)
+	}
+	if err == nil {
+		m.update(entry)
+		err = m.save(r.ManifestPath)
+	}
+	if err != nil {
+		return &Error{Request: req, Err: err, Path: r.ManifestPath}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package replay
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Mode determines whether a RoundTripper plays back recordings, records new
+// ones, or both.
+type Mode int
+
+const (
+	// ModeRecordIfMissing enables playing back recordings that exist, and
+	// recording new responses when a recording isn't found.
+	ModeRecordIfMissing Mode = iota
+	// ModePlaybackOnly enables playing back content only.
+	ModePlaybackOnly
+	// ModeRecordOnly enables recording new content only.
+	ModeRecordOnly
+	// ModeVerify enables playing back content only, as for ModePlaybackOnly,
+	// but also sends each request that has a recording, and reports any
+	// differences between the live and recorded responses. See Drifts.
+	ModeVerify
+)
+
+// modeNames maps the names accepted by ParseMode to modes.
+var modeNames = map[string]Mode{
+	"record-if-missing": ModeRecordIfMissing,
+	"auto":              ModeRecordIfMissing,
+	"playback-only":     ModePlaybackOnly,
+	"playback":          ModePlaybackOnly,
+	"replay":            ModePlaybackOnly,
+	"record-only":       ModeRecordOnly,
+	"record":            ModeRecordOnly,
+	"verify":            ModeVerify,
+}
+
+// String returns the name of m, e.g. "playback-only", or "Mode(n)" if m isn't
+// one of the Mode constants.
+func (m Mode) String() string {
+	switch m {
+	case ModeRecordIfMissing:
+		return "record-if-missing"
+	case ModePlaybackOnly:
+		return "playback-only"
+	case ModeRecordOnly:
+		return "record-only"
+	case ModeVerify:
+		return "verify"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// valid reports whether m is one of the Mode constants.
+func (m Mode) valid() bool {
+	return m >= ModeRecordIfMissing && m <= ModeVerify
+}
+
+// ParseMode returns the mode with the given name, as returned by String, in any
+// letter case. The aliases "auto" for "record-if-missing", "replay" and
+// "playback" for "playback-only", and "record" for "record-only" are also
+// accepted.
+func ParseMode(name string) (Mode, error) {
+	mode, ok := modeNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return 0, fmt.Errorf("replay: invalid mode %q", name)
+	}
+	return mode, nil
+}
@@ -0,0 +1,143 @@
+package replay
+
+import "net/http"
+
+// An Option configures a RoundTripper.
+type Option func(*RoundTripper)
+
+// WithDir sets the directory that recordings are read from and written to.
+func WithDir(dir string) Option {
+	return func(r *RoundTripper) {
+		r.Dir = dir
+	}
+}
+
+// WithMode sets the Mode of the RoundTripper.
+func WithMode(mode Mode) Option {
+	return func(r *RoundTripper) {
+		r.Mode = mode
+	}
+}
+
+// WithTransport sets the http.RoundTripper used to make live requests.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(r *RoundTripper) {
+		r.RoundTripper = transport
+	}
+}
+
+// WithStore returns an Option that sets the Store of a RoundTripper, e.g. to a
+// *Cassette.
+func WithStore(store Store) Option {
+	return func(r *RoundTripper) {
+		r.Store = store
+	}
+}
+
+// WithStrictPath sets StrictPath, so that recordings without a checksum aren't
+// played back for requests with one.
+func WithStrictPath() Option {
+	return func(r *RoundTripper) {
+		r.StrictPath = true
+	}
+}
+
+// WithPathGenerator sets the PathGenerator. Options that modify the
+// PathGenerator, such as WithOmitHeaders, should come after it.
+func WithPathGenerator(pg *PathGenerator) Option {
+	return func(r *RoundTripper) {
+		r.PathGenerator = pg
+	}
+}
+
+// WithPather sets the Pather, which generates the paths of recordings in place
+// of the PathGenerator.
+func WithPather(pather Pather) Option {
+	return func(r *RoundTripper) {
+		r.Pather = pather
+	}
+}
+
+// WithOmitHeaders adds headers to the OmitHeaders of the PathGenerator.
+func WithOmitHeaders(headers ...string) Option {
+	return func(r *RoundTripper) {
+		pg := r.pathGenerator()
+		if pg.OmitHeaders == nil {
+			pg.OmitHeaders = NewStringSet()
+		}
+		pg.OmitHeaders.Add(headers...)
+	}
+}
+
+// WithOmitQuery adds query string parameters to the OmitQuery of the
+// PathGenerator.
+func WithOmitQuery(params ...string) Option {
+	return func(r *RoundTripper) {
+		pg := r.pathGenerator()
+		if pg.OmitQuery == nil {
+			pg.OmitQuery = NewStringSet()
+		}
+		pg.OmitQuery.Add(params...)
+	}
+}
+
+// pathGenerator returns the PathGenerator, setting it to NewPathGenerator()
+// first if it is nil.
+func (r *RoundTripper) pathGenerator() *PathGenerator {
+	if r.PathGenerator == nil {
+		r.PathGenerator = NewPathGenerator()
+	}
+	return r.PathGenerator
+}
+
+// NewRoundTripper returns a *RoundTripper that keeps recordings in dir, in
+// ModeRecordIfMissing, with http.DefaultTransport and NewPathGenerator(),
+// configured by opts. Options must be applied before the RoundTripper is
+// first used.
+func NewRoundTripper(dir string, opts ...Option) *RoundTripper {
+	r := &RoundTripper{
+		Dir:           dir,
+		RoundTripper:  http.DefaultTransport,
+		PathGenerator: NewPathGenerator(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// NewClientWithOptions returns an *http.Client whose Transport is the
+// *RoundTripper returned by NewRoundTripper(dir, opts...).
+func NewClientWithOptions(dir string, opts ...Option) *http.Client {
+	return &http.Client{Transport: NewRoundTripper(dir, opts...)}
+}
+
+// WrapTransport returns a *RoundTripper, as returned by NewRoundTripper, that
+// keeps recordings in dir and makes live requests with base, or with
+// http.DefaultTransport if base is nil. Options are applied afterwards, so
+// WithTransport replaces base.
+//
+// Where replay sits relative to other transports matters. Wrapping a transport
+// that adds credentials, such as an oauth2.Transport, puts replay above it:
+// requests are hashed and played back without the credentials, and the
+// credentials transport isn't used at all for playback, so tests need no
+// tokens. Wrapping the returned RoundTripper with the credentials transport
+// instead puts replay below it: the Authorization header is seen, but it is
+// omitted from checksums by DefaultOmitHeaders, and tokens are still fetched
+// for playback.
+func WrapTransport(base http.RoundTripper, dir string, opts ...Option) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return NewRoundTripper(dir, append([]Option{WithTransport(base)}, opts...)...)
+}
+
+// WrapClient returns a copy of c whose Transport is that returned by
+// WrapTransport(c.Transport, dir, opts...), so that replay sits above the
+// existing transport. The Timeout, Jar and CheckRedirect of c are kept, and c
+// isn't modified.
+func WrapClient(c *http.Client, dir string, opts ...Option) *http.Client {
+	wrapped := *c
+	wrapped.Transport = WrapTransport(c.Transport, dir, opts...)
+	return &wrapped
+}
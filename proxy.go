@@ -0,0 +1,102 @@
+package replay
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are headers that apply to a single connection, and aren't
+// forwarded by a proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// NewProxyHandler returns an http.Handler that implements an HTTP/1.1 forward
+// proxy. Requests with an absolute URI are passed to rt, so that their
+// responses are recorded or played back according to its Mode, and the
+// responses are copied back to the client with their status, headers, body
+// and trailers. Hop-by-hop headers aren't forwarded in either direction.
+// CONNECT requests aren't supported, so HTTPS can't be proxied, and are
+// rejected with 501 Not Implemented.
+//
+// This allows recording and playing back responses for clients that can be
+// configured to use a proxy, e.g. with the HTTP_PROXY environment variable, but
+// not to use a particular *http.Client.
+func NewProxyHandler(rt *RoundTripper) http.Handler {
+	return &proxyHandler{rt: rt}
+}
+
+type proxyHandler struct {
+	rt *RoundTripper
+}
+
+func (p *proxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodConnect {
+		http.Error(w, "replay: CONNECT is not supported by this proxy",
+			http.StatusNotImplemented)
+		return
+	}
+	if !req.URL.IsAbs() {
+		http.Error(w, "replay: proxy requests must use an absolute URL",
+			http.StatusBadRequest)
+		return
+	}
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	if req.ContentLength == 0 {
+		out.Body = nil
+	}
+	removeHopHeaders(out.Header)
+	res, err := p.rt.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeResponse(w, res)
+}
+
+// writeResponse copies res to w, omitting hop-by-hop headers, and closes the
+// response body.
+func writeResponse(w http.ResponseWriter, res *http.Response) {
+	defer res.Body.Close()
+	for k, v := range res.Header {
+		w.Header()[k] = v
+	}
+	removeHopHeaders(w.Header())
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+	for k, v := range res.Trailer {
+		w.Header()[http.TrailerPrefix+k] = v
+	}
+}
+
+func removeHopHeaders(header http.Header) {
+	// Headers named in Connection are also hop-by-hop.
+	for _, v := range header["Connection"] {
+		for _, name := range splitHeaderList(v) {
+			header.Del(name)
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+func splitHeaderList(v string) []string {
+	var names []string
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
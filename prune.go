@@ -0,0 +1,93 @@
+package replay
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Prune removes the recordings under dir that keep rejects, and any
+// directories under dir that are left empty. keep is called with the path of
+// each recording, including dir, and the recording, whose Body isn't loaded.
+// It returns the paths of the removed recordings, in sorted order. It stops at
+// the first error, such as a recording that can't be parsed. See PruneDryRun.
+func Prune(dir string, keep func(path string, rec *Recording) bool) ([]string, error) {
+	return prune(dir, keep, false)
+}
+
+// PruneDryRun returns the paths of the recordings that Prune would remove,
+// without removing them.
+func PruneDryRun(dir string, keep func(path string, rec *Recording) bool) ([]string, error) {
+	return prune(dir, keep, true)
+}
+
+func prune(
+	dir string, keep func(path string, rec *Recording) bool, dryRun bool,
+) ([]string, error) {
+	var rejected []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isRecordingFile(info.Name()) {
+			return err
+		}
+		rec, body, _, err := loadRecordingStream(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		body.Close()
+		if !keep(path, rec) {
+			rejected = append(rejected, path)
+		}
+		return nil
+	})
+	sort.Strings(rejected)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return rejected, nil
+	}
+	removed := rejected[:0]
+	for _, path := range rejected {
+		if err = os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+		removeEmptyDirs(dir, filepath.Dir(path))
+	}
+	return removed, nil
+}
+
+// removeEmptyDirs removes path and its parents, up to but not including root,
+// for as long as they are empty.
+func removeEmptyDirs(root, path string) {
+	root = filepath.Clean(root)
+	for path = filepath.Clean(path); path != root && len(path) > len(root); path = filepath.Dir(path) {
+		// Remove fails for directories that aren't empty.
+		if os.Remove(path) != nil {
+			return
+		}
+	}
+}
+
+// KeepUsed returns a function for Prune that keeps the recordings in used,
+// e.g. the paths returned by RoundTripper.UsedRecordings.
+func KeepUsed(used StringSet) func(path string, rec *Recording) bool {
+	cleaned := NewStringSet()
+	for path := range used {
+		cleaned.Add(filepath.Clean(path))
+	}
+	return func(path string, rec *Recording) bool {
+		_, ok := cleaned[filepath.Clean(path)]
+		return ok
+	}
+}
+
+// KeepNewerThan returns a function for Prune that keeps the recordings whose
+// files were modified after t.
+func KeepNewerThan(t time.Time) func(path string, rec *Recording) bool {
+	return func(path string, rec *Recording) bool {
+		return rec.ModTime().After(t)
+	}
+}
@@ -0,0 +1,160 @@
+package replay
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// RecordingHandler is an http.Handler that records the responses written by
+// another handler, so that clients of the handler can play them back later.
+// Responses are sent to the client as they are written, including flushes, and
+// are saved once the wrapped handler returns.
+type RecordingHandler struct {
+	// Handler is the wrapped handler.
+	Handler http.Handler
+	// Dir is the base directory where responses are recorded.
+	Dir string
+	// PathGenerator is used to generate the path for each request. The scheme
+	// is "https" if the request was received over TLS, or "http" otherwise,
+	// and the host is taken from the Host header.
+	*PathGenerator
+	// Skip, if not nil, is called for each request before it is passed to
+	// Handler. Requests for which it returns true are not recorded.
+	Skip func(*http.Request) bool
+	// ErrorLog is used to log errors saving recordings. If nil, the log
+	// package's standard logger is used.
+	ErrorLog *log.Logger
+}
+
+// RecordHandler returns a RecordingHandler that records the responses of next
+// to dir, at the paths generated by gen. If gen is nil, NewPathGenerator is
+// used.
+func RecordHandler(next http.Handler, dir string, gen *PathGenerator) *RecordingHandler {
+	if gen == nil {
+		gen = NewPathGenerator()
+	}
+	return &RecordingHandler{Handler: next, Dir: dir, PathGenerator: gen}
+}
+
+func (h *RecordingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.Skip != nil && h.Skip(req) {
+		h.Handler.ServeHTTP(w, req)
+		return
+	}
+
+	clone := req.Clone(req.Context())
+	clone.URL.Scheme = "http"
+	if req.TLS != nil {
+		clone.URL.Scheme = "https"
+	}
+	clone.URL.Host = req.Host
+	path, err := h.PathGenerator.RecordingPath(clone)
+	// The body may have been read and replaced in order to generate the path.
+	req.Body = clone.Body
+	if err != nil {
+		h.logf("replay: failed to generate recording path for %s %s: %v",
+			req.Method, clone.URL, err)
+		h.Handler.ServeHTTP(w, req)
+		return
+	}
+
+	rw := &recordingWriter{ResponseWriter: w}
+	h.Handler.ServeHTTP(rw, req)
+	rec := rw.recording()
+	if err = rec.Save(filepath.Join(h.Dir, path.Path())); err != nil {
+		h.logf("replay: failed to save recording for %s %s: %v",
+			req.Method, clone.URL, err)
+	}
+}
+
+func (h *RecordingHandler) logf(format string, args ...interface{}) {
+	if h.ErrorLog != nil {
+		h.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// recordingWriter is an http.ResponseWriter that keeps a copy of the response
+// written through it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(buf []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(buf)
+	return w.ResponseWriter.Write(buf)
+}
+
+// Flush implements http.Flusher, if the wrapped http.ResponseWriter does.
+func (w *recordingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for http.ResponseController.
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// recording returns a Recording of the response that was written.
+func (w *recordingWriter) recording() *Recording {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	rec := &Recording{
+		Status:     http.StatusText(w.status),
+		StatusCode: w.status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Headers:    w.header,
+		Body:       w.body.Bytes(),
+	}
+	if rec.Status != "" {
+		rec.Status = strconv.Itoa(w.status) + " " + rec.Status
+	}
+	// Trailers are either declared in the Trailer header before the response
+	// is written, or set with http.TrailerPrefix afterwards.
+	final := w.Header()
+	trailers := make(http.Header)
+	for _, v := range w.header["Trailer"] {
+		for _, name := range splitHeaderList(v) {
+			if values, ok := final[http.CanonicalHeaderKey(name)]; ok {
+				trailers[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+	}
+	for k, v := range final {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			trailers[http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = v
+		}
+	}
+	if len(trailers) > 0 {
+		rec.Trailers = trailers
+		rec.Headers.Del("Trailer")
+	}
+	return rec
+}
@@ -4,109 +4,455 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 )
 
 // A Recording represents a recorded HTTP server response. The fields map
 // directly to fields in http.Response, except for Body, which is the body of
-// the server response.
+// the server response, and Error, which is set instead of the other fields if
+// the request failed with a transport error.
 type Recording struct {
-	Status     string      `json:"status,omitempty"`
-	StatusCode int         `json:"status_code,omitempty"`
-	Proto      string      `json:"proto,omitempty"`
-	ProtoMajor int         `json:"proto_major,omitempty"`
-	ProtoMinor int         `json:"proto_minor,omitempty"`
-	Headers    http.Header `json:"headers,omitempty"`
-	Body       []byte      `json:"-"`
+	// FormatVersion is the version of the recording format. Save always
+	// writes FormatVersion. A recording without one is version 1.
+	FormatVersion    int            `json:"format_version,omitempty"`
+	Status           string         `json:"status,omitempty"`
+	StatusCode       int            `json:"status_code,omitempty"`
+	Proto            string         `json:"proto,omitempty"`
+	ProtoMajor       int            `json:"proto_major,omitempty"`
+	ProtoMinor       int            `json:"proto_minor,omitempty"`
+	Headers          http.Header    `json:"headers,omitempty"`
+	Trailers         http.Header    `json:"trailers,omitempty"`
+	ContentLength    int64          `json:"content_length,omitempty"`
+	TransferEncoding []string       `json:"transfer_encoding,omitempty"`
+	Uncompressed     bool           `json:"uncompressed,omitempty"`
+	TLS              *RecordedTLS   `json:"tls,omitempty"`
+	Error            *RecordedError `json:"error,omitempty"`
+	// Request, if not nil, is the fingerprint of the request the recording
+	// was made for. See RoundTripper.SaveRequest.
+	Request *RecordedRequest `json:"request,omitempty"`
+	// Match, if not nil, is the conditions requests must satisfy for this
+	// recording to be played back. See RoundTripper.MatchVariants.
+	Match *RecordingMatch `json:"match,omitempty"`
+	// InjectError, if not nil, is returned by RoundTripper in place of a
+	// response. See InjectedError.
+	InjectError *InjectedError `json:"inject_error,omitempty"`
+	// MaxReplays, if greater than zero, is the number of times a
+	// RoundTripper plays back the recording. After that, it is treated as
+	// if it didn't exist, so the generic recording is tried, and so on. A
+	// replay is only counted once the recording has been accepted, e.g. by
+	// ReRecordOn and VerifyRequest. In ModeRecordIfMissing, the live
+	// response is returned once the replays are used up, but the recording
+	// isn't replaced.
+	MaxReplays int `json:"max_replays,omitempty"`
+	// DelayMS, if greater than zero, is the number of milliseconds that a
+	// RoundTripper waits before playing back the recording, e.g. to
+	// simulate a slow server. If the context of the request is done first,
+	// the error of the context is returned, which is a timeout if its
+	// deadline was exceeded, as for a live request. It is ignored by a
+	// RoundTripper with IgnoreFaults set.
+	DelayMS int64 `json:"delay_ms,omitempty"`
+	// TruncateBodyAt and BodyError, if either is set, make reading the body
+	// of the played back response fail after TruncateBodyAt bytes, with the
+	// error named by BodyError: BodyErrorUnexpectedEOF, the default, for
+	// io.ErrUnexpectedEOF, as for a connection closed early, or
+	// BodyErrorReset for an *InjectedError of type InjectConnectionReset.
+	// The Content-Length of the response and the body of the recording are
+	// unchanged, so the recording can be played back in full by a
+	// RoundTripper with IgnoreFaults set. Loading a recording with any other
+	// BodyError fails.
+	TruncateBodyAt int64  `json:"truncate_body_at,omitempty"`
+	BodyError      string `json:"body_error,omitempty"`
+	// NoBody, if true, means that the response has no body by definition,
+	// as for a response to a HEAD request. ContentLength and the
+	// Content-Length header are kept as recorded, and the response is
+	// played back with http.NoBody.
+	NoBody bool `json:"no_body,omitempty"`
+	// Chunks, if not empty, is the body of the response with the timing of
+	// its parts, and Body is empty. See RoundTripper.RecordChunks.
+	Chunks []RecordedChunk `json:"chunks,omitempty"`
+	Body   []byte          `json:"-"`
+
+	modTime time.Time
 }
 
+// FormatVersion is the current version of the recording format, which is
+// written by Recording.Save. Version 1 recordings have no format_version field,
+// but are otherwise the same as version 2.
+const FormatVersion = 2
+
 // NewRecording returns a new, populated Recording struct from the given
-// *http.Response. The http.Response Body is read and replaced.
+// *http.Response. The http.Response Body is read and replaced. Trailers are
+// captured after the body has been read, since they aren't available before.
 func NewRecording(res *http.Response) (*Recording, error) {
 	body, err := ioutil.ReadAll(res.Body)
 	res.Body.Close()
 	if err != nil {
 		return nil, err
 	}
-	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if res.Body != http.NoBody {
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	rec := newRecording(res)
+	rec.Body = body
+	return rec, nil
+}
 
-	rec := &Recording{
-		Status:     res.Status,
-		StatusCode: res.StatusCode,
-		Proto:      res.Proto,
-		ProtoMajor: res.ProtoMajor,
-		ProtoMinor: res.ProtoMinor,
-		Headers:    res.Header,
-		Body:       body,
+// newRecording returns a Recording populated from res, without a body.
+func newRecording(res *http.Response) *Recording {
+	return &Recording{
+		Status:           res.Status,
+		StatusCode:       res.StatusCode,
+		Proto:            res.Proto,
+		ProtoMajor:       res.ProtoMajor,
+		ProtoMinor:       res.ProtoMinor,
+		Headers:          res.Header,
+		Trailers:         res.Trailer,
+		ContentLength:    res.ContentLength,
+		TransferEncoding: res.TransferEncoding,
+		Uncompressed:     res.Uncompressed,
+		NoBody:           res.Request != nil && res.Request.Method == http.MethodHead,
 	}
+}
 
+// LoadRecording loads a Recording object from the given file path. If the
+// recording has a newer FormatVersion than this package supports, a
+// *FormatVersionError is returned. If its JSON can't be parsed, a *ParseError
+// is returned, and if its body is shorter than its Content-Length header, e.g.
+// because the file was cut off while it was being written, a *TruncatedError
+// is returned.
+func LoadRecording(path string) (*Recording, error) {
+	rec, body, _, err := loadRecordingStream(path)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if rec.Body, err = ioutil.ReadAll(body); err != nil {
+		return nil, err
+	}
 	return rec, nil
 }
 
-// LoadRecording loads a Recording object from the given file path.
-func LoadRecording(path string) (*Recording, error) {
+// LoadRecordingStream loads a Recording object from the given file path, except
+// for its body, which is returned as an io.ReadCloser that reads directly from
+// the file. Body is not set in the returned Recording. The caller must close
+// the returned io.ReadCloser, which closes the file.
+func LoadRecordingStream(path string) (*Recording, io.ReadCloser, error) {
+	rec, body, _, err := loadRecordingStream(path)
+	return rec, body, err
+}
+
+// loadRecordingStream implements LoadRecordingStream, and also returns the
+// size of the body.
+func loadRecordingStream(path string) (*Recording, io.ReadCloser, int64, error) {
 	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+	rec, body, size, err := decodeRecording(f, info.Size(), path)
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+	rec.modTime = info.ModTime()
+	return rec, &fileBody{Reader: body, file: f}, size, nil
+}
+
+// ReadRecording reads a Recording in the format written by WriteTo, and by
+// Save, from r, including its body. Errors are as for LoadRecording, but
+// without a path.
+func ReadRecording(r io.Reader) (*Recording, error) {
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	var rec *Recording
-	dec := json.NewDecoder(f)
-	if err = dec.Decode(&rec); err != nil {
+	rec, body, _, err := decodeRecording(bytes.NewReader(data), int64(len(data)), "")
+	if err != nil {
+		return nil, err
+	}
+	if rec.Body, err = ioutil.ReadAll(body); err != nil {
 		return nil, err
 	}
+	return rec, nil
+}
+
+// recordingReader is implemented by *os.File and *bytes.Reader. ReadAt is used
+// for the Excerpt of a *ParseError.
+type recordingReader interface {
+	io.Reader
+	io.ReaderAt
+}
+
+// decodeRecording decodes the JSON of a recording from src, which is size bytes
+// long, and was read from path, which may be empty. It returns the recording,
+// a reader for its body, which follows the JSON and one newline, and the size
+// of the body.
+func decodeRecording(src recordingReader, size int64, path string) (*Recording, io.Reader, int64, error) {
+	var rec *Recording
+	dec := json.NewDecoder(src)
+	if err := dec.Decode(&rec); err != nil {
+		return nil, nil, 0, newParseError(src, size, path, dec.InputOffset(), err)
+	}
+	if rec == nil {
+		return nil, nil, 0, newParseError(src, size, path, 0, errors.New("recording is null"))
+	}
+	if rec.FormatVersion > FormatVersion {
+		return nil, nil, 0, &FormatVersionError{Path: path, Version: rec.FormatVersion}
+	}
+	if rec.InjectError != nil && !rec.InjectError.valid() {
+		return nil, nil, 0, fmt.Errorf("%sinvalid inject_error type %q",
+			pathPrefix(path), rec.InjectError.Type)
+	}
+	if !rec.validBodyError() {
+		return nil, nil, 0, fmt.Errorf("%sinvalid body_error %q", pathPrefix(path), rec.BodyError)
+	}
+	offset := dec.InputOffset()
 	// dec.Buffered() is a bytes.Reader around the []byte buffered in Decoder.
-	// It isn't all of the data in f.
-	r := bufio.NewReader(io.MultiReader(dec.Buffered(), f))
+	// It isn't all of the data in src.
+	r := bufio.NewReader(io.MultiReader(dec.Buffered(), src))
 	// Encode writes a trailing newline, but Decode doesn't parse it.
 	if buf, err := r.Peek(1); err == nil && buf[0] == '\n' {
 		r.ReadByte()
+		offset++
 	}
-	if rec.Body, err = ioutil.ReadAll(r); err != nil {
-		return nil, err
+	size -= offset
+	if expected, ok := rec.truncated(size); ok {
+		return nil, nil, 0, &TruncatedError{Path: path, Expected: expected, Actual: size}
 	}
-	return rec, nil
+	return rec, r, size, nil
+}
+
+// pathPrefix returns path followed by ": ", to start an error message, or an
+// empty string if path is empty.
+func pathPrefix(path string) string {
+	if path == "" {
+		return ""
+	}
+	return path + ": "
+}
+
+// truncated reports whether a body of the given size is shorter than the
+// Content-Length header of r, and returns the length from the header.
+func (r *Recording) truncated(size int64) (int64, bool) {
+	if r.NoBody || bodylessStatus(r.StatusCode) || len(r.Chunks) > 0 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(r.Headers.Get("Content-Length"), 10, 64)
+	return n, err == nil && n > size
+}
+
+// maxExcerptLength is the maximum length of the Excerpt of a ParseError.
+const maxExcerptLength = 40
+
+// newParseError returns a *ParseError for err, returned by decoding the
+// recording in src, which is size bytes long, from path. offset is the offset
+// of the decoder, which is used if err doesn't have a more precise one.
+func newParseError(src io.ReaderAt, size int64, path string, offset int64, err error) *ParseError {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		offset = size
+	}
+	start := offset - maxExcerptLength/2
+	if start < 0 {
+		start = 0
+	}
+	buf := make([]byte, maxExcerptLength)
+	n, _ := src.ReadAt(buf, start)
+	return &ParseError{Path: path, Offset: offset, Excerpt: string(buf[:n]), Err: err}
+}
+
+// fileBody is an io.ReadCloser that reads the body of a recording, and closes
+// the recording file.
+type fileBody struct {
+	io.Reader
+	file *os.File
+}
+
+func (b *fileBody) Close() error {
+	return b.file.Close()
 }
 
 // Save writes the Recording to the given path. The file is written to a
-// temporary file and then renamed to ensure atomicity.
+// temporary file and then renamed to ensure atomicity. No body is written if the
+// status code doesn't allow one, e.g. 204 No Content. An existing file at path
+// is replaced. The temporary file is removed if any step fails.
 func (r *Recording) Save(path string) error {
-	dir, filename := filepath.Split(path)
-	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-		return err
+	_, err := r.save(path, bytes.NewReader(r.Body))
+	return err
+}
+
+// save implements Save, reading the body from body instead of r.Body. It
+// returns the size of the body.
+func (r *Recording) save(path string, body io.Reader) (int64, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return 0, err
+		}
 	}
-	f, err := ioutil.TempFile(dir, filename)
-	if err != nil {
+	var n int64
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		var err error
+		_, n, err = r.write(w, body)
 		return err
+	})
+	return n, err
+}
+
+// WriteTo writes the Recording to w in the format of the files written by
+// Save: its JSON, one newline, and then its body, if the status code allows
+// one. It returns the number of bytes written. See ReadRecording.
+func (r *Recording) WriteTo(w io.Writer) (int64, error) {
+	header, n, err := r.write(w, bytes.NewReader(r.Body))
+	return header + n, err
+}
+
+// write implements WriteTo, reading the body from body instead of r.Body. It
+// returns the sizes of the JSON, including its newline, and of the body.
+func (r *Recording) write(w io.Writer, body io.Reader) (int64, int64, error) {
+	versioned := *r
+	versioned.FormatVersion = FormatVersion
+	buf, err := json.MarshalIndent(&versioned, "", "  ")
+	if err != nil {
+		return 0, 0, err
+	}
+	header, err := w.Write(append(buf, '\n'))
+	if err != nil || bodylessStatus(r.StatusCode) {
+		return int64(header), 0, err
 	}
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	if err = enc.Encode(&r); err == nil {
-		_, err = f.Write(r.Body)
+	n, err := io.Copy(w, body)
+	return int64(header), n, err
+}
+
+// MigrateDir upgrades the recordings under dir that have an older FormatVersion
+// to the current version, in place. It returns the number of recordings that
+// were upgraded.
+func MigrateDir(dir string) (int, error) {
+	n := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isRecordingFile(info.Name()) {
+			return err
+		}
+		rec, err := LoadRecording(path)
+		if err != nil {
+			return err
+		}
+		if rec.FormatVersion < FormatVersion {
+			if err = rec.Save(path); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// bodylessStatus reports whether responses with the given status code never
+// have a body: 1xx, 204 No Content and 304 Not Modified.
+func bodylessStatus(status int) bool {
+	return status >= 100 && status < 200 ||
+		status == http.StatusNoContent || status == http.StatusNotModified
+}
+
+// ModTime returns the modification time of the file that the recording was
+// loaded from, or the zero time if it wasn't loaded from a file.
+func (r *Recording) ModTime() time.Time {
+	return r.modTime
+}
+
+// ContentLengthMismatch reports whether the recorded content length, either
+// from the ContentLength field or the Content-Length header, disagrees with the
+// actual size of Body. This is typically the result of editing a recording by
+// hand. Response corrects the length in this case.
+func (r *Recording) ContentLengthMismatch() bool {
+	return r.contentLengthMismatch(int64(len(r.Body)))
+}
+
+func (r *Recording) contentLengthMismatch(size int64) bool {
+	if r.NoBody || bodylessStatus(r.StatusCode) {
+		return false
 	}
-	f.Close()
-	if err == nil {
-		err = os.Rename(f.Name(), path)
+	if r.ContentLength > 0 && r.ContentLength != size {
+		return true
 	}
-	if err != nil {
-		os.Remove(f.Name())
+	if v := r.Headers.Get("Content-Length"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		return err != nil || n != size
 	}
-	return err
+	return false
 }
 
 // Response returns an *http.Response object from the populated Recording.
+// ContentLength is set from the recorded value, or from the length of Body if
+// no value was recorded or the recorded value is wrong, unless NoBody is true.
+// If the body was recorded as Chunks, it is returned all at once.
 func (r *Recording) Response() *http.Response {
+	content := r.Body
+	if len(content) == 0 && len(r.Chunks) > 0 {
+		for i := range r.Chunks {
+			content = append(content, r.Chunks[i].bytes()...)
+		}
+	}
+	body := ioutil.NopCloser(bytes.NewReader(content))
+	return r.response(body, int64(len(content)))
+}
+
+// response returns an *http.Response with the given body, which is size bytes
+// long. If NoBody is true, or the status code doesn't allow a body, body is
+// closed, and http.NoBody is used instead.
+func (r *Recording) response(body io.ReadCloser, size int64) *http.Response {
+	header := r.Headers
+	contentLength := r.ContentLength
+	if bodylessStatus(r.StatusCode) {
+		body.Close()
+		body = http.NoBody
+		contentLength = 0
+	} else if r.NoBody {
+		body.Close()
+		body = http.NoBody
+		if contentLength == 0 {
+			// As for net/http, the length comes from the header.
+			contentLength, _ = strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+		}
+	} else if contentLength == 0 {
+		contentLength = size
+	}
+	if r.contentLengthMismatch(size) {
+		contentLength = size
+		if header.Get("Content-Length") != "" {
+			header = header.Clone()
+			header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+		}
+	}
 	return &http.Response{
-		Status:     r.Status,
-		StatusCode: r.StatusCode,
-		Proto:      r.Proto,
-		ProtoMajor: r.ProtoMajor,
-		ProtoMinor: r.ProtoMinor,
-		Header:     r.Headers,
-		Body:       ioutil.NopCloser(bytes.NewReader(r.Body)),
+		Status:           r.Status,
+		StatusCode:       r.StatusCode,
+		Proto:            r.Proto,
+		ProtoMajor:       r.ProtoMajor,
+		ProtoMinor:       r.ProtoMinor,
+		Header:           header,
+		Trailer:          r.Trailers,
+		ContentLength:    contentLength,
+		TransferEncoding: r.TransferEncoding,
+		Uncompressed:     r.Uncompressed,
+		Body:             body,
 	}
 }
@@ -0,0 +1,112 @@
+package replay
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// SetBodyBytes replaces the body of the recording with b, and updates the
+// headers to match: the Content-Length header, if there is one, and
+// ContentLength are set to the length of b, and the Content-Encoding and Etag
+// headers are removed, since they describe the old body. Chunks are removed.
+func (r *Recording) SetBodyBytes(b []byte) {
+	r.Body = b
+	r.Chunks = nil
+	r.ContentLength = int64(len(b))
+	if r.Headers == nil {
+		return
+	}
+	if r.Headers.Get("Content-Length") != "" {
+		r.Headers.Set("Content-Length", strconv.Itoa(len(b)))
+	}
+	r.Headers.Del("Content-Encoding")
+	r.Headers.Del("Etag")
+}
+
+// SetBodyString replaces the body of the recording with s, as for SetBodyBytes.
+func (r *Recording) SetBodyString(s string) {
+	r.SetBodyBytes([]byte(s))
+}
+
+// SetBodyJSON replaces the body of the recording with v encoded as JSON, as
+// for SetBodyBytes.
+func (r *Recording) SetBodyJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r.SetBodyBytes(b)
+	return nil
+}
+
+// GetBodyJSON decodes the body of the recording as JSON into out.
+func (r *Recording) GetBodyJSON(out interface{}) error {
+	return json.Unmarshal(r.Body, out)
+}
+
+// Clone returns a deep copy of the recording, which can be modified without
+// affecting r.
+func (r *Recording) Clone() *Recording {
+	c := *r
+	c.Headers = r.Headers.Clone()
+	c.Trailers = r.Trailers.Clone()
+	if r.TransferEncoding != nil {
+		c.TransferEncoding = append([]string(nil), r.TransferEncoding...)
+	}
+	if r.TLS != nil {
+		tls := *r.TLS
+		if r.TLS.PeerCertificates != nil {
+			tls.PeerCertificates = make([]RecordedCertificate, len(r.TLS.PeerCertificates))
+			for i, cert := range r.TLS.PeerCertificates {
+				if cert.DNSNames != nil {
+					cert.DNSNames = append([]string(nil), cert.DNSNames...)
+				}
+				tls.PeerCertificates[i] = cert
+			}
+		}
+		c.TLS = &tls
+	}
+	if r.Error != nil {
+		recErr := *r.Error
+		c.Error = &recErr
+	}
+	if r.InjectError != nil {
+		injected := *r.InjectError
+		c.InjectError = &injected
+	}
+	if r.Request != nil {
+		req := *r.Request
+		req.Headers = r.Request.Headers.Clone()
+		c.Request = &req
+	}
+	if r.Match != nil {
+		c.Match = &RecordingMatch{
+			Headers: copyStringMap(r.Match.Headers),
+			Query:   copyStringMap(r.Match.Query),
+		}
+	}
+	if r.Chunks != nil {
+		c.Chunks = make([]RecordedChunk, len(r.Chunks))
+		for i, chunk := range r.Chunks {
+			if chunk.Data != nil {
+				chunk.Data = append([]byte(nil), chunk.Data...)
+			}
+			c.Chunks[i] = chunk
+		}
+	}
+	if r.Body != nil {
+		c.Body = append([]byte(nil), r.Body...)
+	}
+	return &c
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
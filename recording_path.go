@@ -2,17 +2,27 @@ package replay
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"hash"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
 )
 
 // StringSet implements a set of string values.
@@ -39,6 +49,14 @@ func (ss StringSet) Del(args ...string) {
 	}
 }
 
+func (ss StringSet) fold(fold func(string) string) StringSet {
+	folded := make(StringSet, len(ss))
+	for k := range ss {
+		folded[fold(k)] = struct{}{}
+	}
+	return folded
+}
+
 // DefaultOmitHeaders returns a default set of headers to omit from recording
 // path generation.
 func DefaultOmitHeaders() StringSet {
@@ -52,28 +70,160 @@ func DefaultOmitHeaders() StringSet {
 	}
 }
 
+// DefaultOmitResponseHeaders returns a default set of response headers to omit
+// from recordings, for the OmitResponseHeaders field of RoundTripper. These
+// headers typically change on every request, and so cause needless changes to
+// recordings when they are re-recorded.
+func DefaultOmitResponseHeaders() StringSet {
+	return NewStringSet(
+		"Age",
+		"Cf-Ray",
+		"Date",
+		"Etag",
+		"X-Amz-Cf-Id",
+		"X-Amzn-Requestid",
+		"X-Amzn-Trace-Id",
+		"X-Request-Id",
+	)
+}
+
+// Pather generates the paths of the recordings of requests. *PathGenerator is a
+// Pather; other implementations can replace it as the Pather of a RoundTripper.
+type Pather interface {
+	// RecordingPath returns the path of the recording of req, relative to
+	// the directories of the RoundTripper. Like PathGenerator.RecordingPath,
+	// it must leave the body of req, if it reads it, so that it can still
+	// be sent.
+	RecordingPath(req *http.Request) (*RecordingPath, error)
+}
+
 // RecordingPath contains a relative path for a recording.
 type RecordingPath struct {
-	dir      string
-	checksum string
+	dir         string
+	checksum    string
+	name        string
+	genericName string
+	// anyHostDir is dir with the host replaced by AnyHostDir, or empty if
+	// the host isn't known.
+	anyHostDir string
+}
+
+// NewRecordingPath returns a RecordingPath in dir, a slash-separated relative
+// path, for a request with the given checksum, which may be empty, e.g. for a
+// Pather. Its filenames are those returned by DefaultFileName for a request
+// without a recording name. Its AnyHostPath is unknown.
+func NewRecordingPath(dir, checksum string) *RecordingPath {
+	name := "request.json"
+	if checksum != "" {
+		name = "request." + checksum + ".json"
+	}
+	return &RecordingPath{
+		dir:         filepath.FromSlash(dir),
+		checksum:    checksum,
+		name:        name,
+		genericName: "request.json",
+	}
+}
+
+// Checksum returns the checksum of the request, or "" if there isn't one.
+func (r *RecordingPath) Checksum() string {
+	return r.checksum
+}
+
+// AnyHostDir is the name of the directory used in place of the host directory
+// for recordings that are played back for any host. See
+// RoundTripper.AnyHostFallback.
+const AnyHostDir = "_any_"
+
+// AnyHostPath returns the path for the request with the host directory
+// replaced by AnyHostDir, and true, or false if the PathGenerator has a
+// PathTemplate, so that the host directory isn't known. If generic is true,
+// the filename is that of GenericPath, otherwise that of Path.
+func (r *RecordingPath) AnyHostPath(generic bool) (string, bool) {
+	if r.anyHostDir == "" {
+		return "", false
+	}
+	name := r.genericName
+	if !generic && r.checksum != "" {
+		name = r.name
+	}
+	return filepath.Join(r.anyHostDir, name), true
 }
 
 // Path returns a canonical filename generated for the request. If a checksum
 // can be calculated over the request query parameters, headers and body,
 // the filename portion of the path will be "recording." + checksum + "".json".
 // If there are no query parameters, no headers and no body, the returned path
-// will be GenericPath().
+// will be GenericPath(). If the PathGenerator has a FileName function, it
+// determines the filename portion instead.
 func (r *RecordingPath) Path() string {
 	if r.checksum != "" {
-		return filepath.Join(r.dir, "request."+r.checksum+".json")
+		return r.NamedPath(r.name)
 	}
 	return r.GenericPath()
 }
 
 // GenericPath returns a generic path for the request. The filename portion is
-// always "request.json", even if a checksum was calculated.
+// always "request.json", even if a checksum was calculated, unless the
+// PathGenerator has a FileName function.
 func (r *RecordingPath) GenericPath() string {
-	return filepath.Join(r.dir, "request.json")
+	return r.NamedPath(r.genericName)
+}
+
+// NamedPath returns the path for the request with the given filename, e.g. to
+// keep named variants of a recording in the same directory.
+func (r *RecordingPath) NamedPath(name string) string {
+	return filepath.Join(r.dir, name)
+}
+
+// DefaultFileName returns the default filename for a recording with the given
+// checksum, which may be empty: "request." + checksum + ".json", or
+// "request.json". If the context of req has a name set by WithRecordingName,
+// it is used in place of "request".
+func DefaultFileName(req *http.Request, checksum string) string {
+	stem := "request"
+	if name, ok := RecordingName(req.Context()); ok {
+		stem = name
+		if strings.HasPrefix(stem, ".") {
+			// Hidden files aren't recordings.
+			stem = "%2E" + stem[1:]
+		}
+	}
+	if checksum != "" {
+		return stem + "." + checksum + ".json"
+	}
+	if stem+".json" == ManifestFileName {
+		// Nor are manifests.
+		stem = "%6D" + stem[1:]
+	}
+	return stem + ".json"
+}
+
+type recordingNameKey struct{}
+
+// WithRecordingName returns a copy of ctx that causes requests made with it to
+// use name in place of "request" in the filenames of their recordings, e.g. to
+// keep recordings of identical requests made in different scenarios apart. The
+// name is escaped as for the other components of recording paths. An empty
+// name unsets any name set earlier, so that "request" is used.
+func WithRecordingName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, recordingNameKey{}, escapePathComponent(name))
+}
+
+// RecordingName returns the escaped name set in ctx by WithRecordingName, and
+// whether there is one, which is never empty. It can be used by a FileName
+// function of PathGenerator.
+func RecordingName(ctx context.Context) (string, bool) {
+	name, _ := ctx.Value(recordingNameKey{}).(string)
+	return name, name != ""
+}
+
+// isRecordingFile reports whether name is the filename of a recording, as
+// opposed to a temporary file written by Recording.Save, which is hidden, or a
+// manifest written by WriteManifest.
+func isRecordingFile(name string) bool {
+	return !strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".json") &&
+		name != ManifestFileName
 }
 
 // PathGenerator creates a unique path for a given *http.Request.
@@ -86,11 +236,128 @@ type PathGenerator struct {
 	// Requests with different content in these parameters can still return the
 	// same unique path.
 	OmitQuery StringSet
+	// OmitQueryPatterns is a list of patterns matching query parameters to
+	// exclude from path calculations, in addition to OmitQuery, e.g.
+	// regexp.MustCompile(`^(?i)x-amz-`) or regexp.MustCompile(`^utm_`).
+	// Parameter names are matched as they appear in the request. It is
+	// ignored if AllowQuery is not empty.
+	OmitQueryPatterns []*regexp.Regexp
+	// AllowHeaders, if not empty, is the set of headers to include in path
+	// calculations. All other headers are excluded, and OmitHeaders is
+	// ignored.
+	AllowHeaders StringSet
+	// AllowQuery, if not empty, is the set of query parameters to include in
+	// path calculations. All other parameters are excluded, and OmitQuery is
+	// ignored.
+	AllowQuery StringSet
+	// ExactNames, if true, compares header and query parameter names to
+	// OmitHeaders, OmitQuery, AllowHeaders and AllowQuery exactly. By default,
+	// header names are canonicalized with textproto.CanonicalMIMEHeaderKey,
+	// both when comparing and when calculating the checksum, and query
+	// parameter names are compared case-insensitively. Set this to keep the
+	// checksums of recordings made by older versions of this package for
+	// requests with non-canonical header names, e.g. req.Header["x-api-key"].
+	ExactNames bool
 	// MungeRequestBody can be used to edit which bytes of the request body
 	// are used to calculate the path CRC. It may be nil or return the same
 	// io.Reader that is passed in. It does not alter the request that is sent
 	// to the server.
 	MungeRequestBody func(*http.Request, io.Reader) io.Reader
+	// IgnoreBody, if true, excludes the request body from path calculations.
+	// The body is not read, so requests that differ only in their bodies
+	// have the same path.
+	IgnoreBody bool
+	// OmitFormParams is a set of form parameters to exclude from path
+	// calculations. It applies to requests with an
+	// application/x-www-form-urlencoded body. Such a body is hashed as sorted
+	// parameters rather than raw bytes if OmitFormParams is not empty.
+	OmitFormParams StringSet
+	// IgnoreJSONFields is a list of fields to exclude from path calculations.
+	// It applies to requests with a JSON Content-Type, whose bodies are
+	// hashed as re-encoded by CanonicalJSONBody with these fields removed,
+	// rather than as raw bytes, if IgnoreJSONFields is not empty. Fields may
+	// be dotted paths, and "[]" matches each element of an array, e.g.
+	// "meta.timestamp" or "items[].id". Bodies that can't be parsed as JSON
+	// are hashed as raw bytes.
+	IgnoreJSONFields []string
+	// PreserveTrailingSlash, if true, distinguishes URL paths with a trailing
+	// slash from those without by adding a final "%2F" directory to the path,
+	// e.g. "/items/" maps to "items/%2F". This can't collide with an actual
+	// path segment, since they are escaped. By default, paths are the same
+	// with or without a trailing slash.
+	PreserveTrailingSlash bool
+	// FileName, if not nil, returns the filename for a recording of req. The
+	// checksum is empty when the generic filename is required, or if no
+	// checksum could be calculated. Filenames should end in ".json", and
+	// must not contain path separators or start with ".". The default is
+	// DefaultFileName.
+	FileName func(req *http.Request, checksum string) string
+	// PathTemplate, if not nil, returns the directory components of the path
+	// for a recording of req, replacing DefaultPathComponents. Each
+	// component is escaped according to Encoding, and empty components are
+	// skipped. For example, a flatter layout could be produced with:
+	//	func(req *http.Request) []string {
+	//		path := strings.Replace(strings.Trim(req.URL.Path, "/"), "/", "-", -1)
+	//		return []string{req.URL.Host, req.Method + "-" + path}
+	//	}
+	PathTemplate func(req *http.Request) []string
+	// MaxComponentLength, if greater than zero, is the maximum length of each
+	// escaped directory component. Longer components are replaced by a
+	// prefix of the component followed by "~" and a short hash of the whole
+	// component.
+	MaxComponentLength int
+	// MaxPathLength, if greater than zero, is the maximum length of the path
+	// returned by RecordingPath.Path, which doesn't include the Dir of the
+	// RoundTripper. The longest directory components are shortened as for
+	// MaxComponentLength until the path fits. An error is returned if it
+	// can't be made to fit.
+	MaxPathLength int
+	// QueryInPath, if true, adds the query string parameters that aren't
+	// omitted to the path as a final directory, e.g. "q=foo&page=2", and
+	// excludes them from the checksum. Parameters are sorted, and keys and
+	// values are escaped with url.QueryEscape. If the directory would be
+	// longer than MaxComponentLength, or 200 characters if that isn't set,
+	// the parameters are included in the checksum instead.
+	QueryInPath bool
+	// Encoding selects how directory components are escaped. The default,
+	// EncodingStrict, escapes them with url.QueryEscape. EncodingReadable
+	// escapes only characters that aren't valid in filenames, so that paths
+	// with spaces, commas and non-ASCII characters are easier to read.
+	// Changing it changes the paths of existing recordings, unless their
+	// components contain no escaped characters. Filenames, including names
+	// set by WithRecordingName, and the QueryInPath directory are always
+	// escaped strictly.
+	Encoding PathEncoding
+	// EscapeUppercase, if true, also percent-encodes uppercase letters in
+	// directory components, e.g. "Users" becomes "%55sers", so that paths
+	// that differ only in case, such as "/Users/ABC" and "/users/abc", don't
+	// collide on case-insensitive filesystems, as on macOS and Windows by
+	// default. The method component of DefaultPathComponents is left alone.
+	// Changing it changes the paths of existing recordings with uppercase
+	// letters. See CheckCollisions.
+	EscapeUppercase bool
+	// IgnoreScheme, if true, leaves the scheme out of the path, so that the
+	// same recordings are used for http and https requests.
+	IgnoreScheme bool
+	// HostAliases maps hosts to the host used in their place for path
+	// calculations, so that equivalent hosts share recordings. Keys and
+	// values include the port, if any, as in URL.Host. It applies to the
+	// host component of DefaultPathComponents and to a Host header, if one
+	// is included in the checksum. Hosts that aren't mapped are unchanged.
+	HostAliases map[string]string
+	// IgnorePort, if true, removes the port from hosts for path calculations,
+	// after HostAliases is applied, so that recordings made against servers
+	// with ephemeral ports, such as httptest servers, can be played back
+	// against others. IPv6 literals keep their brackets, e.g. "[::1]".
+	IgnorePort bool
+	// Hash, if not nil, returns the hash used to calculate the path checksum,
+	// e.g. sha256.New. The digest is hex encoded in the filename. The default
+	// is a CRC32 checksum, encoded in decimal.
+	Hash func() hash.Hash
+	// HashLength, if greater than zero, truncates the hex encoded digest
+	// produced by Hash to the given number of characters. It has no effect on
+	// the default CRC32 checksum.
+	HashLength int
 }
 
 // NewPathGenerator creates a new generator for recording path names.
@@ -98,103 +365,651 @@ func NewPathGenerator() *PathGenerator {
 	return &PathGenerator{OmitHeaders: DefaultOmitHeaders()}
 }
 
-// RecordingPath returns the unique path for the given request.
-func (p *PathGenerator) RecordingPath(req *http.Request) (*RecordingPath, error) {
-	parts := make([]string, 0, 10)
-	if req.URL.Scheme != "" {
-		parts = append(parts, req.URL.Scheme)
+// DefaultPathComponents returns the directory components used for the path of
+// req if PathTemplate is nil: the scheme, unless IgnoreScheme is true, the host,
+// method and each segment of the URL path. The host is mapped by HostAliases
+// and IgnorePort. A trailing slash is included as a final "/" component if
+// PreserveTrailingSlash is true. The components are not yet escaped.
+func (p *PathGenerator) DefaultPathComponents(req *http.Request) []string {
+	components := []string{req.URL.Scheme, p.host(req.URL.Host), req.Method}
+	if p.IgnoreScheme {
+		components = components[1:]
 	}
-	if req.URL.Host != "" {
-		parts = append(parts, url.QueryEscape(req.URL.Host))
+	components = append(components, strings.Split(req.URL.Path, "/")...)
+	if p.PreserveTrailingSlash && req.URL.Path != "/" &&
+		strings.HasSuffix(req.URL.Path, "/") {
+		components = append(components, "/")
 	}
-	if req.Method != "" {
-		parts = append(parts, req.Method)
+	return components
+}
+
+// PathEncoding selects how the components of recording paths are escaped. See
+// the Encoding field of PathGenerator.
+type PathEncoding int
+
+const (
+	// EncodingStrict escapes components with url.QueryEscape. It is the
+	// default.
+	EncodingStrict PathEncoding = iota
+	// EncodingReadable escapes only the characters that aren't valid in
+	// filenames on common platforms, / \ : * ? " < > | and control
+	// characters, along with '%', '+' and '=', which would otherwise be
+	// ambiguous, and leaves the rest alone. For example, "a b+c" becomes
+	// "a b%2Bc" rather than "a+b%2Bc".
+	EncodingReadable
+)
+
+// escape escapes a directory component of a recording path according to the
+// Encoding of p.
+func (p *PathGenerator) escape(component string) string {
+	if p.Encoding == EncodingReadable {
+		return escapeReadable(component)
 	}
-	for _, part := range strings.Split(req.URL.Path, "/") {
-		// Use QueryEscape, since it captures things like ':' that might not be
-		// valid in a path, depending on OS.
-		if part != "" {
-			parts = append(parts, url.QueryEscape(part))
+	return escapePathComponent(component)
+}
+
+// escapeReadable escapes component for EncodingReadable.
+func escapeReadable(component string) string {
+	var b strings.Builder
+	for i := 0; i < len(component); i++ {
+		c := component[i]
+		if c < 0x20 || c == 0x7f || strings.IndexByte(`/\:*?"<>|%+=`, c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
 		}
 	}
+	return escapeSpecial(b.String())
+}
+
+// escapePathComponent escapes a directory component of a recording path.
+func escapePathComponent(component string) string {
+	// Use QueryEscape, since it captures things like ':' that might not be
+	// valid in a path, depending on OS.
+	return escapeSpecial(url.QueryEscape(component))
+}
+
+// escapeSpecial escapes an already escaped component if it refers to the
+// current or parent directory, or if it is a reserved device name on Windows.
+func escapeSpecial(component string) string {
+	if component == "." || component == ".." {
+		component = strings.Replace(component, ".", "%2E", -1)
+	}
+	if isReservedName(component) {
+		// Escape the first character, so that the name still unescapes to
+		// the original, on every platform, so that recordings are portable.
+		component = fmt.Sprintf("%%%02X", component[0]) + component[1:]
+	}
+	return component
+}
+
+// escapeUppercase percent-encodes the uppercase letters of an already escaped
+// component, leaving its escape sequences alone, so that components that differ
+// only in case remain different on case-insensitive filesystems.
+func escapeUppercase(component string) string {
+	var b strings.Builder
+	for i := 0; i < len(component); {
+		if component[i] == '%' && i+3 <= len(component) {
+			b.WriteString(component[i : i+3])
+			i += 3
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(component[i:])
+		if unicode.IsUpper(r) {
+			for j := i; j < i+size; j++ {
+				fmt.Fprintf(&b, "%%%02X", component[j])
+			}
+		} else {
+			b.WriteString(component[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// isReservedName reports whether name is a device name that Windows doesn't
+// allow as a file or directory name, such as "aux" or "com1.txt". The check is
+// case-insensitive and ignores any extension.
+func isReservedName(name string) bool {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	name = strings.ToUpper(strings.TrimRight(name, " "))
+	switch name {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	return len(name) == 4 && (strings.HasPrefix(name, "COM") ||
+		strings.HasPrefix(name, "LPT")) && name[3] >= '1' && name[3] <= '9'
+}
+
+// minShortenedLength is the length of a component shortened by
+// shortenComponent to contain only a separator and a hash.
+const minShortenedLength = 9
+
+// shortenComponent returns component if it is no longer than max. Otherwise,
+// it returns a prefix of component followed by "~" and a hash of the whole
+// component, such that the result is max characters long.
+func shortenComponent(component string, max int) string {
+	if len(component) <= max {
+		return component
+	}
+	sum := sha256.Sum256([]byte(component))
+	hash := hex.EncodeToString(sum[:])[:minShortenedLength-1]
+	if max < minShortenedLength {
+		return hash[:max]
+	}
+	prefix := component[:max-minShortenedLength]
+	// Don't split an escape sequence.
+	if i := strings.LastIndexByte(prefix, '%'); i >= 0 && i >= len(prefix)-2 {
+		prefix = prefix[:i]
+	}
+	return prefix + "~" + hash
+}
+
+// shortenPath shortens the longest of parts with shortenComponent until the
+// length of parts joined with name is no longer than max.
+func shortenPath(parts []string, name string, max int) ([]string, error) {
+	length := len(name)
+	for _, part := range parts {
+		length += len(part) + 1
+	}
+	for length > max {
+		longest := -1
+		for i, part := range parts {
+			if len(part) > minShortenedLength &&
+				(longest < 0 || len(part) > len(parts[longest])) {
+				longest = i
+			}
+		}
+		if longest < 0 {
+			return nil, fmt.Errorf(
+				"replay: recording path can't be shortened to %d characters", max,
+			)
+		}
+		part := parts[longest]
+		target := len(part) - (length - max)
+		if target < minShortenedLength {
+			target = minShortenedLength
+		}
+		if target >= len(part) {
+			target = len(part) - 1
+		}
+		parts[longest] = shortenComponent(part, target)
+		length -= len(part) - len(parts[longest])
+	}
+	return parts, nil
+}
+
+// host returns the host used in place of host for path calculations.
+func (p *PathGenerator) host(host string) string {
+	if alias, ok := p.HostAliases[host]; ok {
+		host = alias
+	}
+	if p.IgnorePort {
+		host = stripPort(host)
+	}
+	return host
+}
+
+// stripPort returns host without its port, if it has one.
+func stripPort(host string) string {
+	i := strings.LastIndexByte(host, ':')
+	if i < 0 || strings.Contains(host[i:], "]") {
+		return host
+	}
+	if !strings.HasPrefix(host, "[") && strings.Count(host, ":") > 1 {
+		// An IPv6 address without brackets can't have a port.
+		return host
+	}
+	return host[:i]
+}
+
+// hostHeader returns header with the values of its Host header, if any,
+// replaced by the result of host. header is not modified.
+func (p *PathGenerator) hostHeader(header http.Header) http.Header {
+	values, ok := header["Host"]
+	if !ok || (len(p.HostAliases) == 0 && !p.IgnorePort) {
+		return header
+	}
+	hosts := make([]string, len(values))
+	for i, v := range values {
+		hosts[i] = p.host(v)
+	}
+	copied := make(http.Header, len(header))
+	for k, v := range header {
+		copied[k] = v
+	}
+	copied["Host"] = hosts
+	return copied
+}
+
+// RecordingPath returns the unique path for the given request.
+func (p *PathGenerator) RecordingPath(req *http.Request) (*RecordingPath, error) {
+	var components []string
+	// hostIndex is the index of the host in components, if it is known.
+	hostIndex := -1
+	if p.PathTemplate != nil {
+		components = p.PathTemplate(req)
+	} else {
+		components = p.DefaultPathComponents(req)
+		hostIndex = 1
+		if p.IgnoreScheme {
+			hostIndex = 0
+		}
+	}
+	parts := make([]string, 0, len(components))
+	anyHostIndex := -1
+	for i, component := range components {
+		if i == hostIndex && component != "" {
+			anyHostIndex = len(parts)
+		}
+		if component != "" {
+			component = p.escape(component)
+			if p.EscapeUppercase && (hostIndex < 0 || i != hostIndex+1) {
+				// The method, after the host, is left alone.
+				component = escapeUppercase(component)
+			}
+			if p.MaxComponentLength > 0 {
+				component = shortenComponent(component, p.MaxComponentLength)
+			}
+			parts = append(parts, component)
+		}
+	}
+	if component, ok := p.queryComponent(req); ok {
+		parts = append(parts, component)
+	}
 
 	crc, err := p.RequestCRC(req)
 	if err != nil {
 		return nil, err
 	}
 
+	fileName := p.FileName
+	if fileName == nil {
+		fileName = DefaultFileName
+	}
+	name := fileName(req, crc)
+	if p.MaxPathLength > 0 {
+		if parts, err = shortenPath(parts, name, p.MaxPathLength); err != nil {
+			return nil, err
+		}
+	}
 	path := &RecordingPath{
-		dir:      strings.Join(parts, string(os.PathSeparator)),
-		checksum: crc,
+		dir:         strings.Join(parts, string(os.PathSeparator)),
+		checksum:    crc,
+		name:        name,
+		genericName: fileName(req, ""),
+	}
+	if anyHostIndex >= 0 {
+		parts[anyHostIndex] = AnyHostDir
+		path.anyHostDir = strings.Join(parts, string(os.PathSeparator))
 	}
 
 	return path, nil
 }
 
+// hashBuffer is scratch space used to calculate checksums.
+type hashBuffer struct {
+	bytes.Buffer
+	keys []string
+}
+
+// maxPooledBufferSize is the capacity above which a hashBuffer isn't reused, so
+// that a single large request body doesn't hold on to memory indefinitely.
+const maxPooledBufferSize = 1 << 20
+
+var hashBufferPool = sync.Pool{
+	New: func() interface{} { return new(hashBuffer) },
+}
+
+func getHashBuffer() *hashBuffer {
+	return hashBufferPool.Get().(*hashBuffer)
+}
+
+func putHashBuffer(buf *hashBuffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	for i := range buf.keys {
+		buf.keys[i] = ""
+	}
+	buf.keys = buf.keys[:0]
+	hashBufferPool.Put(buf)
+}
+
 type hashableMap map[string][]string
 
-func (m hashableMap) updateHash(h hash.Hash, excludes StringSet) bool {
-	values := make(sort.StringSlice, 0, len(m))
+// keys returns the keys in m, in sorted order. If allow is not empty, only keys
+// in allow are returned. Otherwise, keys in omit are not returned. If fold is
+// not nil, it is applied to keys and to the members of allow and omit before
+// they are compared.
+func (m hashableMap) keys(allow, omit StringSet, fold func(string) string) []string {
+	return m.appendKeys(make([]string, 0, len(m)), allow, omit, fold)
+}
+
+// appendKeys appends the keys returned by keys to dst, and sorts them.
+func (m hashableMap) appendKeys(
+	dst []string, allow, omit StringSet, fold func(string) string,
+) []string {
+	if fold != nil {
+		allow, omit = allow.fold(fold), omit.fold(fold)
+	}
 	for k := range m {
-		if _, ok := excludes[k]; !ok {
-			values = append(values, k)
+		key := k
+		if fold != nil {
+			key = fold(k)
+		}
+		if len(allow) > 0 {
+			if _, ok := allow[key]; ok {
+				dst = append(dst, k)
+			}
+		} else if _, ok := omit[key]; !ok {
+			dst = append(dst, k)
 		}
 	}
-	sort.Sort(values)
-	for _, k := range values {
-		h.Write([]byte(k))
+	sort.Strings(dst)
+	return dst
+}
+
+// updateHash writes the keys returned by keys and their values to h. They are
+// written in a single call, which gives the same result as writing each one
+// separately.
+func (m hashableMap) updateHash(
+	h hash.Hash, allow, omit StringSet, fold func(string) string,
+) bool {
+	buf := getHashBuffer()
+	defer putHashBuffer(buf)
+	keys := m.appendKeys(buf.keys, allow, omit, fold)
+	buf.keys = keys
+	for _, k := range keys {
+		buf.WriteString(k)
 		for _, v := range m[k] {
-			h.Write([]byte(v))
+			buf.WriteString(v)
+		}
+	}
+	h.Write(buf.Bytes())
+	return len(keys) > 0
+}
+
+func (p *PathGenerator) foldQuery() func(string) string {
+	if p.ExactNames {
+		return nil
+	}
+	return strings.ToLower
+}
+
+// query returns the query string parameters of req, without those matching
+// OmitQueryPatterns.
+func (p *PathGenerator) query(req *http.Request) hashableMap {
+	q := req.URL.Query()
+	if len(p.OmitQueryPatterns) == 0 || len(p.AllowQuery) > 0 {
+		return hashableMap(q)
+	}
+	for k := range q {
+		for _, pattern := range p.OmitQueryPatterns {
+			if pattern.MatchString(k) {
+				delete(q, k)
+				break
+			}
 		}
 	}
-	return len(values) > 0
+	return hashableMap(q)
+}
+
+// maxQueryComponentLength is the maximum length of the query string directory
+// added when QueryInPath is true, unless MaxComponentLength is set.
+const maxQueryComponentLength = 200
+
+// queryComponent returns the directory component for the query string of req,
+// and true, if QueryInPath is true and the query string has parameters that
+// aren't omitted. Keys and values are escaped, and keys are sorted.
+func (p *PathGenerator) queryComponent(req *http.Request) (string, bool) {
+	if !p.QueryInPath {
+		return "", false
+	}
+	q := p.query(req)
+	keys := q.keys(p.AllowQuery, p.OmitQuery, p.foldQuery())
+	if len(keys) == 0 {
+		return "", false
+	}
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			// There is always an '=', so this can't collide with an
+			// escaped path segment, which can't contain one.
+			pairs = append(pairs, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+	component := strings.Join(pairs, "&")
+	max := maxQueryComponentLength
+	if p.MaxComponentLength > 0 {
+		max = p.MaxComponentLength
+	}
+	if len(component) > max {
+		return "", false
+	}
+	return component, true
+}
+
+// canonicalHeader returns a copy of header with canonical keys, or header itself
+// if its keys are all canonical already. Values of keys that are the same after
+// canonicalization are merged in key order.
+func canonicalHeader(header http.Header) http.Header {
+	isCanonical := true
+	for k := range header {
+		if textproto.CanonicalMIMEHeaderKey(k) != k {
+			isCanonical = false
+			break
+		}
+	}
+	if isCanonical {
+		return header
+	}
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	canonical := make(http.Header, len(header))
+	for _, k := range keys {
+		ck := textproto.CanonicalMIMEHeaderKey(k)
+		canonical[ck] = append(canonical[ck], header[k]...)
+	}
+	return canonical
 }
 
 // RequestCRC generates a checksum based on the contents of any headers, query
-// string parameters and body in the request. Any headers in OmitHeaders or any
-// query string parameters in OmitQuery are not considered. If there are no
-// headers, query string parameters and body to consider, returns an empty
-// string.
+// string parameters and body in the request. Headers in OmitHeaders, and query
+// string parameters in OmitQuery or matching OmitQueryPatterns, are not
+// considered. If AllowHeaders or AllowQuery are not empty, only the headers or
+// query string parameters they contain are considered. If there are no
+// headers, query string parameters or body to consider, it returns an empty
+// string. The checksum is calculated with Hash, if it is set.
 func (p *PathGenerator) RequestCRC(req *http.Request) (string, error) {
-	q := req.URL.Query()
-	h := crc32.NewIEEE()
-	hasHash := hashableMap(q).updateHash(h, p.OmitQuery)
-	hasHash = hashableMap(req.Header).updateHash(h, p.OmitHeaders) || hasHash
+	var h hash.Hash = crc32.NewIEEE()
+	if p.Hash != nil {
+		h = p.Hash()
+	}
+	header := req.Header
+	var foldHeader func(string) string
+	if !p.ExactNames {
+		header = canonicalHeader(header)
+		foldHeader = textproto.CanonicalMIMEHeaderKey
+	}
+	header = p.hostHeader(header)
+	hasHash := false
+	if _, ok := p.queryComponent(req); !ok {
+		hasHash = p.query(req).updateHash(
+			h, p.AllowQuery, p.OmitQuery, p.foldQuery(),
+		)
+	}
+	hasHash = hashableMap(header).updateHash(
+		h, p.AllowHeaders, p.OmitHeaders, foldHeader,
+	) || hasHash
 
-	if req.Body != nil {
-		if _, ok := req.Body.(io.ReadSeeker); !ok && req.GetBody == nil {
-			body, err := ioutil.ReadAll(req.Body)
-			req.Body.Close()
-			if err != nil {
-				return "", err
-			}
-			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if req.Body != nil && !p.IgnoreBody {
+		n, err := p.hashRequestBody(h, req)
+		if err != nil {
+			return "", err
 		}
+		hasHash = hasHash || n > 0
+	}
 
-		var r io.Reader = req.Body
-		if p.MungeRequestBody != nil {
-			r = p.MungeRequestBody(req, req.Body)
+	if !hasHash {
+		return "", nil
+	}
+	if p.Hash == nil {
+		return strconv.FormatUint(uint64(h.(hash.Hash32).Sum32()), 10), nil
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if p.HashLength > 0 && p.HashLength < len(sum) {
+		sum = sum[:p.HashLength]
+	}
+	return sum, nil
+}
+
+// hashRequestBody writes the body of req to h, and returns the number of bytes
+// that were read. The body is replaced or rewound, so that it can still be
+// sent. If req has no GetBody function, the body is buffered, and one is set,
+// so that the http.Client can send the body again, e.g. after a 307 or 308
+// redirect.
+func (p *PathGenerator) hashRequestBody(h hash.Hash, req *http.Request) (int64, error) {
+	if req.GetBody == nil {
+		if p.MungeRequestBody == nil && !p.isOmittingFormParams(req) &&
+			!p.isIgnoringJSONFields(req) {
+			// The body is hashed while it is buffered, so it is only read
+			// once.
+			return readBody(req, h)
 		}
-		n, err := io.Copy(h, r)
-		if seeker, ok := req.Body.(io.Seeker); ok {
-			if err == nil {
-				_, err = seeker.Seek(io.SeekStart, 0)
-			}
-			if err != nil {
-				req.Body.Close()
-				return "", err
-			}
-		} else {
+		if err := bufferBody(req); err != nil {
+			return 0, err
+		}
+	}
+
+	var r io.Reader = req.Body
+	if p.MungeRequestBody != nil {
+		r = p.MungeRequestBody(req, req.Body)
+	}
+	n, err := p.hashBody(h, req, r)
+	if seeker, ok := req.Body.(io.Seeker); ok {
+		if err == nil {
+			_, err = seeker.Seek(0, io.SeekStart)
+		}
+		if err != nil {
 			req.Body.Close()
-			if req.Body, err = req.GetBody(); err != nil {
-				return "", err
-			}
+			return 0, err
 		}
-		hasHash = hasHash || n > 0
+	} else {
+		req.Body.Close()
+		if req.Body, err = req.GetBody(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// bufferBody reads the body of req into memory and replaces it, and sets
+// GetBody, so that it can be read more than once, unless GetBody is set
+// already.
+func bufferBody(req *http.Request) error {
+	if req.GetBody != nil {
+		return nil
+	}
+	_, err := readBody(req, nil)
+	return err
+}
+
+// readBody reads the body of req into memory, writing it to w as well if w is
+// not nil, and replaces it with a body that can be read more than once. It
+// returns the size of the body.
+func readBody(req *http.Request, w io.Writer) (int64, error) {
+	buf := getHashBuffer()
+	defer putHashBuffer(buf)
+	var dst io.Writer = &buf.Buffer
+	if w != nil {
+		dst = io.MultiWriter(&buf.Buffer, w)
+	}
+	n, err := io.Copy(dst, req.Body)
+	req.Body.Close()
+	if err != nil {
+		return 0, err
 	}
+	body := make([]byte, buf.Len())
+	copy(body, buf.Bytes())
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return n, nil
+}
 
-	if hasHash {
-		return strconv.FormatUint(uint64(h.Sum32()), 10), nil
+// isOmittingFormParams reports whether OmitFormParams applies to the body of
+// req.
+func (p *PathGenerator) isOmittingFormParams(req *http.Request) bool {
+	if len(p.OmitFormParams) == 0 {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == "application/x-www-form-urlencoded"
+}
+
+// isIgnoringJSONFields reports whether IgnoreJSONFields applies to the body of
+// req.
+func (p *PathGenerator) isIgnoringJSONFields(req *http.Request) bool {
+	if len(p.IgnoreJSONFields) == 0 {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return isJSON(mediaType)
+}
+
+// hashBody writes the body read from r to h, and returns the number of bytes
+// that were read. Form parameters in OmitFormParams are removed from form
+// bodies first, and fields in IgnoreJSONFields from JSON bodies.
+func (p *PathGenerator) hashBody(h hash.Hash, req *http.Request, r io.Reader) (int64, error) {
+	omitForm, ignoreJSON := p.isOmittingFormParams(req), p.isIgnoringJSONFields(req)
+	if !omitForm && !ignoreJSON {
+		return io.Copy(h, r)
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	if ignoreJSON {
+		_, err = h.Write(canonicalJSON(body, jsonPaths(p.IgnoreJSONFields)))
+		return int64(len(body)), err
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		n, err := h.Write(body)
+		return int64(n), err
+	}
+	hashableMap(form).updateHash(h, nil, p.OmitFormParams, nil)
+	return int64(len(body)), nil
+}
+
+// MigrateRecording renames the recording for req under dir from the path
+// generated by from to the path generated by to. It can be used to rename
+// existing recordings after changing the Hash of a PathGenerator, given the
+// requests that created them. It is not an error if the paths are the same.
+func MigrateRecording(dir string, req *http.Request, from, to *PathGenerator) error {
+	oldPath, err := from.RecordingPath(req)
+	if err != nil {
+		return err
+	}
+	newPath, err := to.RecordingPath(req)
+	if err != nil {
+		return err
+	}
+	src := filepath.Join(dir, oldPath.Path())
+	dst := filepath.Join(dir, newPath.Path())
+	if src == dst {
+		return nil
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
 	}
-	return "", nil
+	return os.Rename(src, dst)
 }
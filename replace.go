@@ -0,0 +1,32 @@
+package replay
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes a file at path with write, replacing any existing file
+// atomically. The output is written to a temporary file in the same directory,
+// which is renamed over path by replaceFile. The temporary file is hidden, so
+// that it is less likely to be committed by accident if it is ever left behind,
+// and it is removed if any step fails.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	dir, filename := filepath.Split(path)
+	f, err := ioutil.TempFile(dir, "."+filename+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = replaceFile(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package replay
+
+import "os"
+
+// replaceFile atomically renames src to dst, replacing dst if it exists.
+func replaceFile(src, dst string) error {
+	return os.Rename(src, dst)
+}
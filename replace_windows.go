@@ -0,0 +1,25 @@
+//go:build windows
+
+package replay
+
+import (
+	"os"
+	"time"
+)
+
+// replaceFile renames src to dst, replacing dst if it exists. On Windows,
+// renaming over a file fails with "access is denied" if the file is open, or
+// was just closed and is still being scanned by another process. In that case,
+// the existing file is removed and the rename is retried a few times.
+func replaceFile(src, dst string) error {
+	var err error
+	for delay := 10 * time.Millisecond; delay <= time.Second; delay *= 2 {
+		if err = os.Rename(src, dst); err == nil {
+			return nil
+		}
+		if rmErr := os.Remove(dst); rmErr != nil && !os.IsNotExist(rmErr) {
+			time.Sleep(delay)
+		}
+	}
+	return err
+}
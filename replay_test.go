@@ -1,16 +1,35 @@
 package replay
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -43,6 +62,7 @@ func TestRecordReplay(t *testing.T) {
 		assert.Equal("not found\n", string(buf))
 		assert.Equal(http.StatusNotFound, res.StatusCode)
 		assert.Equal("CustomValue", res.Header.Get("X-Custom-Header"))
+		assert.Nil(res.TLS)
 	}
 }
 
@@ -184,3 +204,5231 @@ func TestMethod(t *testing.T) {
 		assert.Equal(http.StatusOK, res.StatusCode)
 	}
 }
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRecordErrors(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	client := NewClient(tmpDir)
+	rt := client.Transport.(*RoundTripper)
+	rt.RecordErrors = true
+	rt.RoundTripper = roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return nil, &net.OpError{
+				Op: "dial", Net: "tcp", Err: os.NewSyscallError(
+					"connect", syscall.ECONNREFUSED,
+				),
+			}
+		},
+	)
+	_, err = client.Get("http://127.0.0.1:1/refused")
+	require.Error(err)
+
+	client = NewPlaybackOnlyClient(tmpDir)
+	_, err = client.Get("http://127.0.0.1:1/refused")
+	var recErr *RecordedError
+	if assert.True(errors.As(err, &recErr)) {
+		assert.Equal(ErrorCategoryConnectionRefused, recErr.Category)
+		assert.Contains(recErr.Message, "connection refused")
+	}
+	assert.True(errors.Is(err, syscall.ECONNREFUSED))
+	_, ok := err.(*url.Error)
+	assert.True(ok)
+
+	// Errors caused by the request's context aren't recorded.
+	client = NewClient(tmpDir)
+	rt = client.Transport.(*RoundTripper)
+	rt.RecordErrors = true
+	rt.RoundTripper = roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "/deadline" {
+				return nil, fmt.Errorf("dial: %w", context.DeadlineExceeded)
+			}
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for path, ctx := range map[string]context.Context{
+		"/canceled": ctx,
+		"/deadline": context.Background(),
+	} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://127.0.0.1:1"+path, nil)
+		require.NoError(err)
+		_, err = client.Do(req)
+		assert.Error(err)
+		_, err = NewPlaybackOnlyClient(tmpDir).Get("http://127.0.0.1:1" + path)
+		assert.True(errors.Is(err, ErrRecordingNotFound), "%s: %v", path, err)
+	}
+
+	// A hand-written recording can still simulate a canceled request.
+	rec := &Recording{Error: &RecordedError{
+		Message:  "context canceled",
+		Category: ErrorCategoryCanceled,
+	}}
+	require.NoError(rec.Save(filepath.Join(
+		tmpDir, "http", "127.0.0.1%3A1", "GET", "canceled", "request.json",
+	)))
+	_, err = NewPlaybackOnlyClient(tmpDir).Get("http://127.0.0.1:1/canceled")
+	assert.True(errors.Is(err, context.Canceled), "%v", err)
+}
+
+func TestTrailers(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Trailer", "X-Checksum")
+			fmt.Fprintln(w, "body")
+			w.Header().Set("X-Checksum", "abc123")
+		},
+	))
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	client := NewClient(tmpDir)
+	res, err := client.Get(server.URL + "/trailers")
+	require.NoError(err)
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.Equal("abc123", res.Trailer.Get("X-Checksum"))
+	server.Close()
+
+	res, err = client.Get(server.URL + "/trailers")
+	if assert.NoError(err) && assert.NotNil(res) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal("body\n", string(buf))
+		assert.Equal("abc123", res.Trailer.Get("X-Checksum"))
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	assert := assert.New(t)
+	rec := &Recording{StatusCode: http.StatusOK, Body: []byte("hello")}
+	assert.Equal(int64(5), rec.Response().ContentLength)
+	assert.False(rec.ContentLengthMismatch())
+
+	rec.ContentLength = -1
+	rec.TransferEncoding = []string{"chunked"}
+	res := rec.Response()
+	assert.Equal(int64(-1), res.ContentLength)
+	assert.Equal([]string{"chunked"}, res.TransferEncoding)
+
+	// A hand-edited body that no longer matches the recorded length.
+	rec = &Recording{
+		StatusCode:    http.StatusOK,
+		ContentLength: 10,
+		Headers:       http.Header{"Content-Length": []string{"10"}},
+		Body:          []byte("edited"),
+	}
+	assert.True(rec.ContentLengthMismatch())
+	res = rec.Response()
+	assert.Equal(int64(6), res.ContentLength)
+	assert.Equal("6", res.Header.Get("Content-Length"))
+	assert.Equal("10", rec.Headers.Get("Content-Length"))
+}
+
+func TestParseError(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "http", "example.com", "GET", "request.json")
+	rec := &Recording{
+		StatusCode: http.StatusOK,
+		Headers:    http.Header{"Content-Length": []string{"11"}},
+		Body:       []byte("hello world"),
+	}
+	require.NoError(rec.Save(path))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(err)
+
+	// A hand-edited recording with a trailing comma.
+	broken := bytes.Replace(data, []byte(`"status_code": 200`), []byte(`"status_code": 200,`), 1)
+	require.NoError(ioutil.WriteFile(path, broken, 0644))
+	_, err = LoadRecording(path)
+	var parseErr *ParseError
+	require.True(errors.As(err, &parseErr), "%v", err)
+	assert.Equal(path, parseErr.Path)
+	assert.Equal(int64(bytes.Index(broken, []byte(`200,`))+5), parseErr.Offset)
+	assert.Contains(parseErr.Excerpt, `200,`)
+	assert.LessOrEqual(len(parseErr.Excerpt), 40)
+	var syntaxErr *json.SyntaxError
+	assert.True(errors.As(err, &syntaxErr))
+	assert.Contains(err.Error(), path+": invalid recording at offset")
+
+	client := &http.Client{Transport: &RoundTripper{Dir: tmpDir, Mode: ModePlaybackOnly}}
+	_, err = client.Get("http://example.com/")
+	var replayErr *Error
+	require.True(errors.As(err, &replayErr))
+	assert.True(errors.As(err, &parseErr))
+
+	// A recording cut off in the middle of its JSON.
+	require.NoError(ioutil.WriteFile(path, data[:20], 0644))
+	_, err = LoadRecording(path)
+	require.True(errors.As(err, &parseErr), "%v", err)
+	assert.Equal(int64(20), parseErr.Offset)
+	assert.True(errors.Is(err, io.ErrUnexpectedEOF))
+
+	// A recording cut off in the middle of its body.
+	require.NoError(ioutil.WriteFile(path, data[:len(data)-5], 0644))
+	_, err = LoadRecording(path)
+	var truncatedErr *TruncatedError
+	require.True(errors.As(err, &truncatedErr), "%v", err)
+	assert.Equal(&TruncatedError{Path: path, Expected: 11, Actual: 6}, truncatedErr)
+	_, err = client.Get("http://example.com/")
+	assert.True(errors.As(err, &truncatedErr))
+
+	// A longer body is assumed to have been edited by hand.
+	require.NoError(ioutil.WriteFile(path, append(data, "!"...), 0644))
+	rec, err = LoadRecording(path)
+	require.NoError(err)
+	assert.Equal("hello world!", string(rec.Body))
+}
+
+func TestReRecordCorrupt(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello world")
+	}))
+	defer server.Close()
+	client := NewClient(tmpDir)
+	client.Transport.(*RoundTripper).TrackUsage = true
+	res, err := client.Get(server.URL + "/")
+	require.NoError(err)
+	res.Body.Close()
+	paths := client.Transport.(*RoundTripper).UsedRecordings()
+	require.Len(paths, 1)
+	path := paths[0]
+	data, err := ioutil.ReadFile(path)
+	require.NoError(err)
+
+	get := func(rt *RoundTripper) (string, error) {
+		res, err := (&http.Client{Transport: rt}).Get(server.URL + "/")
+		if err != nil {
+			return "", err
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return string(body), err
+	}
+	for _, corrupt := range [][]byte{data[:len(data)-3], data[:10], []byte("null")} {
+		require.NoError(ioutil.WriteFile(path, corrupt, 0644))
+		_, err = LoadRecording(path)
+		assert.True(errors.Is(err, ErrCorruptRecording), "%v", err)
+		_, err = get(&RoundTripper{Dir: tmpDir})
+		assert.True(errors.Is(err, ErrCorruptRecording), "%v", err)
+
+		body, err := get(&RoundTripper{Dir: tmpDir, ReRecordCorrupt: true})
+		require.NoError(err)
+		assert.Equal("hello world", body)
+		rec, err := LoadRecording(path)
+		require.NoError(err)
+		assert.Equal("hello world", string(rec.Body))
+	}
+	require.NoError(ioutil.WriteFile(path, []byte("null"), 0644))
+	_, err = get(&RoundTripper{Dir: tmpDir, Mode: ModePlaybackOnly, ReRecordCorrupt: true})
+	assert.True(errors.Is(err, ErrCorruptRecording), "%v", err)
+}
+
+func FuzzReadRecording(f *testing.F) {
+	var buf bytes.Buffer
+	rec := &Recording{
+		StatusCode: http.StatusOK,
+		Headers:    http.Header{"Content-Length": {"5"}},
+		Chunks:     []RecordedChunk{{OffsetMS: 10, Text: "a"}},
+		Body:       []byte("hello"),
+	}
+	rec.WriteTo(&buf)
+	f.Add(buf.Bytes())
+	f.Add([]byte("null"))
+	f.Add([]byte(`{"status_code": 200, "headers": {"Content-Length": ["10"]}}` + "\nshort"))
+	f.Add([]byte(`{"inject_error": {"type": "bogus"}}`))
+	f.Add([]byte(`{"error": {"message": "x", "category": "timeout"}}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rec, err := ReadRecording(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		res := rec.Response()
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	})
+}
+
+func TestWriteToReadRecording(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	for _, rec := range []*Recording{
+		{StatusCode: http.StatusOK, Headers: http.Header{"Content-Type": {"text/plain"}},
+			Body: []byte("hello\n")},
+		{StatusCode: http.StatusOK, Body: []byte("\nstarts with a newline")},
+		{StatusCode: http.StatusOK},
+		{StatusCode: http.StatusNoContent, Body: []byte("dropped")},
+		{Error: &RecordedError{Message: "connection refused"}},
+	} {
+		path := filepath.Join(tmpDir, "request.json")
+		require.NoError(rec.Save(path))
+		saved, err := ioutil.ReadFile(path)
+		require.NoError(err)
+
+		var buf bytes.Buffer
+		n, err := rec.WriteTo(&buf)
+		require.NoError(err)
+		assert.Equal(int64(buf.Len()), n)
+		assert.Equal(string(saved), buf.String())
+
+		read, err := ReadRecording(bytes.NewReader(saved))
+		require.NoError(err)
+		loaded, err := LoadRecording(path)
+		require.NoError(err)
+		assert.Equal(loaded.Body, read.Body)
+		assert.Equal(loaded.Headers, read.Headers)
+		var again bytes.Buffer
+		_, err = read.WriteTo(&again)
+		require.NoError(err)
+		assert.Equal(string(saved), again.String())
+	}
+
+	_, err = ReadRecording(strings.NewReader("{]"))
+	var parseErr *ParseError
+	require.True(errors.As(err, &parseErr))
+	assert.Empty(parseErr.Path)
+	assert.EqualError(err, `invalid recording at offset 2 near "{]": `+
+		`invalid character ']' looking for beginning of object key string`)
+}
+
+func TestCassette(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	count := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		w.Header().Set("Content-Type", "application/octet-stream")
+		fmt.Fprintf(w, "%s\x00\xff%d", r.URL.Path, count)
+	}))
+	cassettePath := filepath.Join(tmpDir, "suite", "cassette.ndjson")
+	cassette, err := OpenCassette(cassettePath)
+	require.NoError(err)
+	get := func(client *http.Client, path string) string {
+		res, err := client.Get(server.URL + path)
+		require.NoError(err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		require.NoError(err)
+		return string(body)
+	}
+	client := NewClientWithOptions("", WithStore(cassette), WithMode(ModeRecordOnly))
+	assert.Equal("/a\x00\xff1", get(client, "/a"))
+	assert.Equal("/b\x00\xff2", get(client, "/b"))
+	assert.Equal("/a\x00\xff3", get(client, "/a"))
+	data, err := ioutil.ReadFile(cassettePath)
+	require.NoError(err)
+	assert.Equal(3, bytes.Count(data, []byte("\n")), "saves are appended")
+	require.NoError(cassette.Close())
+	data, err = ioutil.ReadFile(cassettePath)
+	require.NoError(err)
+	assert.Equal(2, bytes.Count(data, []byte("\n")), "Close rewrites")
+	server.Close()
+
+	cassette, err = OpenCassette(cassettePath)
+	require.NoError(err)
+	host := escapePathComponent(strings.TrimPrefix(server.URL, "http://"))
+	assert.Equal([]string{"http/" + host + "/GET/a/request.json", "http/" + host + "/GET/b/request.json"},
+		cassette.Keys())
+	client = NewClientWithOptions("", WithStore(cassette), WithMode(ModePlaybackOnly))
+	assert.Equal("/a\x00\xff3", get(client, "/a"))
+	assert.Equal("/b\x00\xff2", get(client, "/b"))
+	_, err = client.Get(server.URL + "/c")
+	assert.True(errors.Is(err, ErrRecordingNotFound))
+	require.NoError(cassette.Close())
+	assert.Error(cassette.Save("x/request.json", &Recording{}))
+
+	// Converting to a directory and back.
+	dir := filepath.Join(tmpDir, "unpacked")
+	require.NoError(Unpack(cassettePath, dir))
+	rec, err := LoadRecording(filepath.Join(dir, "http", host, "GET", "a", "request.json"))
+	require.NoError(err)
+	assert.Equal("/a\x00\xff3", string(rec.Body))
+	assert.Equal("application/octet-stream", rec.Headers.Get("Content-Type"))
+	packed := filepath.Join(tmpDir, "packed.ndjson")
+	require.NoError(Pack(dir, packed))
+	repacked, err := ioutil.ReadFile(packed)
+	require.NoError(err)
+	assert.Equal(string(data), string(repacked))
+
+	// Keys can't escape the directory.
+	require.NoError(ioutil.WriteFile(packed, []byte(`{"key":"../evil.json","status_code":200}`+"\n"), 0644))
+	_, err = OpenCassette(packed)
+	assert.EqualError(err, packed+`: invalid key "../evil.json"`)
+	assert.Error(Unpack(packed, dir))
+	assert.Error(Unpack(filepath.Join(tmpDir, "missing.ndjson"), dir))
+	require.NoError(ioutil.WriteFile(packed, []byte(`{"key":"a.json",`), 0644))
+	_, err = OpenCassette(packed)
+	var parseErr *ParseError
+	assert.True(errors.As(err, &parseErr))
+}
+
+func TestZip(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	dir := filepath.Join(tmpDir, "testdata")
+	for _, path := range []string{"a", "a.b", "b/c"} {
+		rec := &Recording{StatusCode: http.StatusOK, Body: []byte("/" + path)}
+		require.NoError(rec.Save(filepath.Join(
+			dir, "http", "example.com", "GET", filepath.FromSlash(path), "request.json",
+		)))
+	}
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a recording"), 0644))
+	zipPath := filepath.Join(tmpDir, "testdata.zip")
+	require.NoError(ZipDir(dir, zipPath))
+	first, err := ioutil.ReadFile(zipPath)
+	require.NoError(err)
+
+	// The archive doesn't depend on modification times.
+	later := time.Now().Add(time.Hour)
+	require.NoError(os.Chtimes(filepath.Join(dir, "http", "example.com", "GET", "a", "request.json"), later, later))
+	require.NoError(ZipDir(dir, zipPath))
+	second, err := ioutil.ReadFile(zipPath)
+	require.NoError(err)
+	assert.Equal(first, second)
+
+	store, err := OpenZip(zipPath)
+	require.NoError(err)
+	defer store.Close()
+	assert.Equal([]string{
+		"http/example.com/GET/a.b/request.json",
+		"http/example.com/GET/a/request.json",
+		"http/example.com/GET/b/c/request.json",
+	}, store.Keys())
+
+	client := NewClientWithOptions("", WithStore(store), WithMode(ModePlaybackOnly))
+	for _, path := range []string{"/a", "/a.b", "/b/c"} {
+		res, err := client.Get("http://example.com" + path)
+		require.NoError(err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		require.NoError(err)
+		assert.Equal(path, string(body))
+	}
+	_, err = client.Get("http://example.com/missing")
+	assert.True(errors.Is(err, ErrRecordingNotFound))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	client = NewClientWithOptions("", WithStore(store), WithMode(ModeRecordOnly))
+	_, err = client.Get(server.URL + "/a")
+	assert.True(errors.Is(err, ErrReadOnlyStore), "%v", err)
+}
+
+func TestErrorPath(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	assert.EqualError(&Error{Err: errors.New("failed")}, "failed")
+	assert.EqualError(&Error{Err: errors.New("failed"), Path: "a/b.json"}, "a/b.json: failed")
+
+	// A corrupt recording.
+	path := filepath.Join(tmpDir, "http", "example.com", "GET", "corrupt", "request.json")
+	require.NoError(os.MkdirAll(filepath.Dir(path), os.ModePerm))
+	require.NoError(ioutil.WriteFile(path, []byte("{]"), 0644))
+	client := &http.Client{Transport: &RoundTripper{Dir: tmpDir, Mode: ModePlaybackOnly}}
+	_, err = client.Get("http://example.com/corrupt")
+	var replayErr *Error
+	require.True(errors.As(err, &replayErr))
+	assert.Equal(path, replayErr.Path)
+	assert.Equal(1, strings.Count(replayErr.Error(), path))
+
+	// A missing recording has no single path.
+	_, err = client.Get("http://example.com/missing")
+	require.True(errors.As(err, &replayErr))
+	assert.Empty(replayErr.Path)
+
+	// A recording that can't be saved, because a file is in the way.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpDir, "blocked"), nil, 0644))
+	client = &http.Client{Transport: &RoundTripper{Dir: filepath.Join(tmpDir, "blocked", "sub")}}
+	_, err = client.Get(server.URL + "/saved")
+	require.True(errors.As(err, &replayErr))
+	assert.Equal(filepath.Join(tmpDir, "blocked", "sub", "http",
+		escapePathComponent(strings.TrimPrefix(server.URL, "http://")), "GET", "saved", "request.json"),
+		replayErr.Path)
+	assert.Equal(1, strings.Count(replayErr.Error(), replayErr.Path), replayErr.Error())
+}
+
+func TestExplain(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	p := &PathGenerator{OmitHeaders: NewStringSet("X-Request-Id"), OmitQuery: NewStringSet("nonce")}
+	req, err := http.NewRequest("POST", "http://example.com/a/b?q=1&nonce=2", strings.NewReader("body"))
+	require.NoError(err)
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("X-Request-Id", "abc")
+	req.Header.Set("Authorization", "secret")
+	e, err := p.Explain(req)
+	require.NoError(err)
+	assert.Equal([]string{"http", "example.com", "POST", "a", "b"}, e.Components)
+	assert.Equal("text/plain", e.IncludedHeaders.Get("Accept"))
+	assert.Equal("abc", e.OmittedHeaders.Get("X-Request-Id"))
+	assert.Equal(url.Values{"q": {"1"}}, e.IncludedQuery)
+	assert.Equal(url.Values{"nonce": {"2"}}, e.OmittedQuery)
+	assert.Equal(int64(4), e.BodySize)
+	rp, err := p.RecordingPath(req)
+	require.NoError(err)
+	assert.Equal(rp.Path(), e.Path)
+	assert.Equal(rp.GenericPath(), e.GenericPath)
+	assert.NotEmpty(e.Checksum)
+	body, err := ioutil.ReadAll(req.Body)
+	require.NoError(err)
+	assert.Equal("body", string(body))
+
+	report := e.String()
+	assert.Contains(report, `header X-Request-Id: ["abc"] (omitted)`)
+	assert.Contains(report, `query nonce: ["2"] (omitted)`)
+	assert.Contains(report, "body: 4 bytes included")
+	assert.NotContains(report, "secret")
+
+	p.IgnoreBody = true
+	e, err = p.Explain(req)
+	require.NoError(err)
+	assert.True(e.BodyIgnored)
+	assert.Zero(e.BodySize)
+
+	// Playback misses include the report if Verbose is true.
+	client := &http.Client{Transport: &RoundTripper{Dir: tmpDir, Mode: ModePlaybackOnly}}
+	_, err = client.Get("http://example.com/missing?q=1")
+	var notFound *NotFoundError
+	require.True(errors.As(err, &notFound))
+	assert.Nil(notFound.Explanation)
+	client = &http.Client{Transport: &RoundTripper{Dir: tmpDir, Mode: ModePlaybackOnly, Verbose: true}}
+	_, err = client.Get("http://example.com/missing?q=1")
+	require.True(errors.As(err, &notFound))
+	require.NotNil(notFound.Explanation)
+	assert.Contains(err.Error(), `query q: ["1"] (included in checksum)`)
+}
+
+func TestKeyFunc(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+	keyFunc := func(req *http.Request) (string, error) {
+		switch req.URL.Path {
+		case "/users", "/people":
+			return "users/list", nil
+		case "/orders":
+			return ".orders", nil
+		case "/bad":
+			return "", errors.New("no key")
+		}
+		return "", nil
+	}
+	rt := &RoundTripper{Dir: tmpDir, Mode: ModeRecordIfMissing, KeyFunc: keyFunc, TrackUsage: true}
+	client := &http.Client{Transport: rt}
+	for _, path := range []string{"/users", "/orders", "/other"} {
+		res, err := client.Get(server.URL + path)
+		require.NoError(err)
+		res.Body.Close()
+	}
+	assert.FileExists(filepath.Join(tmpDir, "users", "list.json"))
+	assert.FileExists(filepath.Join(tmpDir, "%2Eorders.json"))
+	rp, err := rt.PathGenerator.RecordingPath(httptest.NewRequest("GET", server.URL+"/other", nil))
+	require.NoError(err)
+	assert.FileExists(filepath.Join(tmpDir, rp.Path()))
+	_, err = client.Get(server.URL + "/bad")
+	assert.EqualError(errors.Unwrap(err), "no key")
+	assert.Empty(rt.DuplicateKeys())
+
+	// Playback uses the same keys, so a different request with the same key
+	// gets the same recording.
+	rt = &RoundTripper{Dir: tmpDir, Mode: ModePlaybackOnly, KeyFunc: keyFunc, TrackUsage: true}
+	client = &http.Client{Transport: rt}
+	for _, path := range []string{"/users", "/people"} {
+		res, err := client.Get(server.URL + path)
+		require.NoError(err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		require.NoError(err)
+		assert.Equal("/users", string(body))
+	}
+	assert.Equal(map[string][]string{
+		"users/list": {"GET " + server.URL + "/people", "GET " + server.URL + "/users"},
+	}, rt.DuplicateKeys())
+}
+
+// methodPather is a Pather that keeps recordings in a directory per method.
+type methodPather struct{}
+
+func (methodPather) RecordingPath(req *http.Request) (*RecordingPath, error) {
+	return NewRecordingPath("by-method/"+req.Method, req.URL.Query().Get("v")), nil
+}
+
+func TestPather(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	rp := NewRecordingPath("a/b", "123")
+	assert.Equal(filepath.Join("a", "b", "request.123.json"), rp.Path())
+	assert.Equal(filepath.Join("a", "b", "request.json"), rp.GenericPath())
+	assert.Equal("123", rp.Checksum())
+	_, ok := rp.AnyHostPath(false)
+	assert.False(ok)
+	var _ Pather = NewPathGenerator()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+	client := NewClientWithOptions(tmpDir, WithPather(methodPather{}))
+	res, err := client.Get(server.URL + "/anything?v=1")
+	require.NoError(err)
+	res.Body.Close()
+	assert.FileExists(filepath.Join(tmpDir, "by-method", "GET", "request.1.json"))
+
+	// The recording without a checksum is played back for other requests.
+	require.NoError(os.Rename(filepath.Join(tmpDir, "by-method", "GET", "request.1.json"),
+		filepath.Join(tmpDir, "by-method", "GET", "request.json")))
+	client = NewClientWithOptions(tmpDir, WithPather(methodPather{}), WithMode(ModePlaybackOnly))
+	res, err = client.Get("http://example.com/other?v=2")
+	require.NoError(err)
+	res.Body.Close()
+	_, err = client.Post("http://example.com/other", "text/plain", strings.NewReader("body"))
+	var notFound *NotFoundError
+	require.True(errors.As(err, &notFound))
+	assert.Equal([]string{filepath.Join(tmpDir, "by-method", "POST", "request.json")}, notFound.Paths)
+
+	client.Transport.(*RoundTripper).Verbose = true
+	_, err = client.Post("http://example.com/other", "text/plain", strings.NewReader("body"))
+	require.True(errors.As(err, &notFound))
+	require.NotNil(notFound.Explanation)
+	assert.True(notFound.Explanation.Custom)
+	assert.Equal([]string{"by-method", "POST"}, notFound.Explanation.Components)
+}
+
+func TestShouldRecord(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	for _, mode := range []Mode{ModeRecordIfMissing, ModeRecordOnly} {
+		requests.Store(0)
+		rt := &RoundTripper{
+			Dir:  filepath.Join(tmpDir, mode.String()),
+			Mode: mode,
+			ShouldRecord: func(req *http.Request, res *http.Response) bool {
+				return res.StatusCode < 500 && req.URL.Path != "/health"
+			},
+		}
+		client := &http.Client{Transport: rt}
+		for i := 0; i < 2; i++ {
+			for _, path := range []string{"/ok", "/fail", "/health"} {
+				res, err := client.Get(server.URL + path)
+				require.NoError(err)
+				body, err := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				require.NoError(err)
+				assert.Equal(path, string(body))
+			}
+		}
+		saved, err := ReportUnused(rt.Dir, nil)
+		require.NoError(err)
+		require.Len(saved, 1, mode)
+		assert.Equal("ok", filepath.Base(filepath.Dir(saved[0])), mode)
+		stats := rt.Stats()
+		if mode == ModeRecordIfMissing {
+			// The second request for /ok is played back.
+			assert.EqualValues(5, requests.Load())
+			assert.Equal(Stats{Replayed: 1, Recorded: 1, LivePassthrough: 4}, stats)
+		} else {
+			assert.EqualValues(6, requests.Load())
+			assert.Equal(Stats{Recorded: 2, LivePassthrough: 4}, stats)
+		}
+	}
+}
+
+func TestParseStatusRanges(t *testing.T) {
+	assert := assert.New(t)
+	for _, test := range []struct {
+		pattern string
+		match   []int
+		noMatch []int
+	}{
+		{"2xx", []int{200, 204, 299}, []int{199, 300, 404}},
+		{"5XX", []int{500, 503}, []int{499, 600}},
+		{"404", []int{404}, []int{400, 405}},
+		{" 500-503 ", []int{500, 503}, []int{499, 504}},
+		{"200-200", []int{200}, []int{201}},
+	} {
+		ranges, err := parseStatusRanges([]string{test.pattern})
+		if !assert.NoError(err, test.pattern) {
+			continue
+		}
+		for _, code := range test.match {
+			assert.True(matchStatus(ranges, code), "%s %d", test.pattern, code)
+		}
+		for _, code := range test.noMatch {
+			assert.False(matchStatus(ranges, code), "%s %d", test.pattern, code)
+		}
+	}
+	for _, pattern := range []string{"", "x", "0xx", "6xx", "2x", "2xxx", "99", "1000", "503-500", "500-", "-500", "abc"} {
+		_, err := parseStatusRanges([]string{"2xx", pattern})
+		assert.EqualError(err, fmt.Sprintf("replay: invalid status %q in RecordStatuses", pattern))
+	}
+	ranges, err := parseStatusRanges([]string{"2xx", "404"})
+	assert.NoError(err)
+	assert.True(matchStatus(ranges, 404))
+	assert.False(matchStatus(ranges, 503))
+}
+
+func TestRecordStatuses(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first response is an error, and later ones succeed.
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	rt := &RoundTripper{Dir: tmpDir, Mode: ModeRecordIfMissing, RecordStatuses: []string{"2xx", "404"}}
+	client := &http.Client{Transport: rt}
+	get := func() int {
+		res, err := client.Get(server.URL + "/flaky")
+		require.NoError(err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	// The filtered out response is returned, but doesn't create a
+	// recording, so the next request is sent again.
+	assert.Equal(http.StatusServiceUnavailable, get())
+	unused, err := ReportUnused(tmpDir, nil)
+	require.NoError(err)
+	assert.Empty(unused)
+	assert.Equal(http.StatusOK, get())
+	assert.Equal(http.StatusOK, get())
+	assert.EqualValues(2, requests.Load())
+	assert.Equal(Stats{Replayed: 1, Recorded: 1, LivePassthrough: 1}, rt.Stats())
+
+	// Invalid patterns fail before the request is sent.
+	rt.RecordStatuses = []string{"2xx", "bad"}
+	rt.Mode = ModeRecordOnly
+	_, err = client.Get(server.URL + "/flaky")
+	assert.ErrorContains(err, `replay: invalid status "bad" in RecordStatuses`)
+	assert.EqualValues(2, requests.Load())
+}
+
+func TestMaxBodySize(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	big := strings.Repeat("x", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			fmt.Fprint(w, "small")
+		case "/big":
+			fmt.Fprint(w, big)
+		case "/big-chunked":
+			// Flushing first leaves the length unknown.
+			w.(http.Flusher).Flush()
+			fmt.Fprint(w, big)
+		}
+	}))
+	defer server.Close()
+
+	for i, rt := range []*RoundTripper{
+		{},
+		{StreamRecord: true},
+		{RecordChunks: func(*http.Response) bool { return true }},
+	} {
+		var recordErrors []error
+		rt.Dir = filepath.Join(tmpDir, strconv.Itoa(i))
+		rt.Mode = ModeRecordOnly
+		rt.MaxBodySize = 10
+		rt.OnRecordError = func(req *http.Request, path string, err error) {
+			recordErrors = append(recordErrors, err)
+		}
+		client := &http.Client{Transport: rt}
+		for _, path := range []string{"/small", "/big", "/big-chunked"} {
+			res, err := client.Get(server.URL + path)
+			require.NoError(err)
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			require.NoError(err)
+			if path == "/small" {
+				assert.Equal("small", string(body))
+			} else {
+				assert.Equal(big, string(body), "%d %s", i, path)
+			}
+		}
+		saved, err := ReportUnused(rt.Dir, nil)
+		require.NoError(err)
+		require.Len(saved, 1, i)
+		assert.Equal("small", filepath.Base(filepath.Dir(saved[0])))
+		require.Len(recordErrors, 2, i)
+		for _, err := range recordErrors {
+			assert.ErrorIs(err, ErrRecordingTooLarge)
+			assert.ErrorContains(err, "body is larger than MaxBodySize (10 bytes)")
+		}
+		assert.Equal(Stats{Recorded: 1, LivePassthrough: 2}, rt.Stats(), i)
+	}
+
+	// Existing recordings are played back whatever their size.
+	rt := &RoundTripper{Dir: filepath.Join(tmpDir, "playback"), MaxBodySize: 10}
+	rp, err := NewPathGenerator().RecordingPath(httptest.NewRequest("GET", "http://example.com/big", nil))
+	require.NoError(err)
+	rec := &Recording{StatusCode: http.StatusOK, Body: []byte(big)}
+	require.NoError(rec.Save(filepath.Join(rt.Dir, rp.Path())))
+	res, err := (&http.Client{Transport: rt}).Get("http://example.com/big")
+	require.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(err)
+	assert.Equal(big, string(body))
+}
+
+func TestDelay(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	gen := NewPathGenerator()
+	for path, delayMS := range map[string]int64{"/fast": 0, "/slow": 50, "/hang": 60000} {
+		rp, err := gen.RecordingPath(httptest.NewRequest("GET", "http://example.com"+path, nil))
+		require.NoError(err)
+		rec := &Recording{StatusCode: http.StatusOK, DelayMS: delayMS, Body: []byte("ok")}
+		require.NoError(rec.Save(filepath.Join(tmpDir, rp.Path())))
+	}
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "http", "example.com", "GET", "slow", "request.json"))
+	require.NoError(err)
+	assert.Contains(string(data), `"delay_ms": 50`)
+
+	client := NewPlaybackOnlyClient(tmpDir)
+	for path, min := range map[string]time.Duration{"/fast": 0, "/slow": 50 * time.Millisecond} {
+		start := time.Now()
+		res, err := client.Get("http://example.com" + path)
+		require.NoError(err)
+		res.Body.Close()
+		assert.GreaterOrEqual(time.Since(start), min, path)
+	}
+
+	// A deadline that passes first is reported as a timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com/hang", nil)
+	require.NoError(err)
+	start := time.Now()
+	_, err = client.Do(req)
+	assert.Less(time.Since(start), 10*time.Second)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+	var urlErr *url.Error
+	require.True(errors.As(err, &urlErr))
+	assert.True(urlErr.Timeout())
+	assert.Contains(err.Error(), filepath.Join("GET", "hang", "request.json"))
+
+	client.Timeout = 20 * time.Millisecond
+	_, err = client.Get("http://example.com/hang")
+	require.True(errors.As(err, &urlErr))
+	assert.True(urlErr.Timeout())
+
+	// Cancellation isn't a timeout.
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	req, err = http.NewRequestWithContext(ctx, "GET", "http://example.com/hang", nil)
+	require.NoError(err)
+	client.Timeout = 0
+	_, err = client.Do(req)
+	assert.ErrorIs(err, context.Canceled)
+	require.True(errors.As(err, &urlErr))
+	assert.False(urlErr.Timeout())
+}
+
+func TestBodyFaults(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	gen := NewPathGenerator()
+	save := func(path string, rec *Recording) {
+		rp, err := gen.RecordingPath(httptest.NewRequest("GET", "http://example.com"+path, nil))
+		require.NoError(err)
+		rec.StatusCode = http.StatusOK
+		rec.Headers = http.Header{"Content-Length": {"10"}}
+		rec.Body = []byte("0123456789")
+		require.NoError(rec.Save(filepath.Join(tmpDir, rp.Path())))
+	}
+	save("/eof", &Recording{TruncateBodyAt: 4})
+	save("/reset", &Recording{TruncateBodyAt: 4, BodyError: BodyErrorReset})
+	save("/immediate", &Recording{BodyError: BodyErrorUnexpectedEOF})
+	save("/end", &Recording{TruncateBodyAt: 20, BodyError: BodyErrorReset})
+	save("/injected", &Recording{InjectError: &InjectedError{Type: InjectTimeout}, DelayMS: 60000})
+	save("/invalid", &Recording{BodyError: "bogus"})
+
+	get := func(client *http.Client, path string) (string, error) {
+		res, err := client.Get("http://example.com" + path)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		assert.EqualValues(10, res.ContentLength)
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+	client := NewPlaybackOnlyClient(tmpDir)
+	body, err := get(client, "/eof")
+	assert.Equal("0123", body)
+	assert.Equal(io.ErrUnexpectedEOF, err)
+	body, err = get(client, "/reset")
+	assert.Equal("0123", body)
+	assert.ErrorIs(err, syscall.ECONNRESET)
+	body, err = get(client, "/immediate")
+	assert.Empty(body)
+	assert.ErrorIs(err, io.ErrUnexpectedEOF)
+	body, err = get(client, "/end")
+	assert.Equal("0123456789", body)
+	assert.ErrorIs(err, syscall.ECONNRESET)
+	_, err = get(client, "/invalid")
+	assert.ErrorContains(err, `invalid body_error "bogus"`)
+
+	// The same recordings are played back in full with IgnoreFaults.
+	client = NewClientWithOptions(tmpDir, WithMode(ModePlaybackOnly))
+	client.Transport.(*RoundTripper).IgnoreFaults = true
+	for _, path := range []string{"/eof", "/reset", "/immediate", "/end", "/injected"} {
+		body, err := get(client, path)
+		require.NoError(err, path)
+		assert.Equal("0123456789", body, path)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintln(w, "secure")
+		},
+	))
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	client := NewClient(tmpDir)
+	rt := client.Transport.(*RoundTripper)
+	rt.RoundTripper = server.Client().Transport
+	rt.RecordTLS = true
+	res, err := client.Get(server.URL + "/secure")
+	require.NoError(err)
+	require.NotNil(res.TLS)
+	version := res.TLS.Version
+	subject := res.TLS.PeerCertificates[0].Subject
+	server.Close()
+
+	res, err = client.Get(server.URL + "/secure")
+	if assert.NoError(err) && assert.NotNil(res) {
+		res.Body.Close()
+		if assert.NotNil(res.TLS) {
+			assert.Equal(version, res.TLS.Version)
+			assert.True(res.TLS.HandshakeComplete)
+			if assert.NotEmpty(res.TLS.PeerCertificates) {
+				replayed := res.TLS.PeerCertificates[0].Subject
+				assert.Equal(subject.String(), replayed.String())
+				assert.Equal(subject.Organization, replayed.Organization)
+			}
+		}
+	}
+
+	// Subjects are parsed back from their string form, including attributes
+	// without a field in pkix.Name, as parsed from a certificate.
+	email := asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+	name := pkix.Name{
+		Country:      []string{"US"},
+		Organization: []string{"Acme, Inc.", "+Plus"},
+		CommonName:   " #example.com\\ ",
+		Names:        []pkix.AttributeTypeAndValue{{Type: email, Value: "admin@example.com"}},
+	}
+	parsed, err := parseDistinguishedName(name.String())
+	require.NoError(err)
+	assert.Equal(name.String(), parsed.String())
+	assert.Equal(name.Organization, parsed.Organization)
+	assert.Equal(name.CommonName, parsed.CommonName)
+	parsed, err = parseDistinguishedName("1.2.3.4=#0101ff,CN=a")
+	require.NoError(err)
+	assert.Equal("a", parsed.CommonName)
+	assert.Contains(parsed.Names, pkix.AttributeTypeAndValue{
+		Type: asn1.ObjectIdentifier{1, 2, 3, 4}, Value: true,
+	})
+	_, err = parseDistinguishedName("CN=a,bogus")
+	assert.Error(err)
+	cs := (&RecordedTLS{PeerCertificates: []RecordedCertificate{
+		{Subject: "not a name", CommonName: "example.com"},
+	}}).ConnectionState(nil)
+	assert.Equal("CN=example.com", cs.PeerCertificates[0].Subject.String())
+}
+
+func TestConcurrentRecording(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			time.Sleep(10 * time.Millisecond)
+			fmt.Fprintln(w, "once")
+		},
+	))
+	defer server.Close()
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	client := NewClient(tmpDir)
+	client.Transport.(*RoundTripper).Coalesce = true
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(server.URL + "/concurrent")
+			if err == nil {
+				_, err = ioutil.ReadAll(res.Body)
+				res.Body.Close()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(err)
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&hits))
+	assert.Empty(client.Transport.(*RoundTripper).locks)
+}
+
+func TestConcurrentRecordingBodies(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			time.Sleep(10 * time.Millisecond)
+			fmt.Fprint(w, strings.Repeat("x", 1024))
+		},
+	))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		mode     Mode
+		coalesce bool
+	}{
+		{ModeRecordIfMissing, true},
+		{ModeRecordIfMissing, false},
+		{ModeRecordOnly, true},
+	} {
+		tmpDir, err := ioutil.TempDir("", "")
+		require.NoError(err)
+		defer os.RemoveAll(tmpDir)
+		atomic.StoreInt32(&hits, 0)
+
+		client := NewClient(tmpDir)
+		rt := client.Transport.(*RoundTripper)
+		rt.Mode = tc.mode
+		rt.Coalesce = tc.coalesce
+		rt.CacheRecordings = true
+		bodies := make(chan string, 20)
+		var wg sync.WaitGroup
+		for i := 0; i < cap(bodies); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := client.Get(server.URL + "/bodies")
+				if !assert.NoError(err) {
+					bodies <- ""
+					return
+				}
+				defer res.Body.Close()
+				// Read slowly, so that bodies are read concurrently.
+				var buf bytes.Buffer
+				for {
+					n, err := io.CopyN(&buf, res.Body, 100)
+					if err != nil || n == 0 {
+						break
+					}
+					time.Sleep(time.Millisecond)
+				}
+				bodies <- buf.String()
+			}()
+		}
+		wg.Wait()
+		close(bodies)
+		for body := range bodies {
+			assert.Equal(strings.Repeat("x", 1024), body)
+		}
+		// Requests are only coalesced in ModeRecordIfMissing.
+		if tc.coalesce && tc.mode == ModeRecordIfMissing {
+			assert.Equal(int32(1), atomic.LoadInt32(&hits))
+		} else {
+			assert.Equal(int32(20), atomic.LoadInt32(&hits))
+		}
+	}
+}
+
+func TestSaveReplace(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "a", "request.json")
+	rec := &Recording{StatusCode: http.StatusOK, Body: []byte("first")}
+	require.NoError(rec.Save(path))
+	rec = &Recording{StatusCode: http.StatusCreated, Body: []byte("second")}
+	require.NoError(rec.Save(path))
+
+	rec, err = LoadRecording(path)
+	require.NoError(err)
+	assert.Equal(http.StatusCreated, rec.StatusCode)
+	assert.Equal("second", string(rec.Body))
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	require.NoError(err)
+	assert.Len(files, 1)
+
+	// A failed save must not leave a temporary file behind.
+	require.NoError(os.Mkdir(filepath.Join(tmpDir, "a", "dir.json"), 0755))
+	rec = &Recording{StatusCode: http.StatusOK}
+	assert.Error(rec.Save(filepath.Join(tmpDir, "a", "dir.json")))
+	files, err = ioutil.ReadDir(filepath.Dir(path))
+	require.NoError(err)
+	assert.Len(files, 2)
+}
+
+func TestHash(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	crcGen := NewPathGenerator()
+	shaGen := NewPathGenerator()
+	shaGen.Hash = sha256.New
+	shaGen.HashLength = 16
+
+	req, _ := http.NewRequest(
+		http.MethodPost, "http://example.com/hash", strings.NewReader("body"),
+	)
+	sum, err := shaGen.RequestCRC(req)
+	require.NoError(err)
+	assert.Len(sum, 16)
+	_, err = hex.DecodeString(sum)
+	assert.NoError(err)
+
+	crcPath, err := crcGen.RecordingPath(req)
+	require.NoError(err)
+	rec := &Recording{StatusCode: http.StatusOK}
+	require.NoError(rec.Save(filepath.Join(tmpDir, crcPath.Path())))
+	require.NoError(MigrateRecording(tmpDir, req, crcGen, shaGen))
+	_, err = os.Stat(filepath.Join(tmpDir, crcPath.Path()))
+	assert.True(os.IsNotExist(err))
+	shaPath, err := shaGen.RecordingPath(req)
+	require.NoError(err)
+	assert.Equal("request."+sum+".json", filepath.Base(shaPath.Path()))
+	_, err = LoadRecording(filepath.Join(tmpDir, shaPath.Path()))
+	assert.NoError(err)
+}
+
+func TestAllowHeadersAndQuery(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	gen := NewPathGenerator()
+	gen.AllowHeaders = NewStringSet("X-Api-Version")
+	gen.AllowQuery = NewStringSet("id")
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/?trace=1", nil)
+	req.Header.Set("User-Agent", "test/1.0")
+	req.Header.Set("X-Request-Id", "abc")
+	sum, err := gen.RequestCRC(req)
+	require.NoError(err)
+	assert.Empty(sum)
+
+	req.Header.Set("X-Api-Version", "2")
+	sumA, err := gen.RequestCRC(req)
+	require.NoError(err)
+	assert.NotEmpty(sumA)
+	req.Header.Set("User-Agent", "test/2.0")
+	req.URL.RawQuery = "trace=2"
+	sumB, err := gen.RequestCRC(req)
+	require.NoError(err)
+	assert.Equal(sumA, sumB)
+
+	req.URL.RawQuery = "id=1&trace=2"
+	sumC, err := gen.RequestCRC(req)
+	require.NoError(err)
+	assert.NotEqual(sumA, sumC)
+}
+
+func TestHeaderNameCase(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	gen := NewPathGenerator()
+	gen.OmitHeaders.Add("x-api-key")
+	gen.OmitQuery = NewStringSet("Nonce")
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/?nonce=1", nil)
+	req.Header["authorization"] = []string{"secret"}
+	req.Header.Set("X-Api-Key", "key")
+	sum, err := gen.RequestCRC(req)
+	require.NoError(err)
+	assert.Empty(sum)
+
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header["x-custom"] = []string{"a"}
+	sumA, err := gen.RequestCRC(req)
+	require.NoError(err)
+	req.Header = http.Header{"X-Custom": []string{"a"}}
+	sumB, err := gen.RequestCRC(req)
+	require.NoError(err)
+	assert.Equal(sumA, sumB)
+
+	gen.ExactNames = true
+	req.Header = http.Header{"authorization": []string{"secret"}}
+	sum, err = gen.RequestCRC(req)
+	require.NoError(err)
+	assert.NotEmpty(sum)
+}
+
+func TestIgnoreBody(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	gen := NewPathGenerator()
+	gen.IgnoreBody = true
+
+	body := ioutil.NopCloser(strings.NewReader("idempotency-key=1"))
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/", body)
+	sum, err := gen.RequestCRC(req)
+	require.NoError(err)
+	assert.Empty(sum)
+	assert.Equal(body, req.Body)
+	buf, _ := ioutil.ReadAll(req.Body)
+	assert.Equal("idempotency-key=1", string(buf))
+}
+
+func TestCanonicalJSONBody(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	gen := NewPathGenerator()
+	gen.MungeRequestBody = CanonicalJSONBody("meta.timestamp", "nonce")
+
+	crc := func(body string) string {
+		req, _ := http.NewRequest(
+			http.MethodPost, "http://example.com/", strings.NewReader(body),
+		)
+		sum, err := gen.RequestCRC(req)
+		require.NoError(err)
+		buf, _ := ioutil.ReadAll(req.Body)
+		assert.Equal(body, string(buf))
+		return sum
+	}
+
+	sum := crc(`{"a": 1, "b": [1, 2], "meta": {"timestamp": 1, "id": "x"}}`)
+	assert.Equal(sum, crc(`{"meta":{"id":"x","timestamp":2},"b":[1,2],"a":1}`))
+	assert.Equal(sum, crc(`{"nonce":"n","b":[1,2],"a":1,"meta":{"id":"x"}}`))
+	assert.NotEqual(sum, crc(`{"a":2,"b":[1,2],"meta":{"id":"x"}}`))
+	assert.NotEqual(crc("not json"), crc("not  json"))
+}
+
+func TestOmitFormParams(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	gen := NewPathGenerator()
+	gen.OmitFormParams = NewStringSet("nonce", "timestamp")
+
+	crc := func(body string) string {
+		req, _ := http.NewRequest(
+			http.MethodPost, "http://example.com/", strings.NewReader(body),
+		)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		sum, err := gen.RequestCRC(req)
+		require.NoError(err)
+		buf, _ := ioutil.ReadAll(req.Body)
+		assert.Equal(body, string(buf))
+		return sum
+	}
+
+	sum := crc("a=1&b=2&nonce=x&timestamp=1")
+	assert.NotEmpty(sum)
+	assert.Equal(sum, crc("timestamp=2&b=2&nonce=y&a=1"))
+	assert.NotEqual(sum, crc("a=1&b=3&nonce=x"))
+	assert.NotEqual(crc("a=%zz&nonce=1"), crc("a=%zz&nonce=2"))
+}
+
+func TestOmitQueryPatterns(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	gen := NewPathGenerator()
+	gen.OmitQuery = NewStringSet("token")
+	gen.OmitQueryPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`^(?i)x-amz-`),
+		regexp.MustCompile(`^utm_`),
+	}
+	path := func(rawurl string) string {
+		req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+		require.NoError(err)
+		rp, err := gen.RecordingPath(req)
+		require.NoError(err)
+		return rp.Path()
+	}
+
+	const object = "https://bucket.s3.amazonaws.com/key.txt"
+	plain := path(object + "?versionId=1")
+	presigned := path(object + "?versionId=1&X-Amz-Algorithm=AWS4-HMAC-SHA256" +
+		"&X-Amz-Credential=AKID%2F20260101%2Fus-east-1%2Fs3%2Faws4_request" +
+		"&X-Amz-Date=20260101T000000Z&X-Amz-Expires=900" +
+		"&X-Amz-SignedHeaders=host&X-Amz-Signature=abc123")
+	assert.Equal(plain, presigned)
+	assert.Equal(plain, path(object+"?utm_source=a&versionId=1&utm_medium=b&token=t"))
+	assert.NotEqual(plain, path(object+"?versionId=2&X-Amz-Date=20260101T000000Z"))
+	assert.NotEqual(plain, path(object+"?versionId=1&source=a"))
+	assert.Equal(path(object), path(object+"?x-amz-date=1"))
+
+	gen.QueryInPath = true
+	assert.Equal(path(object+"?versionId=1"), path(object+"?X-Amz-Date=1&versionId=1"))
+	gen.AllowQuery = NewStringSet("X-Amz-Date")
+	assert.NotEqual(path(object+"?X-Amz-Date=1"), path(object+"?X-Amz-Date=2"))
+}
+
+func TestReadableEncoding(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	gen := NewPathGenerator()
+	dir := func(rawurl string) string {
+		req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+		require.NoError(err)
+		rp, err := gen.RecordingPath(req)
+		require.NoError(err)
+		return filepath.ToSlash(filepath.Dir(rp.Path()))
+	}
+	const rawurl = "http://example.com:8080/a%20file,%20v2/%C3%A9t%C3%A9/x+y=z%25/.."
+	assert.Equal("http/example.com%3A8080/GET/a+file%2C+v2/%C3%A9t%C3%A9/x%2By%3Dz%25/%2E%2E", dir(rawurl))
+	gen.Encoding = EncodingReadable
+	assert.Equal("http/example.com%3A8080/GET/a file, v2/été/x%2By%3Dz%25/%2E%2E", dir(rawurl))
+	assert.Equal("http/example.com/GET/a%5Cb%3Ac%2A%3F%22%3C%3E%7C%01/%2E%2E",
+		dir("http://example.com/a%5Cb:c*%3F%22%3C%3E%7C%01/%2E%2E"))
+
+	// Recording and playback agree, and Walk recovers the URL.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+	rt := &RoundTripper{Dir: tmpDir, Mode: ModeRecordIfMissing, PathGenerator: gen}
+	client := &http.Client{Transport: rt}
+	res, err := client.Get(server.URL + "/a%20file,%20v2/x+y")
+	require.NoError(err)
+	res.Body.Close()
+	rt = &RoundTripper{Dir: tmpDir, Mode: ModePlaybackOnly, PathGenerator: gen}
+	client = &http.Client{Transport: rt}
+	res, err = client.Get(server.URL + "/a%20file,%20v2/x+y")
+	require.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(err)
+	assert.Equal("/a file, v2/x+y", string(body))
+
+	var urls []string
+	require.NoError(WalkHeaders(tmpDir, func(info RecordingInfo, _ *Recording) error {
+		urls = append(urls, info.URL().String())
+		return info.Err
+	}))
+	assert.Equal([]string{server.URL + "/a%20file,%20v2/x+y"}, urls)
+}
+
+func TestReservedNames(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	for _, name := range []string{
+		"con", "PRN", "Aux", "nul", "com1", "COM9", "lpt1", "Lpt9",
+		"aux.txt", "nul.tar.gz", "con ",
+	} {
+		assert.True(isReservedName(name), name)
+		for _, escaped := range []string{escapePathComponent(name), escapeReadable(name)} {
+			assert.False(isReservedName(escaped), escaped)
+			unescaped, err := url.QueryUnescape(escaped)
+			require.NoError(err)
+			assert.Equal(name, unescaped)
+		}
+	}
+	for _, name := range []string{
+		"console", "auxiliary", "com", "com0", "com10", "lpt", "nul_", "x.aux", "",
+	} {
+		assert.False(isReservedName(name), name)
+	}
+
+	gen := NewPathGenerator()
+	req, err := http.NewRequest(http.MethodGet, "http://aux/api/aux/CON.json/settings", nil)
+	require.NoError(err)
+	rp, err := gen.RecordingPath(req)
+	require.NoError(err)
+	assert.Equal("http/%61ux/GET/api/%61ux/%43ON.json/settings/request.json",
+		filepath.ToSlash(rp.Path()))
+	gen.Encoding = EncodingReadable
+	rp, err = gen.RecordingPath(req)
+	require.NoError(err)
+	assert.Equal("http/%61ux/GET/api/%61ux/%43ON.json/settings/request.json",
+		filepath.ToSlash(rp.Path()))
+	req = req.WithContext(WithRecordingName(req.Context(), "nul"))
+	assert.Equal("%6Eul.json", DefaultFileName(req, ""))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+	for _, mode := range []Mode{ModeRecordOnly, ModePlaybackOnly} {
+		client := &http.Client{Transport: &RoundTripper{Dir: tmpDir, Mode: mode}}
+		res, err := client.Get(server.URL + "/api/aux/settings")
+		require.NoError(err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		require.NoError(err)
+		assert.Equal("/api/aux/settings", string(body))
+	}
+	var urls []string
+	require.NoError(WalkHeaders(tmpDir, func(info RecordingInfo, _ *Recording) error {
+		urls = append(urls, info.URL().String())
+		return info.Err
+	}))
+	assert.Equal([]string{server.URL + "/api/aux/settings"}, urls)
+}
+
+func TestCheckCollisions(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+	paths := []string{"/Users/ABC", "/users/abc", "/users/%C3%89t%C3%A9", "/users/%C3%A9t%C3%A9"}
+	record := func(gen *PathGenerator) string {
+		tmpDir, err := ioutil.TempDir("", "")
+		require.NoError(err)
+		for _, mode := range []Mode{ModeRecordOnly, ModePlaybackOnly} {
+			rt := &RoundTripper{Dir: tmpDir, Mode: mode, PathGenerator: gen}
+			client := &http.Client{Transport: rt}
+			for _, path := range paths {
+				res, err := client.Get(server.URL + path)
+				require.NoError(err)
+				body, err := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				require.NoError(err)
+				unescaped, _ := url.PathUnescape(path)
+				assert.Equal(unescaped, string(body))
+			}
+		}
+		return tmpDir
+	}
+
+	tmpDir := record(NewPathGenerator())
+	defer os.RemoveAll(tmpDir)
+	collisions, err := CheckCollisions(tmpDir)
+	require.NoError(err)
+	require.Len(collisions, 1)
+	assert.Equal(filepath.Join(tmpDir, "http", escapePathComponent(
+		strings.TrimPrefix(server.URL, "http://")), "GET", "Users", "ABC", "request.json"),
+		collisions[0].Path)
+	assert.Equal(filepath.Join(filepath.Dir(filepath.Dir(filepath.Dir(collisions[0].Path))),
+		"users", "abc", "request.json"), collisions[0].Other)
+
+	gen := NewPathGenerator()
+	gen.EscapeUppercase = true
+	for _, encoding := range []PathEncoding{EncodingStrict, EncodingReadable} {
+		gen.Encoding = encoding
+		tmpDir := record(gen)
+		defer os.RemoveAll(tmpDir)
+		collisions, err := CheckCollisions(tmpDir)
+		require.NoError(err)
+		assert.Empty(collisions)
+		var urls []string
+		require.NoError(WalkHeaders(tmpDir, func(info RecordingInfo, _ *Recording) error {
+			urls = append(urls, info.URL().Path)
+			return info.Err
+		}))
+		assert.ElementsMatch([]string{"/Users/ABC", "/users/abc", "/users/Été", "/users/été"}, urls)
+	}
+	assert.Equal("%55sers", escapeUppercase("Users"))
+	assert.Equal("a%2Fb%C3%89", escapeUppercase("a%2Fb%C3%89"))
+	assert.Equal("%C3%89té", escapeUppercase("Été"))
+}
+
+func TestIgnoreJSONFields(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	gen := NewPathGenerator()
+	gen.IgnoreJSONFields = []string{"request_id", "meta.timestamp", "items[].id"}
+
+	crc := func(contentType, body string) string {
+		req, _ := http.NewRequest(
+			http.MethodPost, "http://example.com/", strings.NewReader(body),
+		)
+		req.Header.Set("Content-Type", contentType)
+		sum, err := gen.RequestCRC(req)
+		require.NoError(err)
+		buf, _ := ioutil.ReadAll(req.Body)
+		assert.Equal(body, string(buf))
+		return sum
+	}
+
+	const jsonType = "application/json; charset=utf-8"
+	sum := crc(jsonType, `{"request_id":"1","meta":{"timestamp":1,"v":2},"items":[{"id":1,"n":"a"}]}`)
+	assert.Equal(sum, crc(jsonType, `{"items":[{"n":"a","id":9}], "meta":{"v":2,"timestamp":5},"request_id":"2"}`))
+	assert.Equal(sum, crc(jsonType, `{"meta":{"v":2},"items":[{"n":"a"}]}`))
+	assert.Equal(crc("application/vnd.api+json", `{"request_id":"1"}`),
+		crc("application/vnd.api+json", `{"request_id":"2"}`))
+	assert.NotEqual(sum, crc(jsonType, `{"meta":{"v":3},"items":[{"n":"a"}]}`))
+	assert.NotEqual(sum, crc("text/plain", `{"request_id":"1","meta":{"timestamp":1,"v":2},"items":[{"id":1,"n":"a"}]}`))
+	assert.NotEqual(crc(jsonType, `{"request_id": 1,`), crc(jsonType, `{"request_id": 2,`))
+}
+
+func TestImportHAR(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	har := `{"log": {"entries": [
+		{
+			"request": {"method": "GET", "url": "http://example.com/a",
+				"httpVersion": "HTTP/1.1", "headers": []},
+			"response": {"status": 200, "statusText": "OK",
+				"httpVersion": "HTTP/1.1",
+				"headers": [{"name": "Content-Type", "value": "text/plain"}],
+				"content": {"text": "aGVsbG8=", "encoding": "base64"}}
+		},
+		{
+			"request": {"method": "POST", "url": "http://example.com/b",
+				"httpVersion": "HTTP/1.1", "headers": [],
+				"postData": {"mimeType": "text/plain", "text": "body"}},
+			"response": {"status": 201, "statusText": "Created",
+				"httpVersion": "h2", "headers": [],
+				"content": {"text": "created"}}
+		},
+		{
+			"request": {"method": "GET", "url": "://bad", "headers": []},
+			"response": {"status": 200, "headers": [], "content": {}}
+		}
+	]}}`
+	n, err := ImportHAR(strings.NewReader(har), tmpDir, nil)
+	assert.Equal(2, n)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "entry 2")
+	}
+
+	client := NewPlaybackOnlyClient(tmpDir)
+	res, err := client.Get("http://example.com/a")
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal("hello", string(buf))
+		assert.Equal("text/plain", res.Header.Get("Content-Type"))
+	}
+	req, _ := http.NewRequest(
+		http.MethodPost, "http://example.com/b", strings.NewReader("body"),
+	)
+	req.Header.Set("Content-Type", "text/plain")
+	res, err = client.Do(req)
+	if assert.NoError(err) {
+		res.Body.Close()
+		assert.Equal(http.StatusCreated, res.StatusCode)
+	}
+}
+
+func TestVCRCassette(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	cassette := `---
+version: 1
+interactions:
+- request:
+    body: ""
+    form: {}
+    headers: {}
+    url: http://example.com/vcr/a
+    method: GET
+  response:
+    body: first
+    headers:
+      Content-Type:
+      - text/plain
+    status: 200 OK
+    code: 200
+    duration: ""
+- request:
+    body: ""
+    form: {}
+    headers: {Accept: [application/octet-stream]}
+    url: http://example.com/vcr/b
+    method: GET
+  response:
+    body: !!binary 3q2+7w==
+    headers: {Content-Type: [application/octet-stream]}
+    status: 200 OK
+    code: 200
+    duration: ""
+`
+	cassettePath := filepath.Join(tmpDir, "cassette.yaml")
+	require.NoError(ioutil.WriteFile(cassettePath, []byte(cassette), 0644))
+	recDir := filepath.Join(tmpDir, "recordings")
+	n, err := FromVCRCassette(cassettePath, recDir)
+	require.NoError(err)
+	assert.Equal(2, n)
+
+	client := NewPlaybackOnlyClient(recDir)
+	res, err := client.Get("http://example.com/vcr/a")
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal("first", string(buf))
+		assert.Equal("text/plain", res.Header.Get("Content-Type"))
+	}
+	req, err := http.NewRequest("GET", "http://example.com/vcr/b", nil)
+	require.NoError(err)
+	req.Header.Set("Accept", "application/octet-stream")
+	res, err = client.Do(req)
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal([]byte{0xde, 0xad, 0xbe, 0xef}, buf)
+		assert.Equal("application/octet-stream", res.Header.Get("Content-Type"))
+	}
+
+	outPath := filepath.Join(tmpDir, "out.yaml")
+	require.NoError(ToVCRCassette(recDir, outPath))
+	recDir2 := filepath.Join(tmpDir, "recordings2")
+	n, err = FromVCRCassette(outPath, recDir2)
+	require.NoError(err)
+	assert.Equal(2, n)
+	rec, err := LoadRecording(
+		filepath.Join(recDir2, "http", "example.com", "GET", "vcr", "a", "request.json"),
+	)
+	if assert.NoError(err) {
+		assert.Equal("first", string(rec.Body))
+		assert.Equal("text/plain", rec.Headers.Get("Content-Type"))
+	}
+	rec, err = LoadRecording(
+		filepath.Join(recDir2, "http", "example.com", "GET", "vcr", "b", "request.json"),
+	)
+	if assert.NoError(err) {
+		assert.Equal([]byte{0xde, 0xad, 0xbe, 0xef}, rec.Body)
+	}
+
+	// Interactions that map to the same recording are saved with recording
+	// names, so they can be replayed in turn.
+	duplicate := strings.Replace(cassette, "/vcr/b", "/vcr/a", 1)
+	duplicate = strings.Replace(duplicate, "{Accept: [application/octet-stream]}", "{}", 1)
+	require.NoError(ioutil.WriteFile(cassettePath, []byte(duplicate), 0644))
+	recDir3 := filepath.Join(tmpDir, "recordings3")
+	n, err = FromVCRCassette(cassettePath, recDir3)
+	require.NoError(err)
+	assert.Equal(2, n)
+	client = NewPlaybackOnlyClient(recDir3)
+	res, err = client.Get("http://example.com/vcr/a")
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal("first", string(buf))
+	}
+	req, err = http.NewRequest("GET", "http://example.com/vcr/a", nil)
+	require.NoError(err)
+	res, err = client.Do(req.WithContext(WithRecordingName(req.Context(), "request-2")))
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal([]byte{0xde, 0xad, 0xbe, 0xef}, buf)
+	}
+
+	// Nothing is saved if any of the interactions can't be converted.
+	invalid := strings.Replace(duplicate, "http://example.com/vcr/a", "http://[::1", 1)
+	require.NoError(ioutil.WriteFile(cassettePath, []byte(invalid), 0644))
+	recDir4 := filepath.Join(tmpDir, "recordings4")
+	n, err = FromVCRCassette(cassettePath, recDir4)
+	assert.Error(err)
+	assert.Equal(0, n)
+	_, err = os.Stat(recDir4)
+	assert.True(os.IsNotExist(err))
+}
+
+func TestProxyHandler(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			assert.Empty(req.Header.Get("Proxy-Connection"))
+			assert.Empty(req.Header.Get("X-Hop"))
+			w.Header().Set("X-Custom-Header", "CustomValue")
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintln(w, "proxied")
+		},
+	))
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	rt := NewClient(tmpDir).Transport.(*RoundTripper)
+	proxy := httptest.NewServer(NewProxyHandler(rt))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/proxy", nil)
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	res, err := client.Do(req)
+	require.NoError(err)
+	res.Body.Close()
+	server.Close()
+
+	res, err = client.Get(server.URL + "/proxy")
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(http.StatusAccepted, res.StatusCode)
+		assert.Equal("CustomValue", res.Header.Get("X-Custom-Header"))
+		assert.Equal("proxied\n", string(buf))
+	}
+}
+
+func TestProxyHandlerConnect(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	handler := NewProxyHandler(NewPlaybackOnlyClient(tmpDir).Transport.(*RoundTripper))
+	req := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(http.StatusNotImplemented, w.Code)
+	assert.Contains(w.Body.String(), "CONNECT")
+
+	req = httptest.NewRequest(http.MethodGet, "/relative", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestServer(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("X-Custom-Header", "CustomValue")
+			fmt.Fprintln(w, "from upstream")
+		},
+	))
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	res, err := NewClient(tmpDir).Get(upstream.URL + "/server")
+	require.NoError(err)
+	res.Body.Close()
+	upstream.Close()
+
+	server := NewServer(tmpDir, upstream.URL)
+	defer server.Close()
+	res, err = http.Get(server.URL + "/server")
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal("CustomValue", res.Header.Get("X-Custom-Header"))
+		assert.Equal("from upstream\n", string(buf))
+	}
+
+	res, err = http.Get(server.URL + "/missing")
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(http.StatusNotFound, res.StatusCode)
+		assert.Contains(string(buf), filepath.Join("GET", "missing"))
+	}
+}
+
+func TestRecordHandler(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	flushed := make(chan struct{})
+	handler := RecordHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			w.Header().Set("X-Custom-Header", "CustomValue")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, "got %s\n", body)
+			w.(http.Flusher).Flush()
+			<-flushed
+			fmt.Fprintln(w, "done")
+		},
+	), tmpDir, nil)
+	handler.Skip = func(req *http.Request) bool {
+		return req.URL.Path == "/skip"
+	}
+	server := httptest.NewServer(handler)
+
+	res, err := http.Post(server.URL+"/record", "text/plain", strings.NewReader("x"))
+	require.NoError(err)
+	// The first line must arrive before the handler returns.
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	require.NoError(err)
+	assert.Equal("got x\n", line)
+	close(flushed)
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res, err = http.Get(server.URL + "/skip")
+	require.NoError(err)
+	res.Body.Close()
+	server.Close()
+
+	client := NewPlaybackOnlyClient(tmpDir)
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/record", strings.NewReader("x"))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("User-Agent", "Go-http-client/1.1")
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Content-Length", "1")
+	res, err = client.Do(req)
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(http.StatusCreated, res.StatusCode)
+		assert.Equal("201 Created", res.Status)
+		assert.Equal("CustomValue", res.Header.Get("X-Custom-Header"))
+		assert.Equal("got x\ndone\n", string(buf))
+	}
+	_, err = client.Get(server.URL + "/skip")
+	assert.Error(err)
+}
+
+func redirectServer() *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/redirect/a":
+				// Relative to the current path.
+				w.Header().Set("Location", "b")
+				w.WriteHeader(http.StatusMovedPermanently)
+			case "/redirect/b":
+				w.Header().Set("Location", server.URL+"/redirect/c")
+				w.WriteHeader(http.StatusFound)
+			case "/redirect/c":
+				w.Header().Set("Location", "/redirect/d")
+				w.WriteHeader(http.StatusTemporaryRedirect)
+			default:
+				body, _ := ioutil.ReadAll(req.Body)
+				fmt.Fprintf(w, "%s %s %s", req.Method, req.URL.Path, body)
+			}
+		},
+	))
+	return server
+}
+
+func TestRedirects(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	server := redirectServer()
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	res, err := NewClient(tmpDir).Get(server.URL + "/redirect/a")
+	require.NoError(err)
+	res.Body.Close()
+	// 307 redirects must resend the body.
+	post := func(client *http.Client) (*http.Response, error) {
+		return client.Post(
+			server.URL+"/redirect/c", "text/plain", strings.NewReader("body"),
+		)
+	}
+	res, err = post(NewClient(tmpDir))
+	require.NoError(err)
+	res.Body.Close()
+	server.Close()
+
+	res, err = post(NewPlaybackOnlyClient(tmpDir))
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal("POST /redirect/d body", string(buf))
+	}
+
+	client := NewPlaybackOnlyClient(tmpDir)
+	var hops []string
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		loc, err := req.Response.Location()
+		if assert.NoError(err) {
+			assert.Equal(req.URL.String(), loc.String())
+		}
+		hops = append(hops, fmt.Sprintf(
+			"%d %s", req.Response.StatusCode, req.Response.Header.Get("Location"),
+		))
+		return nil
+	}
+	res, err = client.Get(server.URL + "/redirect/a")
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal("GET /redirect/d ", string(buf))
+	}
+	assert.Equal([]string{
+		"301 b",
+		"302 " + server.URL + "/redirect/c",
+		"307 /redirect/d",
+	}, hops)
+}
+
+// seekableBody is a request body that can be rewound by seeking, but that
+// http.NewRequest doesn't know how to set GetBody for.
+type seekableBody struct {
+	*strings.Reader
+}
+
+func (seekableBody) Close() error { return nil }
+
+func TestRedirectRequestBodies(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	server := redirectServer()
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	bodies := map[string]func() io.Reader{
+		"buffered": func() io.Reader { return bytes.NewBufferString("body") },
+		"streamed": func() io.Reader {
+			return io.MultiReader(strings.NewReader("bo"), strings.NewReader("dy"))
+		},
+		"seekable": func() io.Reader { return seekableBody{strings.NewReader("body")} },
+	}
+	post := func(client *http.Client, name string) string {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/redirect/c", bodies[name]())
+		require.NoError(err)
+		res, err := client.Do(req)
+		require.NoError(err, name)
+		buf, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		require.NoError(err)
+		return string(buf)
+	}
+	for name := range bodies {
+		assert.Equal("POST /redirect/d body", post(NewClient(tmpDir), name), name)
+	}
+	server.Close()
+	for name := range bodies {
+		assert.Equal("POST /redirect/d body", post(NewPlaybackOnlyClient(tmpDir), name), name)
+	}
+}
+
+// cancelingTransport returns a response, ignoring the context of the request,
+// and then cancels the context, as if it were cancelled while the response was
+// being saved.
+type cancelingTransport struct {
+	cancel context.CancelFunc
+}
+
+func (t *cancelingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	defer t.cancel()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("body")),
+		Request:    req,
+	}, nil
+}
+
+func TestContextCancellation(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "http", "example.com", "GET", "request.json")
+	require.NoError((&Recording{StatusCode: http.StatusOK, Body: []byte("recorded")}).Save(path))
+
+	get := func(ctx context.Context, rt http.RoundTripper) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/", nil)
+		require.NoError(err)
+		return rt.RoundTrip(req)
+	}
+	rt := &RoundTripper{Dir: tmpDir, Mode: ModePlaybackOnly}
+
+	// Cancelled before the recording is loaded.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = get(ctx, rt)
+	var replayErr *Error
+	assert.True(errors.As(err, &replayErr))
+	assert.True(errors.Is(err, context.Canceled))
+
+	// Cancelled while the body is being read.
+	ctx, cancel = context.WithCancel(context.Background())
+	res, err := get(ctx, rt)
+	require.NoError(err)
+	buf := make([]byte, 2)
+	_, err = res.Body.Read(buf)
+	require.NoError(err)
+	cancel()
+	_, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.True(errors.As(err, &replayErr))
+	assert.Equal(path, replayErr.Path)
+	assert.True(errors.Is(err, context.Canceled))
+
+	// Cancelled while the response is being saved.
+	ctx, cancel = context.WithCancel(context.Background())
+	rt = &RoundTripper{Dir: tmpDir, Mode: ModeRecordOnly, RoundTripper: &cancelingTransport{cancel}}
+	_, err = get(ctx, rt)
+	require.True(errors.As(err, &replayErr))
+	assert.Equal(path, replayErr.Path)
+	assert.True(errors.Is(err, context.Canceled))
+	rec, err := LoadRecording(path)
+	require.NoError(err)
+	assert.Equal("recorded", string(rec.Body))
+}
+
+func TestCollapseRedirects(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	server := redirectServer()
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	client := NewClient(tmpDir)
+	client.Transport.(*RoundTripper).CollapseRedirects = true
+	res, err := client.Get(server.URL + "/redirect/a")
+	require.NoError(err)
+	res.Body.Close()
+	server.Close()
+
+	res, err = NewPlaybackOnlyClient(tmpDir).Get(server.URL + "/redirect/a")
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal("GET /redirect/d ", string(buf))
+	}
+	var files []string
+	filepath.Walk(tmpDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	assert.Len(files, 1)
+}
+
+func TestCookieRewrite(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	gen := NewPathGenerator()
+	save := func(req *http.Request, rec *Recording) {
+		path, err := gen.RecordingPath(req)
+		require.NoError(err)
+		require.NoError(rec.Save(filepath.Join(tmpDir, path.Path())))
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://api.example.com/login", nil)
+	setCookie := "session=abc; Path=/; Domain=api.example.org; " +
+		"Expires=Wed, 21 Oct 2015 07:28:00 GMT; Secure; HttpOnly"
+	save(req, &Recording{
+		StatusCode: http.StatusOK,
+		Headers:    http.Header{"Set-Cookie": []string{setCookie}},
+	})
+	req, _ = http.NewRequest(http.MethodGet, "http://api.example.com/profile", nil)
+	req.Header.Set("Cookie", "session=abc")
+	save(req, &Recording{StatusCode: http.StatusOK, Body: []byte("logged in")})
+
+	client := NewPlaybackOnlyClient(tmpDir)
+	client.Jar, _ = cookiejar.New(nil)
+	client.Transport.(*RoundTripper).CookieRewrite = &CookieRewrite{
+		Domain:      "api.example.com",
+		StripExpiry: true,
+		StripSecure: true,
+	}
+	res, err := client.Get("http://api.example.com/login")
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal(
+		"session=abc; Path=/; Domain=api.example.com; HttpOnly",
+		res.Header.Get("Set-Cookie"),
+	)
+	res, err = client.Get("http://api.example.com/profile")
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal("logged in", string(buf))
+	}
+
+	rec, err := LoadRecording(filepath.Join(
+		tmpDir, "http", "api.example.com", "GET", "login", "request.json",
+	))
+	require.NoError(err)
+	assert.Equal(setCookie, rec.Headers.Get("Set-Cookie"))
+}
+
+func TestUnusedRecordings(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	rec := &Recording{StatusCode: http.StatusOK}
+	used := filepath.Join(tmpDir, "http", "example.com", "GET", "used", "request.json")
+	unused := filepath.Join(tmpDir, "http", "example.com", "GET", "unused", "request.json")
+	require.NoError(rec.Save(used))
+	require.NoError(rec.Save(unused))
+
+	client := NewPlaybackOnlyClient(tmpDir)
+	rt := client.Transport.(*RoundTripper)
+	rt.TrackUsage = true
+	// The query string results in a checksum, so this uses the generic path.
+	res, err := client.Get("http://example.com/used?a=b")
+	require.NoError(err)
+	res.Body.Close()
+
+	assert.Equal([]string{used}, rt.UsedRecordings())
+	paths, err := rt.UnusedRecordings()
+	require.NoError(err)
+	assert.Equal([]string{unused}, paths)
+}
+
+type fakeTB struct {
+	testing.TB
+	name     string
+	errors   []string
+	cleanups []func()
+}
+
+func (t *fakeTB) Name() string     { return t.name }
+func (t *fakeTB) Helper()          {}
+func (t *fakeTB) Cleanup(f func()) { t.cleanups = append(t.cleanups, f) }
+func (t *fakeTB) Errorf(f string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(f, args...))
+}
+func (t *fakeTB) Error(args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprint(args...))
+}
+
+func TestNewTestClient(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	tb := &fakeTB{TB: t, name: "TestFake/sub case"}
+	os.Unsetenv(ModeEnv)
+	assert.Equal(filepath.Join("testdata", "TestFake", "sub+case"),
+		NewTestClient(tb).Transport.(*RoundTripper).Dir)
+	client := NewTestClient(tb, WithDir(tmpDir))
+	rt := client.Transport.(*RoundTripper)
+	assert.Equal(ModePlaybackOnly, rt.Mode)
+	_, err = client.Get("http://example.com/missing?a=b")
+	assert.Error(err)
+	if assert.Len(tb.errors, 1) {
+		assert.Contains(tb.errors[0], "GET http://example.com/missing?a=b")
+		assert.Contains(tb.errors[0], filepath.Join(
+			tmpDir, "http", "example.com", "GET", "missing", "request.json",
+		))
+	}
+
+	rec := &Recording{StatusCode: http.StatusOK}
+	require.NoError(rec.Save(filepath.Join(
+		tmpDir, "http", "example.com", "GET", "found", "request.json",
+	)))
+	res, err := client.Get("http://example.com/found")
+	require.NoError(err)
+	res.Body.Close()
+	for _, f := range tb.cleanups {
+		f()
+	}
+	assert.Len(tb.errors, 1)
+}
+
+func TestModeFromEnv(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	const key = "REPLAY_TEST_MODE"
+	for value, expected := range map[string]Mode{
+		"":                  ModePlaybackOnly,
+		"replay":            ModePlaybackOnly,
+		"playback-only":     ModePlaybackOnly,
+		"auto":              ModeRecordIfMissing,
+		"Record-If-Missing": ModeRecordIfMissing,
+		"record":            ModeRecordOnly,
+		" record-only ":     ModeRecordOnly,
+		"verify":            ModeVerify,
+	} {
+		t.Setenv(key, value)
+		mode, err := ModeFromEnv(key)
+		require.NoError(err, value)
+		assert.Equal(expected, mode, value)
+	}
+	for _, value := range []string{"1", "true", "recording", "play"} {
+		t.Setenv(key, value)
+		_, err := ModeFromEnv(key)
+		assert.EqualError(err, fmt.Sprintf("replay: invalid %s %q", key, value))
+	}
+
+	t.Setenv(ModeEnv, "")
+	client := NewClientFromEnv("testdata")
+	assert.Equal(ModePlaybackOnly, client.Transport.(*RoundTripper).Mode)
+	t.Setenv(ModeEnv, "auto")
+	client = NewClientFromEnv("testdata")
+	assert.Equal(ModeRecordIfMissing, client.Transport.(*RoundTripper).Mode)
+	t.Setenv(ModeEnv, "yes")
+	assert.Panics(func() { NewClientFromEnv("testdata") })
+}
+
+func TestParseMode(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	for _, mode := range []Mode{ModeRecordIfMissing, ModePlaybackOnly, ModeRecordOnly, ModeVerify} {
+		parsed, err := ParseMode(mode.String())
+		require.NoError(err)
+		assert.Equal(mode, parsed)
+	}
+	assert.Equal("playback-only", ModePlaybackOnly.String())
+	assert.Equal("Mode(7)", Mode(7).String())
+	mode, err := ParseMode("Auto")
+	require.NoError(err)
+	assert.Equal(ModeRecordIfMissing, mode)
+	_, err = ParseMode("Mode(7)")
+	assert.EqualError(err, `replay: invalid mode "Mode(7)"`)
+
+	for _, mode := range []Mode{-1, 7} {
+		client := &http.Client{Transport: &RoundTripper{Dir: "testdata", Mode: mode}}
+		_, err = client.Get("http://example.com/")
+		var replayErr *Error
+		require.True(errors.As(err, &replayErr))
+		assert.EqualError(replayErr, fmt.Sprintf("replay: invalid Mode %d", mode))
+	}
+}
+
+func TestVerifyAllUsed(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	rec := &Recording{StatusCode: http.StatusOK}
+	unused := filepath.Join(tmpDir, "http", "example.com", "GET", "b", "request.json")
+	require.NoError(rec.Save(filepath.Join(
+		tmpDir, "http", "example.com", "GET", "a", "request.json",
+	)))
+	require.NoError(rec.Save(unused))
+
+	tb := &fakeTB{TB: t, name: "TestVerify"}
+	client := NewTestClient(tb, WithDir(tmpDir), WithVerifyAllUsed())
+	res, err := client.Get("http://example.com/a")
+	require.NoError(err)
+	res.Body.Close()
+	err = client.Transport.(*RoundTripper).VerifyAllUsed()
+	if assert.Error(err) {
+		assert.Contains(err.Error(), unused)
+	}
+	for _, f := range tb.cleanups {
+		f()
+	}
+	if assert.Len(tb.errors, 1) {
+		assert.Contains(tb.errors[0], unused)
+	}
+
+	rt := NewPlaybackOnlyClient(filepath.Join(tmpDir, "none")).Transport.(*RoundTripper)
+	assert.Error(rt.VerifyAllUsed())
+	rt.TrackUsage = true
+	assert.NoError(rt.VerifyAllUsed())
+}
+
+func TestPreserveTrailingSlash(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, req.URL.Path)
+		},
+	))
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	client := NewClient(tmpDir)
+	client.Transport.(*RoundTripper).PreserveTrailingSlash = true
+	for _, path := range []string{"/items", "/items/", "/"} {
+		res, err := client.Get(server.URL + path)
+		require.NoError(err)
+		res.Body.Close()
+	}
+	server.Close()
+
+	for _, path := range []string{"/items", "/items/", "/"} {
+		res, err := client.Get(server.URL + path)
+		if assert.NoError(err) {
+			buf, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			assert.Equal(path, string(buf))
+		}
+	}
+
+	gen := NewPathGenerator()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/items/", nil)
+	path, err := gen.RecordingPath(req)
+	require.NoError(err)
+	assert.Equal(filepath.Join("http", "example.com", "GET", "items", "request.json"), path.Path())
+}
+
+func TestFormatVersion(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	v1 := filepath.Join(tmpDir, "v1", "request.json")
+	require.NoError(os.MkdirAll(filepath.Dir(v1), 0755))
+	require.NoError(ioutil.WriteFile(v1, []byte("{\"status_code\": 200}\nbody"), 0644))
+	rec, err := LoadRecording(v1)
+	require.NoError(err)
+	assert.Equal(0, rec.FormatVersion)
+	assert.Equal("body", string(rec.Body))
+
+	future := filepath.Join(tmpDir, "future", "request.json")
+	require.NoError(os.MkdirAll(filepath.Dir(future), 0755))
+	require.NoError(ioutil.WriteFile(future, []byte(fmt.Sprintf(
+		"{\"format_version\": %d, \"status_code\": 200}\n", FormatVersion+1,
+	)), 0644))
+	_, err = LoadRecording(future)
+	assert.True(errors.Is(err, ErrUnsupportedVersion))
+	var versionErr *FormatVersionError
+	if assert.True(errors.As(err, &versionErr)) {
+		assert.Equal(future, versionErr.Path)
+		assert.Equal(FormatVersion+1, versionErr.Version)
+	}
+	require.NoError(os.Remove(future))
+
+	n, err := MigrateDir(tmpDir)
+	require.NoError(err)
+	assert.Equal(1, n)
+	rec, err = LoadRecording(v1)
+	require.NoError(err)
+	assert.Equal(FormatVersion, rec.FormatVersion)
+	assert.Equal("body", string(rec.Body))
+	n, err = MigrateDir(tmpDir)
+	require.NoError(err)
+	assert.Equal(0, n)
+}
+
+func TestLoadRecordingStream(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "http", "example.com", "GET", "large", "request.json")
+	body := bytes.Repeat([]byte("0123456789"), 100000)
+	rec := &Recording{StatusCode: http.StatusOK, Body: body}
+	require.NoError(rec.Save(path))
+
+	rec, r, err := LoadRecordingStream(path)
+	require.NoError(err)
+	assert.Nil(rec.Body)
+	buf, err := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(body, buf)
+	assert.NoError(r.Close())
+
+	res, err := NewPlaybackOnlyClient(tmpDir).Get("http://example.com/large?a=b")
+	require.NoError(err)
+	assert.Equal(int64(len(body)), res.ContentLength)
+	buf, err = ioutil.ReadAll(res.Body)
+	assert.NoError(err)
+	assert.Equal(body, buf)
+	assert.NoError(res.Body.Close())
+	// Closing the body closes the file.
+	assert.Error(res.Body.Close())
+}
+
+func TestStreamRecord(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Trailer", "X-Checksum")
+			fmt.Fprintln(w, "first")
+			w.(http.Flusher).Flush()
+			if req.URL.Path == "/stream" {
+				<-release
+			}
+			fmt.Fprintln(w, "second")
+			w.Header().Set("X-Checksum", "abc")
+		},
+	))
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	client := NewClient(tmpDir)
+	client.Transport.(*RoundTripper).StreamRecord = true
+	res, err := client.Get(server.URL + "/stream")
+	require.NoError(err)
+	// The first line is available before the server finishes the response.
+	r := bufio.NewReader(res.Body)
+	line, err := r.ReadString('\n')
+	require.NoError(err)
+	assert.Equal("first\n", line)
+	close(release)
+	rest, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal("second\n", string(rest))
+	require.NoError(res.Body.Close())
+
+	// An abandoned body isn't recorded.
+	res, err = client.Get(server.URL + "/abandoned")
+	require.NoError(err)
+	require.NoError(res.Body.Close())
+	server.Close()
+
+	res, err = client.Get(server.URL + "/stream")
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal("first\nsecond\n", string(buf))
+		assert.Equal("abc", res.Trailer.Get("X-Checksum"))
+	}
+	_, err = NewPlaybackOnlyClient(tmpDir).Get(server.URL + "/abandoned")
+	assert.True(errors.Is(err, ErrRecordingNotFound))
+
+	// A body that is read completely is recorded, even if EOF isn't seen
+	// before it is closed.
+	const body = `{"a":1}`
+	client.Transport.(*RoundTripper).RoundTripper = roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"Content-Type": {"application/json"}},
+				Body:          ioutil.NopCloser(strings.NewReader(body)),
+				ContentLength: int64(len(body)),
+				Request:       req,
+			}, nil
+		},
+	)
+	res, err = client.Get("http://example.com/decoded")
+	require.NoError(err)
+	var v struct{ A int }
+	require.NoError(json.NewDecoder(res.Body).Decode(&v))
+	require.NoError(res.Body.Close())
+	assert.Equal(1, v.A)
+	res, err = NewPlaybackOnlyClient(tmpDir).Get("http://example.com/decoded")
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(body, string(buf))
+	}
+}
+
+func TestFileName(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	gen := NewPathGenerator()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/list?page=2", nil)
+	path, err := gen.RecordingPath(req)
+	require.NoError(err)
+	crc, err := gen.RequestCRC(req)
+	require.NoError(err)
+	dir := filepath.Join("http", "example.com", "GET", "list")
+	assert.Equal(filepath.Join(dir, "request."+crc+".json"), path.Path())
+	assert.Equal(filepath.Join(dir, "request.json"), path.GenericPath())
+	assert.Equal(filepath.Join(dir, "list-empty.json"), path.NamedPath("list-empty.json"))
+
+	client := NewClient(tmpDir)
+	rt := client.Transport.(*RoundTripper)
+	rt.Mode = ModePlaybackOnly
+	rt.FileName = func(req *http.Request, checksum string) string {
+		if checksum == "" {
+			return "list.json"
+		}
+		return "list-page" + req.URL.Query().Get("page") + ".json"
+	}
+	rec := &Recording{StatusCode: http.StatusOK, Body: []byte("page 2")}
+	require.NoError(rec.Save(filepath.Join(tmpDir, dir, "list-page2.json")))
+	rec = &Recording{StatusCode: http.StatusOK, Body: []byte("generic")}
+	require.NoError(rec.Save(filepath.Join(tmpDir, dir, "list.json")))
+
+	for query, body := range map[string]string{"?page=2": "page 2", "?page=3": "generic"} {
+		res, err := client.Get("http://example.com/list" + query)
+		if assert.NoError(err) {
+			buf, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			assert.Equal(body, string(buf))
+		}
+	}
+}
+
+func TestPathTemplate(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, req.URL.Path)
+		},
+	))
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	gen := NewPathGenerator()
+	gen.PathTemplate = func(req *http.Request) []string {
+		path := strings.Replace(strings.Trim(req.URL.Path, "/"), "/", "-", -1)
+		return []string{req.URL.Host, req.Method + "-" + path, ".."}
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com:80/a/b", nil)
+	path, err := gen.RecordingPath(req)
+	require.NoError(err)
+	assert.Equal(
+		filepath.Join("example.com%3A80", "GET-a-b", "%2E%2E", "request.json"),
+		path.Path(),
+	)
+
+	client := NewClient(tmpDir)
+	client.Transport.(*RoundTripper).PathGenerator = gen
+	res, err := client.Get(server.URL + "/a/b")
+	require.NoError(err)
+	res.Body.Close()
+	server.Close()
+	res, err = client.Get(server.URL + "/a/b")
+	if assert.NoError(err) {
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal("/a/b", string(buf))
+	}
+}
+
+func TestMaxPathLength(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	gen := NewPathGenerator()
+	gen.MaxComponentLength = 100
+	gen.MaxPathLength = 120
+
+	token := strings.Repeat("a", 150) + ":" + strings.Repeat("b", 149)
+	req, _ := http.NewRequest(
+		http.MethodGet, "http://example.com/tokens/"+token+"/details?x=y", nil,
+	)
+	path, err := gen.RecordingPath(req)
+	require.NoError(err)
+	assert.True(len(path.Path()) <= 120, path.Path())
+	for _, part := range strings.Split(path.Path(), string(os.PathSeparator)) {
+		assert.True(len(part) <= 100, part)
+	}
+	again, err := gen.RecordingPath(req)
+	require.NoError(err)
+	assert.Equal(path.Path(), again.Path())
+	assert.Equal(path.GenericPath(), again.GenericPath())
+
+	other, _ := http.NewRequest(
+		http.MethodGet, "http://example.com/tokens/"+token+"c/details?x=y", nil,
+	)
+	otherPath, err := gen.RecordingPath(other)
+	require.NoError(err)
+	assert.NotEqual(path.Path(), otherPath.Path())
+
+	gen.MaxPathLength = 10
+	_, err = gen.RecordingPath(req)
+	assert.Error(err)
+}
+
+func TestQueryInPath(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	gen := NewPathGenerator()
+	gen.QueryInPath = true
+	gen.OmitQuery = NewStringSet("nonce")
+	dir := filepath.Join("http", "example.com", "GET", "search")
+
+	req, _ := http.NewRequest(
+		http.MethodGet, "http://example.com/search?q=foo+bar&page=2&nonce=1", nil,
+	)
+	path, err := gen.RecordingPath(req)
+	require.NoError(err)
+	assert.Equal(filepath.Join(dir, "page=2&q=foo+bar", "request.json"), path.Path())
+
+	req.URL.RawQuery = "nonce=1"
+	path, err = gen.RecordingPath(req)
+	require.NoError(err)
+	assert.Equal(filepath.Join(dir, "request.json"), path.Path())
+
+	req.URL.RawQuery = "q=" + strings.Repeat("x", 300)
+	path, err = gen.RecordingPath(req)
+	require.NoError(err)
+	assert.Equal(dir, filepath.Dir(path.Path()))
+	assert.NotEqual(filepath.Join(dir, "request.json"), path.Path())
+}
+
+func TestOmitResponseHeaders(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Cf-Ray", "123")
+			w.Header().Set("X-Keep", "kept")
+			w.Header().Set("X-Secret", "secret")
+			fmt.Fprint(w, "body")
+		},
+	))
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	client := NewClient(tmpDir)
+	rt := client.Transport.(*RoundTripper)
+	rt.OmitResponseHeaders = DefaultOmitResponseHeaders()
+	rt.FilterResponse = func(rec *Recording) {
+		rec.Headers.Set("X-Secret", "redacted")
+	}
+	res, err := client.Get(server.URL + "/filter")
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal("123", res.Header.Get("Cf-Ray"))
+	assert.NotEmpty(res.Header.Get("Date"))
+	assert.Equal("secret", res.Header.Get("X-Secret"))
+	server.Close()
+
+	res, err = client.Get(server.URL + "/filter")
+	if assert.NoError(err) {
+		res.Body.Close()
+		assert.Empty(res.Header.Get("Cf-Ray"))
+		assert.Empty(res.Header.Get("Date"))
+		assert.Equal("kept", res.Header.Get("X-Keep"))
+		assert.Equal("redacted", res.Header.Get("X-Secret"))
+	}
+}
+
+func TestRewriteRequest(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	newServer := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				fmt.Fprintf(w, "%s %s", req.Host, body)
+			},
+		))
+	}
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	client := NewClient(tmpDir)
+	rt := client.Transport.(*RoundTripper)
+	rt.RewriteRequest = func(req *http.Request) *http.Request {
+		req.URL.Host = "api.example.com"
+		return req
+	}
+	server := newServer()
+	res, err := client.Post(server.URL+"/rewrite", "text/plain",
+		ioutil.NopCloser(strings.NewReader("data")))
+	require.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(err)
+	assert.Equal(server.Listener.Addr().String()+" data", string(body))
+	server.Close()
+
+	matches, err := filepath.Glob(
+		filepath.Join(tmpDir, "http", "api.example.com", "POST", "rewrite", "*.json"))
+	require.NoError(err)
+	assert.Len(matches, 1)
+
+	server = newServer()
+	defer server.Close()
+	rt.Mode = ModePlaybackOnly
+	res, err = client.Post(server.URL+"/rewrite", "text/plain", strings.NewReader("data"))
+	require.NoError(err)
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(err)
+	assert.True(strings.HasSuffix(string(body), " data"))
+	assert.NotContains(string(body), server.Listener.Addr().String())
+}
+
+func TestHostAliases(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	gen := NewPathGenerator()
+	gen.HostAliases = map[string]string{
+		"api-eu.example.com":       "api.example.com",
+		"staging.example.com:8443": "api.example.com",
+	}
+	paths := NewStringSet()
+	for _, rawurl := range []string{
+		"https://api.example.com/items?q=1",
+		"https://api-eu.example.com/items?q=1",
+		"https://staging.example.com:8443/items?q=1",
+	} {
+		req, err := http.NewRequest("GET", rawurl, nil)
+		require.NoError(err)
+		req.Header["Host"] = []string{req.URL.Host}
+		path, err := gen.RecordingPath(req)
+		require.NoError(err)
+		assert.Equal(filepath.Join("https", "api.example.com", "GET", "items"),
+			filepath.Dir(path.Path()))
+		paths.Add(path.Path())
+		assert.Equal([]string{req.URL.Host}, req.Header["Host"])
+	}
+	assert.Len(paths, 1)
+
+	req, err := http.NewRequest("GET", "https://other.example.com/items", nil)
+	require.NoError(err)
+	path, err := gen.RecordingPath(req)
+	require.NoError(err)
+	assert.Equal(filepath.Join("https", "other.example.com", "GET", "items"),
+		filepath.Dir(path.Path()))
+}
+
+func TestIgnorePort(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	for host, expected := range map[string]string{
+		"example.com":      "example.com",
+		"example.com:8080": "example.com",
+		"127.0.0.1:54321":  "127.0.0.1",
+		"[::1]:8080":       "[::1]",
+		"[::1]":            "[::1]",
+		"::1":              "::1",
+	} {
+		assert.Equal(expected, stripPort(host), host)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "recorded")
+	})
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	client := NewClient(tmpDir)
+	rt := client.Transport.(*RoundTripper)
+	rt.IgnorePort = true
+	server := httptest.NewServer(handler)
+	res, err := client.Get(server.URL + "/port")
+	require.NoError(err)
+	res.Body.Close()
+	server.Close()
+	_, err = os.Stat(filepath.Join(tmpDir, "http", "127.0.0.1", "GET", "port", "request.json"))
+	assert.NoError(err)
+
+	server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, "live")
+		},
+	))
+	defer server.Close()
+	rt.Mode = ModePlaybackOnly
+	res, err = client.Get(server.URL + "/port")
+	require.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(err)
+	assert.Equal("recorded", string(body))
+}
+
+func TestIgnoreScheme(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, "secure")
+		},
+	))
+	defer server.Close()
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	rt := &RoundTripper{
+		RoundTripper:  server.Client().Transport,
+		Dir:           tmpDir,
+		PathGenerator: NewPathGenerator(),
+	}
+	rt.IgnoreScheme = true
+	client := &http.Client{Transport: rt}
+	res, err := client.Get(server.URL + "/scheme")
+	require.NoError(err)
+	res.Body.Close()
+	host := url.QueryEscape(server.Listener.Addr().String())
+	_, err = os.Stat(filepath.Join(tmpDir, host, "GET", "scheme", "request.json"))
+	assert.NoError(err)
+
+	rt.Mode = ModePlaybackOnly
+	res, err = client.Get("http://" + server.Listener.Addr().String() + "/scheme")
+	require.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(err)
+	assert.Equal("secure", string(body))
+	assert.Nil(res.TLS)
+}
+
+func TestCacheRecordings(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	count := 0
+	rt := &RoundTripper{
+		RoundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			count++
+			rec := &Recording{StatusCode: 200, Body: []byte(fmt.Sprint("body ", count))}
+			return rec.Response(), nil
+		}),
+		Dir:             tmpDir,
+		PathGenerator:   NewPathGenerator(),
+		CacheRecordings: true,
+		CacheSize:       10,
+	}
+	client := &http.Client{Transport: rt}
+	get := func(rawurl string) string {
+		res, err := client.Get(rawurl)
+		require.NoError(err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		return string(body)
+	}
+	assert.Equal("body 1", get("http://example.com/a"))
+	path := filepath.Join(tmpDir, "http", "example.com", "GET", "a", "request.json")
+	rec := &Recording{
+		StatusCode: 200,
+		Headers:    http.Header{"Content-Type": {"text/plain"}},
+		Body:       []byte("edited"),
+	}
+	require.NoError(rec.Save(path))
+	// The recording isn't cached until it has been played back.
+	assert.Equal("edited", get("http://example.com/a"))
+	require.NoError((&Recording{StatusCode: 200, Body: []byte("ignored")}).Save(path))
+	res, err := client.Get("http://example.com/a")
+	require.NoError(err)
+	res.Header.Set("X-Modified", "true")
+	res2, err := client.Get("http://example.com/a")
+	require.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(err)
+	body2, err := ioutil.ReadAll(res2.Body)
+	require.NoError(err)
+	res.Body.Close()
+	res2.Body.Close()
+	assert.Equal("edited", string(body))
+	assert.Equal("edited", string(body2))
+	assert.Empty(res2.Header.Get("X-Modified"))
+
+	// Recording again replaces the cached recording.
+	rt.Mode = ModeRecordOnly
+	assert.Equal("body 2", get("http://example.com/a"))
+	rt.Mode = ModeRecordIfMissing
+	assert.Equal("body 2", get("http://example.com/a"))
+
+	// Adding a recording that doesn't fit in the cache evicts the first.
+	assert.Equal("body 3", get("http://example.com/b"))
+	assert.Equal("body 3", get("http://example.com/b"))
+	require.NoError((&Recording{StatusCode: 200, Body: []byte("new")}).Save(path))
+	assert.Equal("new", get("http://example.com/a"))
+}
+
+func BenchmarkPlayback(b *testing.B) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	req, err := http.NewRequest("GET", "http://example.com/bench", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	rec := &Recording{
+		StatusCode: 200,
+		Headers:    http.Header{"Content-Type": {"application/json"}},
+		Body:       bytes.Repeat([]byte(`{"key": "value"}`), 1024),
+	}
+	path := filepath.Join(tmpDir, "http", "example.com", "GET", "bench", "request.json")
+	if err = rec.Save(path); err != nil {
+		b.Fatal(err)
+	}
+	for _, cache := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cache=%t", cache), func(b *testing.B) {
+			rt := &RoundTripper{
+				Dir:             tmpDir,
+				Mode:            ModePlaybackOnly,
+				PathGenerator:   NewPathGenerator(),
+				CacheRecordings: cache,
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				res, err := rt.RoundTrip(req)
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(ioutil.Discard, res.Body)
+				res.Body.Close()
+			}
+		})
+	}
+}
+
+// requestCRCCases are requests with the checksums produced for them, which must
+// not change, or existing recordings won't be found.
+var requestCRCCases = []struct {
+	name     string
+	gen      func() *PathGenerator
+	req      func() *http.Request
+	checksum string
+}{
+	{
+		name: "no content",
+		gen:  NewPathGenerator,
+		req: func() *http.Request {
+			req, _ := http.NewRequest("GET", "http://example.com/a", nil)
+			return req
+		},
+		checksum: "",
+	},
+	{
+		name: "query and headers",
+		gen:  NewPathGenerator,
+		req: func() *http.Request {
+			req, _ := http.NewRequest("GET", "http://example.com/a?b=2&a=1&a=3", nil)
+			req.Header.Set("X-Api-Key", "key")
+			req.Header.Set("Accept", "application/json")
+			req.Header.Set("Authorization", "omitted")
+			req.Header["x-lower"] = []string{"lower"}
+			return req
+		},
+		checksum: "822553210",
+	},
+	{
+		name: "exact names",
+		gen: func() *PathGenerator {
+			gen := NewPathGenerator()
+			gen.ExactNames = true
+			return gen
+		},
+		req: func() *http.Request {
+			req, _ := http.NewRequest("GET", "http://example.com/a?B=2", nil)
+			req.Header["x-lower"] = []string{"lower"}
+			return req
+		},
+		checksum: "3226424977",
+	},
+	{
+		name: "stream body",
+		gen:  NewPathGenerator,
+		req: func() *http.Request {
+			req, _ := http.NewRequest("POST", "http://example.com/a",
+				ioutil.NopCloser(strings.NewReader(strings.Repeat("body", 1000))))
+			return req
+		},
+		checksum: "1231668405",
+	},
+	{
+		name: "seekable body",
+		gen:  NewPathGenerator,
+		req: func() *http.Request {
+			req, _ := http.NewRequest("POST", "http://example.com/a", nil)
+			req.Body = struct {
+				io.ReadSeeker
+				io.Closer
+			}{strings.NewReader("body"), ioutil.NopCloser(nil)}
+			return req
+		},
+		checksum: "3685223346",
+	},
+	{
+		name: "form body",
+		gen: func() *PathGenerator {
+			gen := NewPathGenerator()
+			gen.OmitFormParams = NewStringSet("nonce")
+			return gen
+		},
+		req: func() *http.Request {
+			req, _ := http.NewRequest("POST", "http://example.com/a",
+				strings.NewReader("b=2&nonce=123&a=1"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return req
+		},
+		checksum: "4188849682",
+	},
+	{
+		name: "munged body",
+		gen: func() *PathGenerator {
+			gen := NewPathGenerator()
+			gen.MungeRequestBody = func(req *http.Request, r io.Reader) io.Reader {
+				return io.LimitReader(r, 2)
+			}
+			return gen
+		},
+		req: func() *http.Request {
+			req, _ := http.NewRequest("POST", "http://example.com/a",
+				ioutil.NopCloser(strings.NewReader("body")))
+			return req
+		},
+		checksum: "3407832851",
+	},
+	{
+		name: "sha256",
+		gen: func() *PathGenerator {
+			gen := NewPathGenerator()
+			gen.Hash = sha256.New
+			gen.HashLength = 16
+			return gen
+		},
+		req: func() *http.Request {
+			req, _ := http.NewRequest("PUT", "http://example.com/a?q=1",
+				bytes.NewReader([]byte("body")))
+			return req
+		},
+		checksum: "3fbcdab109625e9c",
+	},
+}
+
+func TestRequestCRCGolden(t *testing.T) {
+	for _, c := range requestCRCCases {
+		t.Run(c.name, func(t *testing.T) {
+			require, assert := require.New(t), assert.New(t)
+			req := c.req()
+			var body []byte
+			if req.Body != nil {
+				var err error
+				body, err = ioutil.ReadAll(c.req().Body)
+				require.NoError(err)
+			}
+			sum, err := c.gen().RequestCRC(req)
+			require.NoError(err)
+			assert.Equal(c.checksum, sum)
+			if req.Body != nil {
+				sent, err := ioutil.ReadAll(req.Body)
+				require.NoError(err)
+				assert.Equal(string(body), string(sent))
+			}
+		})
+	}
+}
+
+func BenchmarkRequestCRC(b *testing.B) {
+	gen := NewPathGenerator()
+	for _, size := range []int{0, 1 << 10, 1 << 20} {
+		body := bytes.Repeat([]byte("x"), size)
+		b.Run(fmt.Sprintf("body=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				req, _ := http.NewRequest("POST", "http://example.com/a?b=2&a=1", nil)
+				req.Header.Set("Accept", "application/json")
+				req.Header.Set("Content-Type", "text/plain")
+				req.Header.Set("X-Api-Key", "key")
+				if size > 0 {
+					req.Body = ioutil.NopCloser(bytes.NewReader(body))
+				}
+				if _, err := gen.RequestCRC(req); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSubdirFunc(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tb := &fakeTB{TB: t, name: "TestFake/a:b*c?/d e"}
+	assert.Equal(filepath.Join("base", "TestFake", "a%3Ab%2Ac%3F", "d+e"),
+		DirForTest("base", tb))
+
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	rt := &RoundTripper{
+		RoundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return (&Recording{StatusCode: http.StatusOK}).Response(), nil
+		}),
+		Dir:           tmpDir,
+		PathGenerator: NewPathGenerator(),
+		SubdirFunc: func(req *http.Request) string {
+			return DirForTest("", &fakeTB{TB: t, name: req.Header.Get("X-Test")})
+		},
+	}
+	for _, name := range []string{"TestA", "TestB/sub"} {
+		req, err := http.NewRequest("GET", "http://example.com/shared", nil)
+		require.NoError(err)
+		req.Header.Set("X-Test", name)
+		res, err := rt.RoundTrip(req)
+		require.NoError(err)
+		res.Body.Close()
+	}
+	for _, dir := range []string{"TestA", filepath.Join("TestB", "sub")} {
+		_, err = os.Stat(filepath.Join(
+			tmpDir, dir, "http", "example.com", "GET", "shared",
+		))
+		assert.NoError(err)
+	}
+}
+
+func TestReplayedResponseRequest(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	// Hand-written recordings, without content lengths.
+	recs := map[string]*Recording{
+		filepath.Join("http", "example.com", "GET", "items", "page", "1", "request.json"): {
+			StatusCode: http.StatusFound,
+			Headers:    http.Header{"Location": {"../first"}},
+		},
+		filepath.Join("http", "example.com", "GET", "items", "first", "request.json"): {
+			StatusCode: http.StatusOK,
+			Headers:    http.Header{"Link": {`<?page=2>; rel="next"`}},
+			Body:       []byte("first page"),
+		},
+	}
+	for path, rec := range recs {
+		require.NoError(rec.Save(filepath.Join(tmpDir, path)))
+	}
+
+	client := NewPlaybackOnlyClient(tmpDir)
+	res, err := client.Get("http://example.com/items/page/1")
+	require.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(err)
+	assert.Equal("first page", string(body))
+	assert.Equal(int64(len(body)), res.ContentLength)
+	require.NotNil(res.Request)
+	assert.Equal("http://example.com/items/first", res.Request.URL.String())
+	link := strings.TrimSuffix(strings.TrimPrefix(
+		res.Header.Get("Link"), "<"), `>; rel="next"`)
+	next, err := res.Request.URL.Parse(link)
+	require.NoError(err)
+	assert.Equal("http://example.com/items/first?page=2", next.String())
+}
+
+func TestErrRecordingNotFound(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	for _, strict := range []bool{false, true} {
+		client := NewPlaybackOnlyClient(tmpDir)
+		client.Transport.(*RoundTripper).StrictPath = strict
+		_, err = client.Get("http://example.com/missing?q=1")
+		require.Error(err)
+		assert.True(errors.Is(err, ErrRecordingNotFound))
+		assert.True(errors.Is(err, fs.ErrNotExist))
+		var replayErr *Error
+		if assert.True(errors.As(err, &replayErr)) {
+			assert.Equal("/missing", replayErr.Request.URL.Path)
+		}
+		var pathErr *fs.PathError
+		assert.True(errors.As(err, &pathErr))
+
+		var notFound *NotFoundError
+		if assert.True(errors.As(err, &notFound)) {
+			dir := filepath.Join(tmpDir, "http", "example.com", "GET", "missing")
+			paths := []string{filepath.Join(dir, "request."+notFound.Checksum+".json")}
+			if !strict {
+				paths = append(paths, filepath.Join(dir, "request.json"))
+			}
+			assert.NotEmpty(notFound.Checksum)
+			assert.Equal(paths, notFound.Paths)
+			assert.Equal("GET", notFound.Method)
+			assert.Equal("http://example.com/missing?q=1", notFound.URL)
+			assert.Contains(err.Error(), "GET http://example.com/missing?q=1")
+			assert.Contains(err.Error(), strings.Join(paths, ", "))
+			assert.Contains(err.Error(), "checksum "+notFound.Checksum)
+		}
+	}
+
+	path := filepath.Join(tmpDir, "http", "example.com", "GET", "corrupt", "request.json")
+	require.NoError(os.MkdirAll(filepath.Dir(path), os.ModePerm))
+	require.NoError(ioutil.WriteFile(path, []byte("{"), 0644))
+	_, err = NewPlaybackOnlyClient(tmpDir).Get("http://example.com/corrupt")
+	require.Error(err)
+	assert.False(errors.Is(err, ErrRecordingNotFound))
+	var replayErr *Error
+	assert.True(errors.As(err, &replayErr))
+}
+
+func TestMissingHandler(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	tb := &fakeTB{TB: t, name: "TestFake"}
+	client := NewTestClient(tb, WithDir(tmpDir), WithMode(ModePlaybackOnly))
+	client.Transport.(*RoundTripper).MissingHandler = MissingRecordingResponse
+	res, err := client.Get("http://example.com/missing")
+	require.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(err)
+	require.NoError(res.Body.Close())
+	assert.Equal(StatusRecordingNotFound, res.StatusCode)
+	assert.Equal("599 Recording Not Found", res.Status)
+	assert.Equal("text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(int64(len(body)), res.ContentLength)
+	assert.Contains(string(body), filepath.Join(
+		tmpDir, "http", "example.com", "GET", "missing", "request.json"))
+	assert.Equal("/missing", res.Request.URL.Path)
+	assert.Empty(tb.errors)
+
+	client.Transport.(*RoundTripper).MissingHandler = func(
+		req *http.Request, err *NotFoundError,
+	) (*http.Response, error) {
+		return nil, errors.New("custom")
+	}
+	_, err = client.Get("http://example.com/missing")
+	assert.EqualError(err.(*url.Error).Err, "custom")
+}
+
+func TestDirs(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	local, shared := filepath.Join(tmpDir, "local"), filepath.Join(tmpDir, "shared")
+
+	gen := NewPathGenerator()
+	req, err := http.NewRequest("GET", "http://example.com/a?q=1", nil)
+	require.NoError(err)
+	path, err := gen.RecordingPath(req)
+	require.NoError(err)
+	save := func(path, body string) {
+		rec := &Recording{StatusCode: http.StatusOK, Body: []byte(body)}
+		require.NoError(rec.Save(path))
+	}
+	save(filepath.Join(shared, path.Path()), "shared")
+	save(filepath.Join(local, path.GenericPath()), "local generic")
+	save(filepath.Join(shared, "http", "example.com", "GET", "b", "request.json"), "shared b")
+
+	count := 0
+	rt := &RoundTripper{
+		RoundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			count++
+			return (&Recording{StatusCode: http.StatusOK, Body: []byte("live")}).Response(), nil
+		}),
+		Dirs:          []string{local, shared},
+		PathGenerator: gen,
+	}
+	client := &http.Client{Transport: rt}
+	get := func(rawurl string) (string, error) {
+		res, err := client.Get(rawurl)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+	body, err := get("http://example.com/a?q=1")
+	require.NoError(err)
+	assert.Equal("local generic", body)
+	rt.StrictPath = true
+	body, err = get("http://example.com/a?q=1")
+	require.NoError(err)
+	assert.Equal("shared", body)
+	body, err = get("http://example.com/b")
+	require.NoError(err)
+	assert.Equal("shared b", body)
+	assert.Equal(0, count)
+
+	body, err = get("http://example.com/c")
+	require.NoError(err)
+	assert.Equal("live", body)
+	_, err = os.Stat(filepath.Join(local, "http", "example.com", "GET", "c", "request.json"))
+	assert.NoError(err)
+
+	rt.Mode = ModePlaybackOnly
+	rt.StrictPath = false
+	_, err = get("http://example.com/d?q=1")
+	var notFound *NotFoundError
+	if assert.True(errors.As(err, &notFound)) {
+		assert.Len(notFound.Paths, 4)
+		assert.True(strings.HasPrefix(notFound.Paths[1], local))
+		assert.True(strings.HasPrefix(notFound.Paths[2], shared))
+	}
+}
+
+func TestOverlayClient(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	base, overlay := filepath.Join(tmpDir, "base"), filepath.Join(tmpDir, "overlay")
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, "live")
+		},
+	))
+	defer server.Close()
+
+	host := url.QueryEscape(server.Listener.Addr().String())
+	recPath := func(dir, name string) string {
+		return filepath.Join(dir, "http", host, "GET", name, "request.json")
+	}
+	for path, body := range map[string]string{
+		recPath(base, "shadowed"):    "base",
+		recPath(overlay, "shadowed"): "overlay",
+		recPath(base, "shared"):      "base",
+	} {
+		require.NoError((&Recording{StatusCode: http.StatusOK, Body: []byte(body)}).Save(path))
+	}
+	get := func(client *http.Client, name string) string {
+		res, err := client.Get(server.URL + "/" + name)
+		require.NoError(err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		return string(body)
+	}
+
+	client := NewOverlayClient(base, overlay)
+	rt := client.Transport.(*RoundTripper)
+	assert.Equal(base, rt.BaseDir)
+	assert.Equal(overlay, rt.OverlayDir)
+	assert.Equal("overlay", get(client, "shadowed"))
+	assert.Equal("base", get(client, "shared"))
+	assert.Equal("live", get(client, "new"))
+	_, err = os.Stat(recPath(overlay, "new"))
+	assert.NoError(err)
+	_, err = os.Stat(recPath(base, "new"))
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(recPath(overlay, "shared"))
+	assert.True(os.IsNotExist(err))
+
+	client.Transport.(*RoundTripper).Mode = ModeRecordOnly
+	assert.Equal("live", get(client, "shared"))
+	rec, err := LoadRecording(recPath(base, "shared"))
+	require.NoError(err)
+	assert.Equal("base", string(rec.Body))
+	rec, err = LoadRecording(recPath(overlay, "shared"))
+	require.NoError(err)
+	assert.Equal("live", string(rec.Body))
+
+	// The layers can be combined with Dir, which is searched between them,
+	// and BaseDir is never written to, even without an OverlayDir.
+	middle := filepath.Join(tmpDir, "middle")
+	require.NoError((&Recording{StatusCode: http.StatusOK, Body: []byte("middle")}).Save(
+		recPath(middle, "layered")))
+	require.NoError((&Recording{StatusCode: http.StatusOK, Body: []byte("base")}).Save(
+		recPath(base, "layered")))
+	rt.Mode = ModeRecordIfMissing
+	rt.Dir = middle
+	assert.Equal([]string{overlay, middle, base}, rt.searchDirs())
+	assert.Equal("middle", get(client, "layered"))
+	rt.OverlayDir = ""
+	assert.Equal("live", get(client, "added"))
+	_, err = os.Stat(recPath(middle, "added"))
+	assert.NoError(err)
+	_, err = os.Stat(recPath(base, "added"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestRecordDir(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	playback, record := filepath.Join(tmpDir, "testdata"), filepath.Join(tmpDir, "new")
+	recPath := func(dir, name string) string {
+		return filepath.Join(dir, "http", "example.com", "GET", name, "request.json")
+	}
+	require.NoError((&Recording{StatusCode: http.StatusOK, Body: []byte("old")}).Save(
+		recPath(playback, "existing")))
+
+	rt := &RoundTripper{
+		RoundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return (&Recording{StatusCode: http.StatusOK, Body: []byte("live")}).Response(), nil
+		}),
+		Dir:           filepath.Join(tmpDir, "unused"),
+		PlaybackDir:   playback,
+		RecordDir:     record,
+		PathGenerator: NewPathGenerator(),
+	}
+	client := &http.Client{Transport: rt}
+	get := func(name string) (string, error) {
+		res, err := client.Get("http://example.com/" + name)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+	load := func(path string) string {
+		rec, err := LoadRecording(path)
+		if err != nil {
+			return err.Error()
+		}
+		return string(rec.Body)
+	}
+
+	for _, mode := range []Mode{ModePlaybackOnly, ModeRecordIfMissing, ModeRecordOnly} {
+		rt.Mode = mode
+		body, err := get("existing")
+		require.NoError(err)
+		if mode == ModeRecordOnly {
+			assert.Equal("live", body)
+			assert.Equal("live", load(recPath(record, "existing")))
+		} else {
+			assert.Equal("old", body)
+		}
+		assert.Equal("old", load(recPath(playback, "existing")))
+
+		body, err = get("missing")
+		if mode == ModePlaybackOnly {
+			assert.True(errors.Is(err, ErrRecordingNotFound))
+			continue
+		}
+		require.NoError(err)
+		assert.Equal("live", body)
+		assert.Equal("live", load(recPath(record, "missing")))
+		_, err = os.Stat(recPath(playback, "missing"))
+		assert.True(os.IsNotExist(err))
+	}
+	_, err = os.Stat(filepath.Join(tmpDir, "unused"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestWithRecordingName(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	var state string
+	client := &http.Client{Transport: &RoundTripper{
+		RoundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return (&Recording{StatusCode: http.StatusOK, Body: []byte(state)}).Response(), nil
+		}),
+		Dir:           tmpDir,
+		PathGenerator: NewPathGenerator(),
+	}}
+	get := func(name string) string {
+		ctx := context.Background()
+		if name != "" {
+			ctx = WithRecordingName(ctx, name)
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com/state", nil)
+		require.NoError(err)
+		res, err := client.Do(req)
+		require.NoError(err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		return string(body)
+	}
+	state = "default"
+	assert.Equal("default", get(""))
+	state = "a"
+	assert.Equal("a", get("scenario-a"))
+	state = "b"
+	assert.Equal("b", get("scenario b"))
+	assert.Equal("a", get("scenario-a"))
+	assert.Equal("default", get(""))
+	assert.Equal("b", get(".."))
+
+	dir := filepath.Join(tmpDir, "http", "example.com", "GET", "state")
+	for _, name := range []string{
+		"request.json", "scenario-a.json", "scenario+b.json", "%2E%2E.json",
+	} {
+		_, err = os.Stat(filepath.Join(dir, name))
+		assert.NoError(err, name)
+	}
+
+	req, err := http.NewRequest("POST", "http://example.com/", strings.NewReader("body"))
+	require.NoError(err)
+	req = req.WithContext(WithRecordingName(req.Context(), ".hidden"))
+	name := DefaultFileName(req, "123")
+	assert.Equal("%2Ehidden.123.json", name)
+	assert.True(isRecordingFile(name))
+
+	// An empty name is the same as none.
+	req = req.WithContext(WithRecordingName(req.Context(), ""))
+	_, ok := RecordingName(req.Context())
+	assert.False(ok)
+	assert.Equal("request.json", DefaultFileName(req, ""))
+	assert.Equal("request.123.json", DefaultFileName(req, "123"))
+}
+
+func TestBytesPerSecond(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	rec := &Recording{StatusCode: http.StatusOK, Body: bytes.Repeat([]byte("x"), 1000)}
+	require.NoError(rec.Save(filepath.Join(
+		tmpDir, "http", "example.com", "GET", "slow", "request.json")))
+
+	client := NewPlaybackOnlyClient(tmpDir)
+	client.Transport.(*RoundTripper).BytesPerSecond = 5000
+	start := time.Now()
+	res, err := client.Get("http://example.com/slow")
+	require.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(err)
+	assert.Len(body, 1000)
+	assert.True(time.Since(start) >= 200*time.Millisecond, time.Since(start))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com/slow", nil)
+	require.NoError(err)
+	res, err = client.Do(req)
+	require.NoError(err)
+	defer res.Body.Close()
+	buf := make([]byte, 1000)
+	n, err := res.Body.Read(buf)
+	require.NoError(err)
+	assert.True(n > 0 && n <= 500, n)
+	cancel()
+	_, err = ioutil.ReadAll(res.Body)
+	assert.True(errors.Is(err, context.Canceled))
+}
+
+func TestPassthrough(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Upgrade") != "echo" {
+				fmt.Fprint(w, "live")
+				return
+			}
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+				"Connection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			rw.Flush()
+			line, _ := rw.ReadString('\n')
+			rw.WriteString("echo " + line)
+			rw.Flush()
+		},
+	))
+	defer server.Close()
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	client := NewClient(tmpDir)
+	req, err := http.NewRequest("GET", server.URL+"/upgrade", nil)
+	require.NoError(err)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	assert.True(IsUpgradeRequest(req))
+	res, err := client.Do(req)
+	require.NoError(err)
+	assert.Equal(http.StatusSwitchingProtocols, res.StatusCode)
+	conn, ok := res.Body.(io.ReadWriteCloser)
+	require.True(ok)
+	_, err = io.WriteString(conn, "hello\n")
+	require.NoError(err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(err)
+	assert.Equal("echo hello\n", line)
+	conn.Close()
+
+	rt := client.Transport.(*RoundTripper)
+	rt.Passthrough = func(req *http.Request) bool {
+		return req.URL.Path == "/live"
+	}
+	res, err = client.Get(server.URL + "/live")
+	require.NoError(err)
+	res.Body.Close()
+
+	var files []string
+	filepath.Walk(tmpDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	assert.Empty(files)
+
+	req.Header.Del("Connection")
+	assert.False(IsUpgradeRequest(req))
+}
+
+func TestRecordChunks(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for i := 0; i < 3; i++ {
+				if i > 0 {
+					time.Sleep(50 * time.Millisecond)
+				}
+				fmt.Fprintf(w, "data: %d\n\n", i)
+				w.(http.Flusher).Flush()
+			}
+		},
+	))
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	client := NewClient(tmpDir)
+	client.Transport.(*RoundTripper).RecordChunks = IsEventStream
+	res, err := client.Get(server.URL + "/events")
+	require.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(err)
+	const events = "data: 0\n\ndata: 1\n\ndata: 2\n\n"
+	assert.Equal(events, string(body))
+	server.Close()
+
+	host := url.QueryEscape(server.Listener.Addr().String())
+	rec, err := LoadRecording(filepath.Join(
+		tmpDir, "http", host, "GET", "events", "request.json"))
+	require.NoError(err)
+	assert.Empty(rec.Body)
+	require.Len(rec.Chunks, 3)
+	assert.Equal("data: 1\n\n", rec.Chunks[1].Text)
+	assert.True(rec.Chunks[2].OffsetMS >= 90, rec.Chunks[2].OffsetMS)
+	body, err = ioutil.ReadAll(rec.Response().Body)
+	require.NoError(err)
+	assert.Equal(events, string(body))
+
+	client = NewPlaybackOnlyClient(tmpDir)
+	start := time.Now()
+	res, err = client.Get(server.URL + "/events")
+	require.NoError(err)
+	r := bufio.NewReader(res.Body)
+	line, err := r.ReadString('\n')
+	require.NoError(err)
+	assert.Equal("data: 0\n", line)
+	assert.True(time.Since(start) < 40*time.Millisecond)
+	body, err = ioutil.ReadAll(r)
+	res.Body.Close()
+	require.NoError(err)
+	assert.Equal(events[len(line):], string(body))
+	assert.True(time.Since(start) >= 90*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/events", nil)
+	require.NoError(err)
+	res, err = client.Do(req)
+	require.NoError(err)
+	defer res.Body.Close()
+	r = bufio.NewReader(res.Body)
+	_, err = r.ReadString('\n')
+	require.NoError(err)
+	cancel()
+	_, err = ioutil.ReadAll(r)
+	assert.True(errors.Is(err, context.Canceled))
+
+	// A binary chunk is base64 encoded.
+	chunk := newRecordedChunk(time.Second, []byte{0xff, 0x00})
+	buf, err := json.Marshal(chunk)
+	require.NoError(err)
+	assert.Equal(`{"offset_ms":1000,"data":"/wA="}`, string(buf))
+}
+
+func TestHooks(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	var events []string
+	rt := &RoundTripper{
+		RoundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return (&Recording{StatusCode: http.StatusOK, Body: []byte("live")}).Response(), nil
+		}),
+		Dir:           tmpDir,
+		PathGenerator: NewPathGenerator(),
+		OnReplay: func(req *http.Request, path string, rec *Recording) {
+			events = append(events, fmt.Sprintf("replay %s %d", filepath.Base(path), rec.StatusCode))
+		},
+		OnRecord: func(req *http.Request, path string, rec *Recording) {
+			events = append(events, fmt.Sprintf("record %s %s", filepath.Base(path), rec.Body))
+		},
+		OnMiss: func(req *http.Request, err *NotFoundError) {
+			events = append(events, fmt.Sprintf("miss %d", len(err.Paths)))
+		},
+	}
+	client := &http.Client{Transport: rt}
+	get := func() error {
+		res, err := client.Get("http://example.com/hooks")
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+	require.NoError(get())
+	require.NoError(get())
+	rt.Mode = ModePlaybackOnly
+	rt.Dir = filepath.Join(tmpDir, "empty")
+	assert.Error(get())
+	assert.Equal([]string{
+		"record request.json live",
+		"replay request.json 200",
+		"miss 1",
+	}, events)
+
+	rt.Dir = tmpDir
+	rt.OnReplay = func(req *http.Request, path string, rec *Recording) {
+		panic("oops")
+	}
+	err = get()
+	var replayErr *Error
+	if assert.True(errors.As(err, &replayErr)) {
+		assert.Contains(replayErr.Error(), "OnReplay panicked: oops")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	var buf bytes.Buffer
+	rt := &RoundTripper{
+		RoundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return (&Recording{StatusCode: http.StatusOK, Body: []byte("live")}).Response(), nil
+		}),
+		Dir:           tmpDir,
+		PathGenerator: NewPathGenerator(),
+		Logger: slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+		})),
+	}
+	client := &http.Client{Transport: rt}
+	for _, mode := range []Mode{ModeRecordIfMissing, ModeRecordIfMissing, ModePlaybackOnly} {
+		rt.Mode = mode
+		rawurl := "http://example.com/log?q=1"
+		if mode == ModePlaybackOnly {
+			rawurl = "http://example.com/missing"
+		}
+		res, err := client.Get(rawurl)
+		if err == nil {
+			res.Body.Close()
+		}
+	}
+
+	var events []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var event map[string]interface{}
+		require.NoError(dec.Decode(&event))
+		events = append(events, event)
+	}
+	var msgs []string
+	for _, event := range events {
+		msgs = append(msgs, event["msg"].(string))
+	}
+	assert.Equal([]string{
+		"replay path", "replay live", "replay saved",
+		"replay path", "replay hit",
+		"replay path", "replay miss",
+	}, msgs)
+	dir := filepath.Join(tmpDir, "http", "example.com", "GET", "log")
+	if assert.Len(events, 7) {
+		assert.NotEmpty(events[0]["checksum"])
+		assert.Equal("http://example.com/log?q=1", events[1]["url"])
+		assert.Equal(float64(4), events[2]["bytes"])
+		assert.Equal(dir, filepath.Dir(events[2]["path"].(string)))
+		assert.Equal(events[2]["path"], events[4]["path"])
+		assert.Equal(false, events[4]["generic"])
+		assert.Len(events[6]["paths"], 1)
+	}
+}
+
+func TestStats(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	rt := &RoundTripper{
+		RoundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "/fail" {
+				return nil, errors.New("connection reset")
+			}
+			return (&Recording{StatusCode: http.StatusOK}).Response(), nil
+		}),
+		Dir:           tmpDir,
+		PathGenerator: NewPathGenerator(),
+		Passthrough: func(req *http.Request) bool {
+			return req.URL.Path == "/live"
+		},
+	}
+	client := &http.Client{Transport: rt}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, path := range []string{"/a", "/b", "/live", "/fail"} {
+				if res, err := client.Get("http://example.com" + path); err == nil {
+					res.Body.Close()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	rt.Mode = ModePlaybackOnly
+	_, err = client.Get("http://example.com/missing")
+	assert.Error(err)
+	assert.Equal(Stats{
+		Replayed:        18,
+		Recorded:        2,
+		LivePassthrough: 10,
+		Misses:          1,
+		Errors:          10,
+	}, rt.Stats())
+	assert.Equal("replayed 18, recorded 2, passed through 10, misses 1, errors 10",
+		rt.Stats().String())
+	rt.Reset()
+	assert.Equal(Stats{}, rt.Stats())
+}
+
+func TestModeVerify(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	status, version, body := http.StatusOK, "1", `{"id":1,"time":"now"}`
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("X-Version", version)
+			w.Header().Set("X-Build", "build-"+version)
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+		},
+	))
+	defer server.Close()
+
+	client := NewClient(tmpDir)
+	res, err := client.Get(server.URL + "/verify")
+	require.NoError(err)
+	res.Body.Close()
+
+	rt := client.Transport.(*RoundTripper)
+	rt.Mode = ModeVerify
+	rt.VerifyHeaders = NewStringSet("X-Version", "x-build")
+	rt.NormalizeBody = NormalizeJSON("time")
+	var hooked []string
+	rt.OnDrift = func(req *http.Request, drift *Drift) {
+		hooked = append(hooked, drift.String())
+	}
+	get := func() string {
+		res, err := client.Get(server.URL + "/verify")
+		require.NoError(err)
+		defer res.Body.Close()
+		buf, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		return string(buf)
+	}
+
+	body = `{"time":"later", "id":1}`
+	assert.Equal(`{"id":1,"time":"now"}`, get())
+	assert.Empty(rt.Drifts())
+
+	status, version, body = http.StatusGone, "2", `{"id":2}`
+	assert.Equal(`{"id":1,"time":"now"}`, get())
+	drifts := rt.Drifts()
+	require.Len(drifts, 1)
+	assert.Equal("GET", drifts[0].Method)
+	assert.Equal(server.URL+"/verify", drifts[0].URL)
+	assert.Equal(filepath.Join(tmpDir, "http", url.QueryEscape(server.Listener.Addr().String()),
+		"GET", "verify", "request.json"), drifts[0].Path)
+	assert.Equal([]string{
+		"status: recorded 200, live 410",
+		`header X-Build: recorded ["build-1"], live ["build-2"]`,
+		`header X-Version: recorded ["1"], live ["2"]`,
+		"body: recorded 8 bytes, live 8 bytes differ",
+	}, drifts[0].Differences)
+	assert.Equal([]string{drifts[0].String()}, hooked)
+
+	_, err = client.Get(server.URL + "/missing")
+	assert.True(errors.Is(err, ErrRecordingNotFound))
+	assert.Len(rt.Drifts(), 1)
+}
+
+func TestReRecordOn(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "http", "example.com", "GET", "gone", "request.json")
+	require.NoError((&Recording{StatusCode: http.StatusGone}).Save(path))
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(os.Chtimes(path, old, old))
+
+	var buf bytes.Buffer
+	rt := &RoundTripper{
+		RoundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return (&Recording{StatusCode: http.StatusOK}).Response(), nil
+		}),
+		Dir:           tmpDir,
+		Mode:          ModePlaybackOnly,
+		PathGenerator: NewPathGenerator(),
+		ReRecordOn:    ReRecordErrorsOlderThan(time.Hour),
+		Logger:        slog.New(slog.NewTextHandler(&buf, nil)),
+	}
+	client := &http.Client{Transport: rt}
+	status := func() int {
+		res, err := client.Get("http://example.com/gone")
+		require.NoError(err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(http.StatusGone, status())
+
+	rt.Mode = ModeRecordIfMissing
+	assert.Equal(http.StatusOK, status())
+	assert.Contains(buf.String(), "msg=\"replay rerecord\"")
+	assert.Contains(buf.String(), "status=410")
+	assert.Equal(http.StatusOK, status())
+	assert.Equal(Stats{Replayed: 2, Recorded: 1}, rt.Stats())
+
+	rec, err := LoadRecording(path)
+	require.NoError(err)
+	assert.False(ReRecordErrorsOlderThan(time.Hour)(rec))
+	rec.StatusCode = http.StatusInternalServerError
+	assert.False(ReRecordErrorsOlderThan(time.Hour)(rec))
+	assert.True(ReRecordErrorsOlderThan(-time.Hour)(rec))
+	assert.False(ReRecordErrorsOlderThan(-time.Hour)(&Recording{StatusCode: 500}))
+}
+
+func TestRecordingBody(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	rec := &Recording{
+		StatusCode: http.StatusOK,
+		Headers: http.Header{
+			"Content-Type":     {"application/json"},
+			"Content-Length":   {"14"},
+			"Content-Encoding": {"gzip"},
+			"Etag":             {`"abc"`},
+		},
+		TLS:           &RecordedTLS{PeerCertificates: []RecordedCertificate{{DNSNames: []string{"a"}}}},
+		ContentLength: 14,
+		Body:          []byte(`{"name":"old"}`),
+	}
+	clone := rec.Clone()
+
+	var v map[string]interface{}
+	require.NoError(rec.GetBodyJSON(&v))
+	v["name"] = "new"
+	v["extra"] = true
+	require.NoError(rec.SetBodyJSON(v))
+	assert.Equal(`{"extra":true,"name":"new"}`, string(rec.Body))
+	assert.Equal("27", rec.Headers.Get("Content-Length"))
+	assert.Equal(int64(27), rec.ContentLength)
+	assert.Empty(rec.Headers.Get("Content-Encoding"))
+	assert.Empty(rec.Headers.Get("Etag"))
+	assert.False(rec.ContentLengthMismatch())
+	rec.TLS.PeerCertificates[0].DNSNames[0] = "b"
+
+	assert.Equal(`{"name":"old"}`, string(clone.Body))
+	assert.Equal("14", clone.Headers.Get("Content-Length"))
+	assert.Equal("gzip", clone.Headers.Get("Content-Encoding"))
+	assert.Equal("a", clone.TLS.PeerCertificates[0].DNSNames[0])
+
+	clone.SetBodyString("text")
+	body, err := ioutil.ReadAll(clone.Response().Body)
+	require.NoError(err)
+	assert.Equal("text", string(body))
+	assert.Equal(int64(4), clone.Response().ContentLength)
+
+	noHeaders := &Recording{}
+	noHeaders.SetBodyBytes([]byte("x"))
+	assert.Nil(noHeaders.Headers)
+	assert.Error(noHeaders.SetBodyJSON(func() {}))
+}
+
+func TestEnableTemplates(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	os.Setenv("REPLAY_TEST_ACCOUNT", "acct-1")
+	defer os.Unsetenv("REPLAY_TEST_ACCOUNT")
+	dir := filepath.Join(tmpDir, "http", "example.com", "GET")
+	require.NoError((&Recording{
+		StatusCode: http.StatusOK,
+		Headers: http.Header{
+			"Content-Type": {"application/json"},
+			"X-Expires":    {`{{ (now.Add "1h").Year }}`},
+		},
+		Body: []byte(`{"expires_at":"{{ now.Add "1h" | rfc3339 }}","account":"{{ env "REPLAY_TEST_ACCOUNT" }}"}`),
+	}).Save(filepath.Join(dir, "token", "request.json")))
+	require.NoError((&Recording{
+		StatusCode: http.StatusOK,
+		Headers:    http.Header{"Content-Type": {"text/plain"}},
+		Body:       []byte(`{{ now.Add "soon" }}`),
+	}).Save(filepath.Join(dir, "bad", "request.json")))
+	// Binary bodies are left alone, even if they contain "{{".
+	binary := []byte{0x1f, 0x8b, '{', '{', 0x00, '}', '}', 0xff}
+	require.NoError((&Recording{
+		StatusCode: http.StatusOK,
+		Headers:    http.Header{"Content-Type": {"application/octet-stream"}},
+		Body:       binary,
+	}).Save(filepath.Join(dir, "binary", "request.json")))
+	require.NoError((&Recording{
+		StatusCode: http.StatusOK,
+		Headers: http.Header{
+			"Content-Type":     {"text/plain"},
+			"Content-Encoding": {"gzip"},
+		},
+		Body: binary,
+	}).Save(filepath.Join(dir, "gzip", "request.json")))
+
+	rt := &RoundTripper{
+		Dir:             tmpDir,
+		Mode:            ModePlaybackOnly,
+		PathGenerator:   NewPathGenerator(),
+		EnableTemplates: true,
+	}
+	client := &http.Client{Transport: rt}
+	res, err := client.Get("http://example.com/token")
+	require.NoError(err)
+	var body struct {
+		ExpiresAt time.Time `json:"expires_at"`
+		Account   string
+	}
+	require.NoError(json.NewDecoder(res.Body).Decode(&body))
+	res.Body.Close()
+	assert.WithinDuration(time.Now().Add(time.Hour), body.ExpiresAt, time.Minute)
+	assert.Equal("acct-1", body.Account)
+	assert.Equal(strconv.Itoa(time.Now().Add(time.Hour).Year()), res.Header.Get("X-Expires"))
+
+	_, err = client.Get("http://example.com/bad")
+	var rerr *Error
+	require.True(errors.As(err, &rerr))
+	assert.Contains(err.Error(), filepath.Join(dir, "bad", "request.json"))
+
+	for _, name := range []string{"binary", "gzip"} {
+		res, err = client.Get("http://example.com/" + name)
+		if assert.NoError(err, name) {
+			buf, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			assert.Equal(binary, buf, name)
+		}
+	}
+
+	rt.EnableTemplates = false
+	res, err = client.Get("http://example.com/token")
+	require.NoError(err)
+	buf, err := ioutil.ReadAll(res.Body)
+	require.NoError(err)
+	assert.Contains(string(buf), `{{ env "REPLAY_TEST_ACCOUNT" }}`)
+}
+
+func TestHandle(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	require.NoError((&Recording{StatusCode: http.StatusOK, Body: []byte("file")}).Save(
+		filepath.Join(tmpDir, "http", "example.com", "GET", "static", "request.json")))
+
+	rt := &RoundTripper{
+		RoundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return nil, errors.New("unexpected live request")
+		}),
+		Dir:           tmpDir,
+		Mode:          ModePlaybackOnly,
+		PathGenerator: NewPathGenerator(),
+	}
+	rt.Handle("http/example.com/*/echo", func(req *http.Request) (*Recording, error) {
+		return &Recording{
+			StatusCode: http.StatusOK,
+			Headers:    http.Header{"Set-Cookie": {"session=secret"}},
+			Body:       []byte(req.URL.Query().Get("v")),
+		}, nil
+	})
+	rt.Handle("http/example.com/GET/fail", func(req *http.Request) (*Recording, error) {
+		return nil, errors.New("handler failed")
+	})
+	client := &http.Client{Transport: rt}
+	get := func(url string) string {
+		res, err := client.Get(url)
+		require.NoError(err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		return string(body)
+	}
+	assert.Equal("hello", get("http://example.com/echo?v=hello"))
+	assert.Equal("file", get("http://example.com/static"))
+	_, err = client.Get("http://example.com/fail/deeper")
+	var rerr *Error
+	require.True(errors.As(err, &rerr))
+	assert.Contains(err.Error(), "handler failed")
+	_, err = client.Get("http://example.com/failure")
+	assert.True(errors.Is(err, ErrRecordingNotFound))
+
+	echoPath := filepath.Join(tmpDir, "http", "example.com", "GET", "echo")
+	_, err = os.Stat(echoPath)
+	assert.True(os.IsNotExist(err))
+	rt.Mode = ModeRecordIfMissing
+	rt.SaveHandled = true
+	// Saved recordings are filtered like live responses, but the responses
+	// aren't.
+	rt.OmitResponseHeaders = NewStringSet("Set-Cookie")
+	rt.FilterResponse = func(rec *Recording) {
+		rec.Headers.Set("X-Filtered", "true")
+	}
+	res, err := client.Get("http://example.com/echo?v=saved")
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal("session=secret", res.Header.Get("Set-Cookie"))
+	assert.Empty(res.Header.Get("X-Filtered"))
+	matches, err := filepath.Glob(filepath.Join(echoPath, "*.json"))
+	require.NoError(err)
+	require.Len(matches, 1)
+	rec, err := LoadRecording(matches[0])
+	require.NoError(err)
+	assert.Equal("saved", string(rec.Body))
+	assert.Empty(rec.Headers.Get("Set-Cookie"))
+	assert.Equal("true", rec.Headers.Get("X-Filtered"))
+
+	// Handled recordings are served like replayed ones.
+	rt.Mode = ModePlaybackOnly
+	rt.SaveHandled = false
+	rt.TrackUsage = true
+	rt.EnableTemplates = true
+	var replayed []string
+	rt.OnReplay = func(req *http.Request, path string, rec *Recording) {
+		replayed = append(replayed, path)
+	}
+	rt.Handle("http/example.com/GET/once", func(req *http.Request) (*Recording, error) {
+		return &Recording{
+			StatusCode: http.StatusOK,
+			Headers:    http.Header{"Content-Type": {"text/plain"}},
+			Body:       []byte(`{{ "templated" }}`),
+			MaxReplays: 1,
+		}, nil
+	})
+	onceDir := filepath.Join(tmpDir, "http", "example.com", "GET", "once")
+	assert.Equal("templated", get("http://example.com/once"))
+	if assert.Len(replayed, 1) {
+		assert.Equal(onceDir, filepath.Dir(replayed[0]))
+		assert.Contains(rt.UsedRecordings(), replayed[0])
+	}
+	_, err = client.Get("http://example.com/once")
+	assert.True(errors.Is(err, ErrRecordingNotFound), "%v", err)
+
+	// A handler must return a recording or an error.
+	rt.Handle("http/example.com/GET/nil", func(req *http.Request) (*Recording, error) {
+		return nil, nil
+	})
+	_, err = client.Get("http://example.com/nil")
+	require.True(errors.As(err, &rerr), "%v", err)
+	assert.Contains(err.Error(), "handler returned no recording")
+}
+
+func TestAnyHostFallback(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	limited := filepath.Join(tmpDir, "http", AnyHostDir, "GET", "limited", "request.json")
+	require.NoError((&Recording{StatusCode: http.StatusTooManyRequests}).Save(limited))
+	require.NoError((&Recording{StatusCode: http.StatusOK}).Save(
+		filepath.Join(tmpDir, "http", "b.example.com", "GET", "limited", "request.json")))
+
+	live := 0
+	rt := &RoundTripper{
+		RoundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			live++
+			return (&Recording{StatusCode: http.StatusNoContent}).Response(), nil
+		}),
+		Dir:           tmpDir,
+		Mode:          ModePlaybackOnly,
+		PathGenerator: NewPathGenerator(),
+	}
+	client := &http.Client{Transport: rt}
+	status := func(url string) int {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(err)
+		req.Header.Set("X-Checksummed", "1")
+		res, err := client.Do(req)
+		if err != nil {
+			assert.True(errors.Is(err, ErrRecordingNotFound))
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(0, status("http://a.example.com/limited"))
+
+	rt.AnyHostFallback = true
+	rt.TrackUsage = true
+	assert.Equal(http.StatusTooManyRequests, status("http://a.example.com/limited"))
+	assert.Equal(http.StatusOK, status("http://b.example.com/limited"))
+	assert.Equal([]string{limited, filepath.Join(tmpDir, "http", "b.example.com",
+		"GET", "limited", "request.json")}, rt.UsedRecordings())
+
+	rt.StrictPath = true
+	assert.Equal(0, status("http://a.example.com/limited"))
+
+	rt.StrictPath = false
+	rt.Mode = ModeRecordOnly
+	assert.Equal(http.StatusNoContent, status("http://c.example.com/limited"))
+	assert.Equal(1, live)
+	entries, err := ioutil.ReadDir(filepath.Dir(limited))
+	require.NoError(err)
+	assert.Len(entries, 1)
+}
+
+func TestVerifyRequest(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	rt := &RoundTripper{
+		RoundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			body, err := ioutil.ReadAll(req.Body)
+			require.NoError(err)
+			assert.Equal(`{"n":1}`, string(body))
+			return (&Recording{StatusCode: http.StatusOK}).Response(), nil
+		}),
+		Dir:           tmpDir,
+		PathGenerator: NewPathGenerator(),
+		SaveRequest:   true,
+		TrackUsage:    true,
+	}
+	client := &http.Client{Transport: rt}
+	post := func() error {
+		req, err := http.NewRequest(http.MethodPost, "http://user@example.com/items?id=1",
+			strings.NewReader(`{"n":1}`))
+		require.NoError(err)
+		req.Header.Set("X-Api-Version", "1")
+		req.Header.Set("Authorization", "omitted")
+		res, err := client.Do(req)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+	require.NoError(post())
+	path := rt.UsedRecordings()[0]
+	rec, err := LoadRecording(path)
+	require.NoError(err)
+	sum := sha256.Sum256([]byte(`{"n":1}`))
+	assert.Equal(&RecordedRequest{
+		Method:     http.MethodPost,
+		URL:        "http://example.com/items?id=1",
+		Headers:    http.Header{"X-Api-Version": {"1"}},
+		BodySHA256: hex.EncodeToString(sum[:]),
+	}, rec.Request)
+
+	rt.Mode = ModePlaybackOnly
+	rt.VerifyRequest = true
+	require.NoError(post())
+
+	rec.Request.Headers.Set("X-Api-Version", "2")
+	require.NoError(rec.Save(path))
+	err = post()
+	var mismatch *MismatchError
+	require.True(errors.As(err, &mismatch))
+	assert.Equal(&MismatchError{
+		Path: path, Field: "header X-Api-Version", Expected: `["2"]`, Actual: `["1"]`,
+	}, mismatch)
+	assert.Contains(err.Error(), path)
+
+	rec.Request.Headers.Set("X-Api-Version", "1")
+	rec.Request.URL = "http://example.com/items?id=2"
+	require.NoError(rec.Save(path))
+	require.True(errors.As(post(), &mismatch))
+	assert.Equal("url", mismatch.Field)
+
+	rec.Request = nil
+	require.NoError(rec.Save(path))
+	require.NoError(post())
+}
+
+func TestMatchVariants(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	dir := filepath.Join(tmpDir, "http", "example.com", "GET", "greeting")
+	save := func(name, body string, match *RecordingMatch) {
+		require.NoError((&Recording{
+			StatusCode: http.StatusOK, Body: []byte(body), Match: match,
+		}).Save(filepath.Join(dir, name)))
+	}
+	save("fr.json", "bonjour", &RecordingMatch{Headers: map[string]string{"Accept-Language": "fr"}})
+	save("fr-formal.json", "bonjour madame", &RecordingMatch{
+		Headers: map[string]string{"Accept-Language": "fr"},
+		Query:   map[string]string{"formal": "1"},
+	})
+	save("request.json", "hello", nil)
+
+	gen := NewPathGenerator()
+	gen.OmitHeaders.Add("Accept-Language")
+	gen.OmitQuery = NewStringSet("formal")
+	rt := &RoundTripper{Dir: tmpDir, Mode: ModePlaybackOnly, PathGenerator: gen}
+	client := &http.Client{Transport: rt}
+	get := func(url, lang string) string {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(err)
+		if lang != "" {
+			req.Header.Set("Accept-Language", lang)
+		}
+		res, err := client.Do(req)
+		require.NoError(err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		return string(body)
+	}
+	assert.Equal("hello", get("http://example.com/greeting", "fr"))
+
+	rt.MatchVariants = true
+	assert.Equal("bonjour", get("http://example.com/greeting", "fr"))
+	assert.Equal("bonjour madame", get("http://example.com/greeting?formal=1", "fr"))
+	assert.Equal("hello", get("http://example.com/greeting", "de"))
+	assert.Equal("hello", get("http://example.com/greeting", ""))
+
+	require.NoError(os.Remove(filepath.Join(dir, "request.json")))
+	save("request.json", "only french", &RecordingMatch{Headers: map[string]string{"Accept-Language": "fr"}})
+	_, err = client.Get("http://example.com/greeting")
+	assert.True(errors.Is(err, ErrRecordingNotFound))
+	_, err = client.Get("http://example.com/missing")
+	assert.True(errors.Is(err, ErrRecordingNotFound))
+}
+
+func TestRoundTripperDefaults(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("live"))
+	}))
+	url := server.URL + "/defaults"
+
+	get := func(rt *RoundTripper) string {
+		res, err := (&http.Client{Transport: rt}).Get(url)
+		require.NoError(err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		return string(body)
+	}
+	rt := &RoundTripper{Dir: tmpDir}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal("live", get(rt))
+		}()
+	}
+	wg.Wait()
+	require.NotNil(rt.PathGenerator)
+	assert.Equal(http.DefaultTransport, rt.RoundTripper)
+
+	server.Close()
+	assert.Equal("live", get(&RoundTripper{Dir: tmpDir, Mode: ModePlaybackOnly}))
+}
+
+func TestNewClientWithOptions(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	live := 0
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		live++
+		return (&Recording{StatusCode: http.StatusOK}).Response(), nil
+	})
+	client := NewClientWithOptions(tmpDir,
+		WithTransport(transport),
+		WithStrictPath(),
+		WithOmitHeaders("X-Trace"),
+		WithOmitQuery("nonce"),
+	)
+	rt := client.Transport.(*RoundTripper)
+	assert.Equal(tmpDir, rt.Dir)
+	assert.Equal(ModeRecordIfMissing, rt.Mode)
+	assert.True(rt.StrictPath)
+	assert.Contains(rt.OmitHeaders, "Authorization")
+
+	get := func(url, trace string) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(err)
+		req.Header.Set("X-Trace", trace)
+		res, err := client.Do(req)
+		require.NoError(err)
+		res.Body.Close()
+	}
+	get("http://example.com/a?nonce=1", "1")
+	get("http://example.com/a?nonce=2", "2")
+	assert.Equal(1, live)
+
+	pg := &PathGenerator{}
+	rt = NewRoundTripper(tmpDir, WithPathGenerator(pg), WithOmitQuery("q"),
+		WithMode(ModePlaybackOnly), WithDir("other"))
+	assert.Equal(pg, rt.PathGenerator)
+	assert.Equal(NewStringSet("q"), pg.OmitQuery)
+	assert.Equal(ModePlaybackOnly, rt.Mode)
+	assert.Equal("other", rt.Dir)
+	assert.Equal(http.DefaultTransport, rt.RoundTripper)
+
+	rt = NewRoundTripper(tmpDir, WithPathGenerator(nil), WithOmitHeaders("X-Trace"))
+	assert.Contains(rt.OmitHeaders, "X-Trace")
+}
+
+// tokenTransport adds an Authorization header with a new token to each
+// request, like an oauth2.Transport.
+type tokenTransport struct {
+	base   http.RoundTripper
+	tokens int
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.tokens++
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %d", t.tokens))
+	return t.base.RoundTrip(req)
+}
+
+func TestWrapTransport(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer server.Close()
+
+	get := func(client *http.Client) string {
+		res, err := client.Get(server.URL + "/wrap")
+		require.NoError(err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		return string(body)
+	}
+
+	// Replay above the token transport: playback doesn't need a token.
+	above := &tokenTransport{base: http.DefaultTransport}
+	jar, err := cookiejar.New(nil)
+	require.NoError(err)
+	original := &http.Client{Transport: above, Timeout: time.Minute, Jar: jar}
+	client := WrapClient(original, filepath.Join(tmpDir, "above"))
+	assert.Equal(above, original.Transport)
+	assert.Equal(time.Minute, client.Timeout)
+	assert.Equal(jar, client.Jar)
+	assert.Equal("Bearer 1", get(client))
+	assert.Equal("Bearer 1", get(client))
+	assert.Equal(1, above.tokens)
+
+	// Replay below the token transport: Authorization isn't hashed, but a
+	// token is fetched for every request.
+	below := &tokenTransport{base: WrapTransport(nil, filepath.Join(tmpDir, "below"))}
+	client = &http.Client{Transport: below}
+	assert.Equal("Bearer 1", get(client))
+	assert.Equal("Bearer 1", get(client))
+	assert.Equal(2, below.tokens)
+	assert.Equal(http.DefaultTransport, below.base.(*RoundTripper).RoundTripper)
+
+	rt := WrapTransport(above, tmpDir, WithMode(ModePlaybackOnly)).(*RoundTripper)
+	assert.Equal(ModePlaybackOnly, rt.Mode)
+	assert.Equal(above, rt.RoundTripper)
+}
+
+func TestHeadRequests(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	rt := NewRoundTripper(tmpDir, WithTransport(http.DefaultTransport))
+	rt.TrackUsage = true
+	client := &http.Client{Transport: rt}
+	check := func(method string, body string) {
+		req, err := http.NewRequest(method, server.URL+"/file", nil)
+		require.NoError(err)
+		res, err := client.Do(req)
+		require.NoError(err)
+		defer res.Body.Close()
+		buf, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		assert.Equal(body, string(buf))
+		assert.Equal(int64(5), res.ContentLength)
+		assert.Equal("5", res.Header.Get("Content-Length"))
+		if method == http.MethodHead {
+			assert.Equal(http.NoBody, res.Body)
+		}
+	}
+	check(http.MethodHead, "")
+	check(http.MethodGet, "hello")
+	rt.Mode = ModePlaybackOnly
+	check(http.MethodHead, "")
+	check(http.MethodGet, "hello")
+
+	used := rt.UsedRecordings()
+	require.Len(used, 2)
+	assert.NotEqual(filepath.Dir(used[0]), filepath.Dir(used[1]))
+	for _, path := range used {
+		rec, err := LoadRecording(path)
+		require.NoError(err)
+		head := strings.Contains(path, string(filepath.Separator)+"HEAD"+string(filepath.Separator))
+		assert.Equal(head, rec.NoBody, path)
+		assert.False(rec.ContentLengthMismatch(), path)
+	}
+}
+
+func TestBodylessStatuses(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	for _, status := range []int{http.StatusContinue, http.StatusNoContent, http.StatusNotModified} {
+		path := filepath.Join(tmpDir, strconv.Itoa(status), "request.json")
+		rec := &Recording{
+			StatusCode: status,
+			Headers:    http.Header{"Content-Length": {"10"}, "Etag": {`"x"`}},
+			Body:       []byte("stray"),
+		}
+		require.NoError(rec.Save(path))
+		saved, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		assert.True(bytes.HasSuffix(saved, []byte("}\n")), status)
+
+		loaded, err := LoadRecording(path)
+		require.NoError(err)
+		assert.Empty(loaded.Body, status)
+		require.NoError(loaded.Save(path))
+		resaved, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		assert.Equal(string(saved), string(resaved), status)
+
+		res := loaded.Response()
+		assert.Equal(http.NoBody, res.Body, status)
+		assert.Equal(int64(0), res.ContentLength, status)
+		assert.Equal("10", res.Header.Get("Content-Length"), status)
+	}
+
+	rt := &RoundTripper{
+		RoundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusNotModified,
+				Header:     http.Header{"Etag": {`"v1"`}},
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		}),
+		Dir:           tmpDir,
+		PathGenerator: NewPathGenerator(),
+	}
+	client := &http.Client{Transport: rt}
+	for i := 0; i < 2; i++ {
+		res, err := client.Get("http://example.com/cached")
+		require.NoError(err)
+		assert.Equal(http.StatusNotModified, res.StatusCode)
+		assert.Equal(int64(0), res.ContentLength)
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		assert.Empty(body)
+		res.Body.Close()
+	}
+	assert.Equal(Stats{Replayed: 1, Recorded: 1}, rt.Stats())
+}
+
+func TestManifest(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	require.NoError((&Recording{
+		StatusCode: http.StatusOK,
+		Headers: http.Header{
+			"Content-Type": {"application/json"},
+			"Date":         {"Mon, 02 Jan 2006 15:04:05 GMT"},
+		},
+		Body: []byte(`{"a":1}`),
+	}).Save(filepath.Join(tmpDir, "https", "example.com", "GET", "items", "q=1", "request.json")))
+	require.NoError((&Recording{Error: &RecordedError{Message: "refused"}}).Save(
+		filepath.Join(tmpDir, "http", "example.com%3A8080", "POST", "request.123.json")))
+	require.NoError((&Recording{StatusCode: http.StatusOK}).Save(
+		filepath.Join(tmpDir, "odd.json")))
+
+	require.NoError(WriteManifest(tmpDir))
+	manifestPath := filepath.Join(tmpDir, ManifestFileName)
+	written, err := ioutil.ReadFile(manifestPath)
+	require.NoError(err)
+	m, err := ReadManifest(manifestPath)
+	require.NoError(err)
+	date := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	assert.Equal(&Manifest{Recordings: []ManifestEntry{
+		{
+			Path:   "http/example.com%3A8080/POST/request.123.json",
+			Method: "POST", URL: "http://example.com:8080/",
+			Error: "refused",
+		},
+		{
+			Path:   "https/example.com/GET/items/q=1/request.json",
+			Method: "GET", URL: "https://example.com/items?q=1",
+			StatusCode: http.StatusOK, BodySize: 7,
+			ContentType: "application/json", RecordedAt: &date,
+		},
+		{Path: "odd.json", StatusCode: http.StatusOK},
+	}}, m)
+
+	// The manifest is deterministic, and isn't itself a recording.
+	require.NoError(WriteManifest(tmpDir))
+	rewritten, err := ioutil.ReadFile(manifestPath)
+	require.NoError(err)
+	assert.Equal(string(written), string(rewritten))
+	unused, err := ReportUnused(tmpDir, nil)
+	require.NoError(err)
+	assert.Len(unused, 3)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req = req.WithContext(WithRecordingName(req.Context(), "manifest"))
+	assert.Equal("%6Danifest.json", DefaultFileName(req, ""))
+
+	rt := NewRoundTripper(tmpDir, WithTransport(roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return (&Recording{StatusCode: http.StatusCreated}).Response(), nil
+		})))
+	rt.ManifestPath = manifestPath
+	res, err := (&http.Client{Transport: rt}).Post("http://example.com/new", "text/plain",
+		strings.NewReader("x"))
+	require.NoError(err)
+	res.Body.Close()
+	m, err = ReadManifest(manifestPath)
+	require.NoError(err)
+	require.Len(m.Recordings, 4)
+	added := m.Recordings[1]
+	assert.Equal("POST", added.Method)
+	assert.Equal("http://example.com/new", added.URL)
+	assert.Equal(http.StatusCreated, added.StatusCode)
+	assert.True(strings.HasPrefix(added.Path, "http/example.com/POST/new/request."), added.Path)
+
+	// Requests are reconstructed in the layout of the PathGenerator.
+	rt.PathGenerator.IgnoreScheme = true
+	res, err = (&http.Client{Transport: rt}).Get("http://example.com/schemeless")
+	require.NoError(err)
+	res.Body.Close()
+	m, err = ReadManifest(manifestPath)
+	require.NoError(err)
+	require.Len(m.Recordings, 5)
+	added = m.Recordings[0]
+	assert.Equal("example.com/GET/schemeless/request.json", added.Path)
+	assert.Equal("GET", added.Method)
+	assert.Equal("//example.com/schemeless", added.URL)
+
+	// Paths from a PathTemplate can't be converted back to requests.
+	gen := NewPathGenerator()
+	gen.PathTemplate = func(req *http.Request) []string {
+		return []string{req.URL.Host}
+	}
+	require.NoError(WriteManifestWithGenerator(tmpDir, gen))
+	m, err = ReadManifest(manifestPath)
+	require.NoError(err)
+	for _, entry := range m.Recordings {
+		assert.Empty(entry.URL, entry.Path)
+	}
+	err = ToVCRCassetteWithGenerator(tmpDir, filepath.Join(tmpDir, "cassette.yaml"), gen)
+	assert.True(errors.Is(err, errPathTemplate), "%v", err)
+}
+
+func TestPrune(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	save := func(parts ...string) string {
+		path := filepath.Join(append([]string{tmpDir}, parts...)...)
+		require.NoError((&Recording{StatusCode: http.StatusOK, Body: []byte("x")}).Save(path))
+		return path
+	}
+	used := save("http", "example.com", "GET", "used", "request.json")
+	sibling := save("http", "example.com", "GET", "used", "request.1.json")
+	old := save("http", "example.com", "GET", "old", "deep", "request.json")
+	stale := time.Now().Add(-48 * time.Hour)
+	require.NoError(os.Chtimes(old, stale, stale))
+
+	keep := KeepUsed(NewStringSet(used))
+	wouldRemove, err := PruneDryRun(tmpDir, keep)
+	require.NoError(err)
+	assert.ElementsMatch([]string{sibling, old}, wouldRemove)
+	_, err = os.Stat(old)
+	require.NoError(err)
+
+	removed, err := Prune(tmpDir, KeepNewerThan(time.Now().Add(-24*time.Hour)))
+	require.NoError(err)
+	assert.Equal([]string{old}, removed)
+	_, err = os.Stat(filepath.Join(tmpDir, "http", "example.com", "GET", "old"))
+	assert.True(os.IsNotExist(err))
+
+	removed, err = Prune(tmpDir, keep)
+	require.NoError(err)
+	assert.Equal([]string{sibling}, removed)
+	_, err = os.Stat(used)
+	require.NoError(err)
+
+	removed, err = Prune(tmpDir, func(string, *Recording) bool { return false })
+	require.NoError(err)
+	assert.Equal([]string{used}, removed)
+	entries, err := ioutil.ReadDir(tmpDir)
+	require.NoError(err)
+	assert.Empty(entries)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpDir, "bad.json"), []byte("{"), 0644))
+	_, err = Prune(tmpDir, keep)
+	assert.Error(err)
+	assert.Contains(err.Error(), "bad.json")
+}
+
+func TestWalk(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	save := func(parts ...string) string {
+		path := filepath.Join(append([]string{tmpDir}, parts...)...)
+		require.NoError((&Recording{StatusCode: http.StatusOK, Body: []byte("body")}).Save(path))
+		return path
+	}
+	items := save("https", "example.com%3A8443", "GET", "items", "a+b", "%2F", "q=1", "request.123.json")
+	generic := save("https", "example.com%3A8443", "GET", "request.json")
+	odd := save("odd.json")
+	bad := filepath.Join(tmpDir, "http", "example.com", "GET", "request.json")
+	require.NoError(os.MkdirAll(filepath.Dir(bad), os.ModePerm))
+	require.NoError(ioutil.WriteFile(bad, []byte("{"), 0644))
+
+	var infos []RecordingInfo
+	var bodies []string
+	walkFn := func(info RecordingInfo, rec *Recording) error {
+		infos = append(infos, info)
+		if rec != nil {
+			bodies = append(bodies, string(rec.Body))
+		}
+		return nil
+	}
+	require.NoError(Walk(tmpDir, walkFn))
+	require.Len(infos, 4)
+	assert.Equal(bad, infos[0].FilePath)
+	assert.Error(infos[0].Err)
+	assert.Equal("GET", infos[0].Method)
+
+	assert.Equal(RecordingInfo{
+		FilePath: items, Scheme: "https", Host: "example.com:8443", Method: "GET",
+		PathSegments: []string{"items", "a b", ""}, RawQuery: "q=1", CRC: "123",
+	}, infos[1])
+	assert.Equal("https://example.com:8443/items/a%20b/?q=1", infos[1].URL().String())
+	assert.Equal(generic, infos[2].FilePath)
+	assert.Empty(infos[2].CRC)
+	assert.Empty(infos[2].PathSegments)
+	assert.Equal(odd, infos[3].FilePath)
+	assert.Error(infos[3].Err)
+	assert.Nil(infos[3].URL())
+	assert.Equal([]string{"body", "body", "body"}, bodies)
+
+	infos, bodies = nil, nil
+	require.NoError(WalkHeaders(tmpDir, walkFn))
+	assert.Len(infos, 4)
+	assert.Equal([]string{"", "", ""}, bodies)
+
+	stop := errors.New("stop")
+	assert.Equal(stop, Walk(tmpDir, func(RecordingInfo, *Recording) error { return stop }))
+}
+
+func TestInvalidate(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	version := 1
+	rt := NewRoundTripper(tmpDir, WithTransport(roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return (&Recording{
+				StatusCode: http.StatusOK,
+				Body:       []byte(strconv.Itoa(version)),
+			}).Response(), nil
+		})))
+	rt.CacheRecordings = true
+	client := &http.Client{Transport: rt}
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/contract?v=1", nil)
+		require.NoError(err)
+		return req
+	}
+	get := func() string {
+		res, err := client.Do(newRequest())
+		require.NoError(err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		return string(body)
+	}
+	assert.Equal("1", get())
+	version = 2
+	assert.Equal("1", get())
+
+	require.NoError(rt.Invalidate(newRequest()))
+	assert.Equal("2", get())
+	err = rt.Invalidate(newRequest())
+	require.NoError(err)
+	err = rt.Invalidate(newRequest())
+	assert.True(errors.Is(err, ErrRecordingNotFound))
+
+	dir := filepath.Join(tmpDir, "http", "example.com", "GET", "contract")
+	require.NoError((&Recording{StatusCode: http.StatusOK}).Save(filepath.Join(dir, "request.json")))
+	assert.True(errors.Is(rt.Invalidate(newRequest()), ErrRecordingNotFound))
+	require.NoError(rt.InvalidateGeneric(newRequest()))
+	_, err = os.Stat(filepath.Join(dir, "request.json"))
+	assert.True(os.IsNotExist(err))
+	var notFound *NotFoundError
+	require.True(errors.As(rt.InvalidateGeneric(newRequest()), &notFound))
+	assert.Len(notFound.Paths, 2)
+}
+
+func TestRefresh(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	version := 1
+	rt := NewRoundTripper(tmpDir, WithMode(ModePlaybackOnly), WithTransport(roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return (&Recording{
+				StatusCode: http.StatusOK,
+				Headers:    http.Header{"X-Secret": {"s"}},
+				Body:       []byte(strconv.Itoa(version)),
+			}).Response(), nil
+		})))
+	rt.OmitResponseHeaders = NewStringSet("X-Secret")
+	var recorded []string
+	rt.OnRecord = func(req *http.Request, path string, rec *Recording) {
+		recorded = append(recorded, path)
+	}
+	client := &http.Client{Transport: rt}
+	read := func(res *http.Response, err error) string {
+		require.NoError(err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		return string(body)
+	}
+	url := "http://example.com/fixture"
+	_, err = client.Get(url)
+	assert.True(errors.Is(err, ErrRecordingNotFound))
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(err)
+	assert.Equal("1", read(rt.Refresh(req)))
+	assert.Equal("1", read(client.Get(url)))
+	version = 2
+	assert.Equal("1", read(client.Get(url)))
+	assert.Equal("2", read(rt.Refresh(req)))
+	assert.Equal("2", read(client.Get(url)))
+
+	path := filepath.Join(tmpDir, "http", "example.com", "GET", "fixture", "request.json")
+	assert.Equal([]string{path, path}, recorded)
+	rec, err := LoadRecording(path)
+	require.NoError(err)
+	assert.Empty(rec.Headers.Get("X-Secret"))
+	assert.Equal(Stats{Replayed: 3, Recorded: 2, Misses: 1}, rt.Stats())
+}
+
+func TestInjectError(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	dir := filepath.Join(tmpDir, "http", "example.com", "GET")
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name, "request.json")
+		require.NoError(os.MkdirAll(filepath.Dir(path), os.ModePerm))
+		require.NoError(ioutil.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+	write("timeout", `{"inject_error": {"type": "timeout"}}`)
+	write("reset", `{"inject_error": {"type": "connection_reset", "message": "reset!"}}`)
+	write("eof", `{"inject_error": {"type": "eof"}}`)
+	bad := write("bad", `{"inject_error": {"type": "meltdown"}}`)
+
+	rt := NewRoundTripper(tmpDir, WithMode(ModePlaybackOnly))
+	client := &http.Client{Transport: rt}
+	get := func(name string) error {
+		res, err := client.Get("http://example.com/" + name)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	err = get("timeout")
+	var netErr net.Error
+	require.True(errors.As(err, &netErr))
+	assert.True(netErr.Timeout())
+	assert.True(errors.Is(err, context.DeadlineExceeded))
+	assert.True(errors.Is(err, os.ErrDeadlineExceeded))
+
+	err = get("reset")
+	assert.True(errors.Is(err, syscall.ECONNRESET))
+	assert.Contains(err.Error(), "reset!")
+	require.True(errors.As(err, &netErr))
+	assert.False(netErr.Timeout())
+
+	assert.True(errors.Is(get("eof"), io.EOF))
+
+	err = get("bad")
+	assert.Contains(err.Error(), bad)
+	assert.Contains(err.Error(), `"meltdown"`)
+	assert.Equal(Stats{Replayed: 3, Errors: 1}, rt.Stats())
+}
+
+func TestMaxReplays(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	dir := filepath.Join(tmpDir, "http", "example.com", "GET", "warm")
+	require.NoError((&Recording{StatusCode: http.StatusOK, Body: []byte("cold"), MaxReplays: 1}).Save(
+		filepath.Join(dir, "request.json")))
+	require.NoError((&Recording{StatusCode: http.StatusOK, Body: []byte("once"), MaxReplays: 1}).Save(
+		filepath.Join(tmpDir, "http", "example.com", "GET", "once", "request.json")))
+
+	rt := NewRoundTripper(tmpDir, WithMode(ModePlaybackOnly))
+	client := &http.Client{Transport: rt}
+	get := func(path string) string {
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/"+path, nil)
+		require.NoError(err)
+		req.Header.Set("X-Warm", "1")
+		res, err := client.Do(req)
+		if err != nil {
+			assert.True(errors.Is(err, ErrRecordingNotFound))
+			return ""
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		return string(body)
+	}
+
+	// The recording with the checksum is served once, then the generic one.
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/warm", nil)
+	require.NoError(err)
+	req.Header.Set("X-Warm", "1")
+	rp, err := rt.PathGenerator.RecordingPath(req)
+	require.NoError(err)
+	require.NoError((&Recording{StatusCode: http.StatusOK, Body: []byte("warm"), MaxReplays: 1}).Save(
+		filepath.Join(tmpDir, rp.Path())))
+	assert.Equal("warm", get("warm"))
+	assert.Equal("cold", get("warm"))
+	assert.Equal("", get("warm"))
+
+	var wg sync.WaitGroup
+	var served int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if get("once") == "once" {
+				atomic.AddInt32(&served, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(int32(1), served)
+
+	assert.Equal("", get("once"))
+
+	// Counts are per RoundTripper.
+	res, err := NewClientWithOptions(tmpDir, WithMode(ModePlaybackOnly)).Get("http://example.com/once")
+	require.NoError(err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(err)
+	assert.Equal("once", string(body))
+}
+
+func TestMaxReplaysRecordIfMissing(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "live")
+	}))
+	defer server.Close()
+	rp, err := NewPathGenerator().RecordingPath(httptest.NewRequest("GET", server.URL+"/poll", nil))
+	require.NoError(err)
+	path := filepath.Join(tmpDir, rp.Path())
+	fixture := &Recording{
+		StatusCode: http.StatusOK,
+		Body:       []byte("fixture"),
+		MaxReplays: 1,
+		Request:    &RecordedRequest{Method: "GET", URL: "http://elsewhere.example/poll"},
+	}
+	require.NoError(fixture.Save(path))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(err)
+
+	rt := &RoundTripper{Dir: tmpDir, Mode: ModeRecordIfMissing}
+	client := &http.Client{Transport: rt}
+	get := func() (string, error) {
+		res, err := client.Get(server.URL + "/poll")
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		return string(body), nil
+	}
+
+	// A replay that is rejected isn't counted.
+	rt.VerifyRequest = true
+	_, err = get()
+	var mismatch *MismatchError
+	assert.True(errors.As(err, &mismatch))
+	rt.VerifyRequest = false
+
+	for _, expected := range []string{"fixture", "live", "live"} {
+		body, err := get()
+		require.NoError(err)
+		assert.Equal(expected, body)
+	}
+	// The fixture isn't replaced once its replays are used up.
+	after, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	assert.Equal(string(data), string(after))
+}
+
+func TestFreshenDate(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	const recorded = "Mon, 02 Jan 2006 15:04:05 GMT"
+	dir := filepath.Join(tmpDir, "http", "example.com", "GET")
+	dated := filepath.Join(dir, "dated", "request.json")
+	require.NoError((&Recording{
+		StatusCode: http.StatusOK,
+		Headers:    http.Header{"Date": {recorded}, "Expires": {recorded}},
+	}).Save(dated))
+	require.NoError((&Recording{StatusCode: http.StatusOK}).Save(
+		filepath.Join(dir, "undated", "request.json")))
+
+	rt := NewRoundTripper(tmpDir, WithMode(ModePlaybackOnly))
+	client := &http.Client{Transport: rt}
+	header := func(path string) http.Header {
+		res, err := client.Get("http://example.com/" + path)
+		require.NoError(err)
+		res.Body.Close()
+		return res.Header
+	}
+	assert.Equal(recorded, header("dated").Get("Date"))
+	assert.Empty(header("undated").Get("Date"))
+
+	rt.FreshenDate = true
+	rt.FreshenHeaders = func(h http.Header) {
+		if date, err := http.ParseTime(h.Get("Date")); err == nil && h.Get("Expires") != "" {
+			h.Set("Expires", date.Add(time.Hour).Format(http.TimeFormat))
+		}
+	}
+	for _, path := range []string{"dated", "undated"} {
+		h := header(path)
+		date, err := http.ParseTime(h.Get("Date"))
+		require.NoError(err, path)
+		assert.WithinDuration(time.Now(), date, 2*time.Second, path)
+	}
+	expires, err := http.ParseTime(header("dated").Get("Expires"))
+	require.NoError(err)
+	assert.WithinDuration(time.Now().Add(time.Hour), expires, 2*time.Second)
+	assert.Empty(header("undated").Get("Expires"))
+
+	rec, err := LoadRecording(dated)
+	require.NoError(err)
+	assert.Equal(recorded, rec.Headers.Get("Date"))
+}
+
+func TestRewriteLocation(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	dir := filepath.Join(tmpDir, "https", "api.example.com", "GET")
+	path := filepath.Join(dir, "start", "request.json")
+	require.NoError((&Recording{
+		StatusCode: http.StatusFound,
+		Headers: http.Header{
+			"Location":         {"https://api.example.com/next?page=2"},
+			"Content-Location": {"/start"},
+		},
+	}).Save(path))
+	require.NoError((&Recording{
+		StatusCode: http.StatusOK,
+		Headers:    http.Header{"Content-Location": {"https://other.example.com/next"}},
+	}).Save(filepath.Join(dir, "next", "request.json")))
+
+	rt := NewRoundTripper(tmpDir, WithMode(ModePlaybackOnly))
+	client := &http.Client{
+		Transport: rt,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(url string) http.Header {
+		res, err := client.Get(url)
+		require.NoError(err)
+		res.Body.Close()
+		return res.Header
+	}
+	assert.Equal("https://api.example.com/next?page=2", get("https://api.example.com/start").Get("Location"))
+
+	rt.RewriteLocation = map[string]string{"api.example.com": "localhost:8443"}
+	h := get("https://api.example.com/start")
+	assert.Equal("https://localhost:8443/next?page=2", h.Get("Location"))
+	assert.Equal("/start", h.Get("Content-Location"))
+
+	rt.RewriteLocation["other.example.com"] = "http://127.0.0.1:8080"
+	assert.Equal("http://127.0.0.1:8080/next", get("https://api.example.com/next").Get("Content-Location"))
+
+	rec, err := LoadRecording(path)
+	require.NoError(err)
+	assert.Equal("https://api.example.com/next?page=2", rec.Headers.Get("Location"))
+}
+
+func TestBodyRewrites(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	const page = `{"next":"https://api.example.com/items?page=2"}`
+	rt := NewRoundTripper(tmpDir, WithTransport(roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			contentType := "application/json"
+			if strings.HasSuffix(req.URL.Path, ".bin") {
+				contentType = "application/octet-stream"
+			}
+			return (&Recording{
+				StatusCode: http.StatusOK,
+				Headers: http.Header{
+					"Content-Type":   {contentType},
+					"Content-Length": {strconv.Itoa(len(page))},
+				},
+				ContentLength: int64(len(page)),
+				Body:          []byte(page),
+			}).Response(), nil
+		})))
+	rt.RecordBodyRewrites = []BodyRewrite{{Old: "https://api.example.com", New: "https://replay.invalid"}}
+	rt.TrackUsage = true
+	client := &http.Client{Transport: rt}
+	get := func(path string) (string, *http.Response) {
+		res, err := client.Get("https://api.example.com/" + path)
+		require.NoError(err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		return string(body), res
+	}
+
+	body, _ := get("items")
+	assert.Equal(page, body)
+	rec, err := LoadRecording(rt.UsedRecordings()[0])
+	require.NoError(err)
+	const saved = `{"next":"https://replay.invalid/items?page=2"}`
+	assert.Equal(saved, string(rec.Body))
+	assert.False(rec.ContentLengthMismatch())
+
+	rt.BodyRewrites = []BodyRewrite{{
+		Pattern: regexp.MustCompile(`https://replay\.invalid(/[a-z]+)`),
+		New:     "http://127.0.0.1:8080${1}",
+	}}
+	body, res := get("items")
+	const local = `{"next":"http://127.0.0.1:8080/items?page=2"}`
+	assert.Equal(local, body)
+	assert.Equal(int64(len(local)), res.ContentLength)
+	assert.Equal(strconv.Itoa(len(local)), res.Header.Get("Content-Length"))
+
+	body, _ = get("file.bin")
+	assert.Equal(page, body)
+	body, _ = get("file.bin")
+	assert.Equal(page, body)
+}
@@ -0,0 +1,105 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// CanonicalJSONBody returns a function that can be used as the
+// MungeRequestBody field of PathGenerator for requests with JSON bodies. The
+// body is parsed as JSON, any of the named fields are removed, and it is
+// re-encoded with sorted object keys and no whitespace. Fields may be nested
+// object keys separated by periods, e.g. "meta.timestamp". Fields in objects
+// within arrays are matched as if the array weren't there, or with "[]" after
+// the array's key, e.g. "items[].id". If the body can't be parsed as JSON, the
+// raw bytes are used.
+func CanonicalJSONBody(ignoreFields ...string) func(*http.Request, io.Reader) io.Reader {
+	paths := jsonPaths(ignoreFields)
+	return func(req *http.Request, r io.Reader) io.Reader {
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			return io.MultiReader(bytes.NewReader(body), errReader{err})
+		}
+		return bytes.NewReader(canonicalJSON(body, paths))
+	}
+}
+
+// NormalizeJSON returns a function that can be used as the NormalizeBody field
+// of RoundTripper for responses with JSON bodies. Bodies are canonicalized as
+// by CanonicalJSONBody, with the named fields removed.
+func NormalizeJSON(ignoreFields ...string) func(*http.Response, []byte) []byte {
+	paths := jsonPaths(ignoreFields)
+	return func(res *http.Response, body []byte) []byte {
+		return canonicalJSON(body, paths)
+	}
+}
+
+// jsonPaths splits each of fields into the keys of its path.
+func jsonPaths(fields []string) [][]string {
+	paths := make([][]string, len(fields))
+	for i, field := range fields {
+		keys := strings.Split(field, ".")
+		for j, key := range keys {
+			keys[j] = strings.TrimSuffix(key, "[]")
+		}
+		paths[i] = keys
+	}
+	return paths
+}
+
+// isJSON reports whether mediaType is that of JSON content, e.g.
+// "application/json" or "application/vnd.api+json".
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || mediaType == "text/json" ||
+		strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json")
+}
+
+// canonicalJSON returns body with the fields identified by paths removed, and
+// re-encoded with sorted object keys and no whitespace, or body itself if it
+// can't be parsed as JSON.
+func canonicalJSON(body []byte, paths [][]string) []byte {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return body
+	}
+	for _, path := range paths {
+		deleteJSONPath(v, path)
+	}
+	canonical, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return canonical
+}
+
+// deleteJSONPath removes the field identified by path from v, which is a value
+// decoded by encoding/json.
+func deleteJSONPath(v interface{}, path []string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(v, path[0])
+		} else if child, ok := v[path[0]]; ok {
+			deleteJSONPath(child, path[1:])
+		}
+	case []interface{}:
+		for _, elem := range v {
+			deleteJSONPath(elem, path)
+		}
+	}
+}
+
+// errReader is an io.Reader that always returns an error.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -1,19 +1,22 @@
 package replay
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
-)
-
-const (
-	// ModeRecordIfMissing enables playing back recordings that exist, and
-	// recording new responses when a recording isn't found.
-	ModeRecordIfMissing = iota
-	// ModePlaybackOnly enables playing back content only.
-	ModePlaybackOnly
-	// ModeRecordOnly enables recording new content only.
-	ModeRecordOnly
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // RoundTripper implemnts a wrapper around an instance of the http.RoundTripper
@@ -23,86 +26,1333 @@ const (
 type RoundTripper struct {
 	// RoundTripper is the http.RoundTripper used to process HTTP requests if
 	// a recorded response is not available on disk. It will be unused if
-	// Record is false.
+	// Record is false. If it is nil when RoundTrip is first called,
+	// http.DefaultTransport is used.
 	http.RoundTripper
 	// Dir is the base directory where HTTP responses are read from and recored
 	// to.
 	Dir string
+	// Dirs are further directories that recordings are read from, after Dir,
+	// e.g. for fixtures shared between packages. For each directory in turn,
+	// the path with the checksum is searched for before the path without
+	// one. New recordings are saved to Dir, or to the first of Dirs if Dir is
+	// empty, unless RecordDir is set.
+	Dirs []string
+	// PlaybackDir, if not empty, is searched for recordings in place of Dir.
+	PlaybackDir string
+	// RecordDir, if not empty, is the directory that new recordings are saved
+	// to, instead of the first directory that is searched. Recordings saved
+	// there are only played back if it is also searched, e.g. if it is the
+	// same as PlaybackDir. See the package documentation for an example.
+	RecordDir string
+	// OverlayDir and BaseDir, if not empty, layer two trees of recordings.
+	// OverlayDir is searched before Dir and Dirs, and new recordings are
+	// saved to it unless RecordDir is set. BaseDir is searched after them,
+	// and is never modified, so it can be a read-only tree of shared
+	// recordings, with OverlayDir holding additions and overrides. See
+	// NewOverlayClient.
+	OverlayDir string
+	BaseDir    string
+	// Store, if not nil, holds recordings in place of files, e.g. a
+	// *Cassette. Its keys are the paths that would otherwise be used for
+	// the files, with forward slashes, so Dir is normally left empty, in
+	// which case they are relative. MatchVariants, ManifestPath, Invalidate,
+	// and the checks of UnusedRecordings and VerifyAllUsed only apply to
+	// files.
+	Store Store
 	// Mode determines if responses are recorded, played back, or recorded only
-	// if missing.
-	Mode int
+	// if missing. Requests that are recorded to the same path are sent and
+	// saved one at a time. RoundTrip returns an error if it isn't one of the
+	// Mode constants.
+	Mode Mode
+	// Coalesce, if true, causes concurrent identical requests to be coalesced
+	// in ModeRecordIfMissing: one of them is sent, and the others wait for
+	// its recording to be saved and then play it back, each with its own
+	// body. Otherwise, each of them is sent and recorded in turn. It has no
+	// effect in other modes.
+	Coalesce bool
 	// PathGenerator is used to generate unique paths for retrieving and saving
-	// responses. The paths generated are relative to Dir.
+	// responses. The paths generated are relative to Dir. If it is nil when
+	// RoundTrip is first called, NewPathGenerator() is used.
 	*PathGenerator
+	// Pather, if not nil, generates the paths of recordings in place of
+	// PathGenerator, e.g. to use an entirely different layout. PathGenerator
+	// is still used for the fingerprints saved by SaveRequest.
+	Pather Pather
+	// KeyFunc, if not nil, returns a key for each request, such as
+	// "list-users" or "orders/create", which is used as the path of its
+	// recording, relative to Dir, in place of the path generated by
+	// PathGenerator or Pather. Slashes separate directories, each component
+	// is escaped as by PathGenerator, and ".json" is appended unless the key
+	// ends with it, so "orders/create" is played back from and recorded to
+	// "orders/create.json". If it returns an empty key, the generated path
+	// is used. It is called with the request returned by RewriteRequest, if
+	// that is set. Requests given the same key share a recording; if
+	// TrackUsage is true, DuplicateKeys reports keys given to different
+	// requests.
+	KeyFunc func(*http.Request) (string, error)
 	// StrictPath, if true, will prevent RoundTripper from loading responses
 	// without a checksum. The default is to attempt to load a recording from
 	// the path without a checksum in cases where the path including the
 	// checksum does not exist.
 	StrictPath bool
+	// SaveRequest, if true, saves a fingerprint of the request with each new
+	// recording, as its Request. See VerifyRequest.
+	SaveRequest bool
+	// VerifyRequest, if true, compares each request with the fingerprint
+	// saved with its recording, if it has one, when it is played back, and
+	// returns an *Error wrapping a *MismatchError if they differ. This
+	// guards against checksum collisions, and recordings that have been
+	// edited or moved. Recordings without a fingerprint are played back as
+	// usual.
+	VerifyRequest bool
+	// MatchVariants, if true, allows a directory to contain several variants
+	// of a recording, each with a Match block of conditions on the request,
+	// e.g. to serve different responses for requests that differ only in an
+	// omitted header:
+	//	"match": {"headers": {"Accept-Language": "fr"}}
+	// Each directory that would be searched for a recording is read, and the
+	// first recording in filename order whose conditions the request
+	// satisfies is played back. Otherwise, recordings are looked for as
+	// usual, but those with a Match block are skipped.
+	MatchVariants bool
+	// AnyHostFallback, if true, causes recordings that aren't found under
+	// the directory for the request's host to be looked for under an
+	// AnyHostDir ("_any_") directory in its place, e.g.
+	// "http/_any_/GET/limited/request.json", in each of the directories
+	// searched. This allows a fixture such as a rate-limit response to be
+	// shared by all hosts. StrictPath applies to these paths as well. New
+	// recordings are never saved there. It has no effect if the PathGenerator
+	// has a PathTemplate.
+	AnyHostFallback bool
+	// SubdirFunc, if not nil, returns a directory for the recording of a
+	// request, relative to Dir, which is prepended to the generated path. It
+	// may contain path separators, e.g. to group recordings by test with
+	// DirForTest. An empty directory adds nothing to the path.
+	SubdirFunc func(*http.Request) string
+	// ReRecordOn, if not nil, is called in ModeRecordIfMissing with each
+	// recording that is found, and if it returns true, the recording is
+	// replaced with a new one instead of being played back, e.g. to refresh
+	// recordings of errors with ReRecordErrorsOlderThan. Body is not set in
+	// the recording unless CacheRecordings is true.
+	ReRecordOn func(recorded *Recording) bool
+	// ReRecordCorrupt, if true, replaces recordings that are corrupt, as
+	// reported by ErrCorruptRecording, e.g. because a test run was killed
+	// while one was being saved, with new ones in ModeRecordIfMissing,
+	// instead of returning an error.
+	ReRecordCorrupt bool
+	// Verbose, if true, adds an Explanation of how each request maps to the
+	// paths that were searched to the *NotFoundError returned when there is
+	// no recording for it, to help find out why a request doesn't match a
+	// recording.
+	Verbose bool
+	// Passthrough, if not nil, is called with each request, and the request
+	// is sent with the wrapped RoundTripper without being played back or
+	// recorded if it returns true. Protocol upgrade requests, such as for
+	// WebSockets, are always passed through, since the connection can't be
+	// recorded. See IsUpgradeRequest.
+	Passthrough func(*http.Request) bool
+	// MissingHandler, if not nil, is called in ModePlaybackOnly when there is
+	// no recording for a request, and its result is returned by RoundTrip in
+	// place of the *Error wrapping err. It can be used to make missing
+	// recordings look like server failures, e.g. with
+	// MissingRecordingResponse. A client returned by NewTestClient doesn't
+	// fail the test for a missing recording if MissingHandler is set.
+	MissingHandler func(req *http.Request, err *NotFoundError) (*http.Response, error)
+	// RewriteRequest, if not nil, is called with a copy of each request before
+	// its recording path is generated, and the path is generated from the
+	// request it returns instead. It can be used to map hosts that vary
+	// between runs, such as those of httptest servers, to fixed names. The
+	// request that is sent is not affected. The copy has its own body if the
+	// original can be read more than once, which is arranged if necessary.
+	RewriteRequest func(*http.Request) *http.Request
+	// ShouldRecord, if not nil, is called with each live response in
+	// ModeRecordIfMissing and ModeRecordOnly, before its body is read, and
+	// if it returns false, the response is returned untouched and nothing is
+	// saved, e.g. to avoid recording 5xx responses. In ModeRecordOnly, the
+	// request is still sent, and the response isn't recorded. In
+	// ModeRecordIfMissing, the next request for the same recording is sent
+	// again. It isn't called for transport errors, which are recorded
+	// according to RecordErrors.
+	ShouldRecord func(*http.Request, *http.Response) bool
+	// RecordStatuses, if not empty, are the status codes of the live
+	// responses that are recorded, as codes, such as "404", classes, such as
+	// "2xx", or inclusive ranges, such as "500-503". Other responses are
+	// returned without being recorded, as for ShouldRecord, e.g. to keep
+	// transient 502 and 503 responses out of recordings. RoundTrip returns
+	// an *Error instead of sending a request if any of them is invalid.
+	RecordStatuses []string
+	// MaxBodySize, if greater than zero, is the size of the largest body, in
+	// bytes, that is recorded. If the body of a live response is larger,
+	// nothing is saved, and the response is returned with its whole body;
+	// at most MaxBodySize bytes of it are read before it is returned. An
+	// *Error wrapping ErrRecordingTooLarge is passed to OnRecordError, and
+	// logged, so that it is clear that nothing was saved. If StreamRecord is
+	// true, the body is returned as usual, and the recording is abandoned
+	// once it exceeds the limit. Existing recordings are played back
+	// whatever their size.
+	MaxBodySize int64
+	// IgnoreFaults, if true, plays back recordings without the faults that
+	// their InjectError, DelayMS, TruncateBodyAt and BodyError fields
+	// simulate, so that the same recordings can be played back cleanly,
+	// e.g. for clients that don't handle the faults.
+	IgnoreFaults bool
+	// RecordErrors, if true, causes errors returned by the wrapped RoundTripper
+	// to be recorded. Playing back such a recording returns a *RecordedError
+	// instead of a response. Errors caused by the request's context being
+	// canceled or reaching its deadline aren't recorded, since they are
+	// caused by the client rather than the server.
+	RecordErrors bool
+	// RecordTLS, if true, saves the negotiated TLS version, cipher suite and
+	// peer certificate subjects of HTTPS responses in recordings. Replayed
+	// HTTPS responses always have a non-nil TLS field, but placeholder values
+	// are used for anything that wasn't recorded.
+	RecordTLS bool
+	// CollapseRedirects, if true, causes redirects to be followed when
+	// recording, and the final response to be recorded for the original
+	// request. Intermediate responses aren't recorded. By default, the
+	// *http.Client follows redirects, and each response in a redirect chain,
+	// including its Location header, is recorded for its own request.
+	CollapseRedirects bool
+	// CookieRewrite, if not nil, is used to rewrite the Set-Cookie headers of
+	// played back responses.
+	CookieRewrite *CookieRewrite
+	// RewriteLocation maps hosts to the hosts that replace them in absolute
+	// URLs in the Location and Content-Location headers of played back
+	// responses, so that redirects recorded against a real server lead back
+	// to the server that the code under test is using, e.g. an httptest
+	// server. Keys and values include the port, if any, as in URL.Host. A
+	// value may also include a scheme, e.g. "http://127.0.0.1:8080", to
+	// replace that as well. Relative URLs are unchanged, and recordings
+	// aren't modified.
+	RewriteLocation map[string]string
+	// BodyRewrites are applied in order to the bodies of played back
+	// responses with a textual Content-Type, such as JSON, and no
+	// Content-Encoding, e.g. to replace the host in absolute URLs with that
+	// of a local server. The Content-Length is corrected, and recordings
+	// aren't modified.
+	BodyRewrites []BodyRewrite
+	// RecordBodyRewrites are applied in the same way to the bodies of new
+	// recordings before they are saved, but not to the live responses, e.g.
+	// to replace a real host with a placeholder that BodyRewrites replaces
+	// on playback, so that recordings work in any environment.
+	RecordBodyRewrites []BodyRewrite
+	// FreshenDate, if true, sets the Date header of played back responses to
+	// the current time, adding one if the recording has none, so that
+	// clients that check the age of responses or clock skew see a recent
+	// date. Recordings aren't modified.
+	FreshenDate bool
+	// FreshenHeaders, if not nil, is called with a copy of the headers of
+	// each played back response, after FreshenDate is applied, e.g. to move
+	// Expires or Last-Modified forward by the age of the recording.
+	FreshenHeaders func(http.Header)
+	// StreamRecord, if true, returns responses to the caller as they are
+	// received while recording, instead of reading the whole body first. The
+	// body is copied to a temporary file as it is read, and the recording is
+	// saved once it has been read completely. If the body is closed before
+	// then, nothing is saved. Other requests for the same recording wait
+	// until the body has been read or closed, so it must always be closed.
+	StreamRecord bool
+	// RecordChunks, if not nil, is called with each response that is
+	// recorded, and if it returns true, the body is recorded as chunks with
+	// the time at which each was received, e.g. for IsEventStream. Such
+	// recordings are played back with the same timing. The response is
+	// returned once the body has been read completely, unless StreamRecord
+	// is true, in which case RecordChunks is ignored.
+	RecordChunks func(*http.Response) bool
+	// OmitResponseHeaders is a set of response headers and trailers that
+	// aren't saved in new recordings, e.g. DefaultOmitResponseHeaders. The
+	// live response returned while recording still has them.
+	OmitResponseHeaders StringSet
+	// FilterResponse, if not nil, is called with each new recording before it
+	// is saved, after OmitResponseHeaders is applied. It may modify the
+	// recording's headers, which are copies of those of the live response.
+	// Body is shared with the live response, and may be replaced but must not
+	// be modified. Body is nil if StreamRecord is true, or if the body is
+	// recorded as Chunks.
+	FilterResponse func(*Recording)
+	// OnReplay, if not nil, is called when a recording is played back, with
+	// the path it was loaded from. Body is not set in rec unless
+	// CacheRecordings is true. Like OnRecord and OnMiss, it is called in the
+	// goroutine that called RoundTrip, and must not modify rec. A panic in any
+	// of them is recovered, and RoundTrip returns it as an *Error.
+	OnReplay func(req *http.Request, path string, rec *Recording)
+	// OnRecord, if not nil, is called when a new recording has been saved. If
+	// StreamRecord is true, it is called by the goroutine that reads the end
+	// of the body, and a panic is returned as an error by Read.
+	OnRecord func(req *http.Request, path string, rec *Recording)
+	// OnMiss, if not nil, is called when there is no recording for a request
+	// in ModePlaybackOnly.
+	OnMiss func(req *http.Request, err *NotFoundError)
+	// OnRecordError, if not nil, is called when a live response is returned
+	// without being recorded to path because of err, an *Error wrapping
+	// ErrRecordingTooLarge, because of MaxBodySize. Like OnRecord, it may be
+	// called by the goroutine that reads the body if StreamRecord is true.
+	OnRecordError func(req *http.Request, path string, err error)
+	// TrackUsage, if true, keeps track of which recordings are played back or
+	// recorded, for UsedRecordings and UnusedRecordings. A response played
+	// back from the path without a checksum counts as usage of that path.
+	TrackUsage bool
+	// EnableTemplates, if true, causes the header values of played back
+	// recordings that contain "{{", and their bodies if they are text, to be
+	// executed as text/template templates, e.g. to make timestamps relative
+	// to the current time:
+	//	"expires_at": "{{ now.Add "1h" | rfc3339 }}"
+	// The functions available are:
+	//	now: the current time, which has an Add method that takes a
+	//	     duration string, and the methods of time.Time, e.g. Format
+	//	rfc3339: formats a time as RFC 3339, in UTC
+	//	unix: converts a time to seconds since the Unix epoch
+	//	env: returns the value of an environment variable
+	// Bodies are only executed if their Content-Type is textual and they
+	// have no Content-Encoding, as for BodyRewrites, so that binary bodies
+	// that happen to contain "{{" are left alone. Bodies are read into
+	// memory when templates are enabled. Errors in templates are returned as
+	// an *Error naming the recording's path.
+	EnableTemplates bool
+	// BytesPerSecond, if greater than zero, limits the rate at which the
+	// bodies of played back responses can be read, to simulate a slow
+	// connection. Reads fail with the error of the request's context once it
+	// is done. The default is no limit.
+	BytesPerSecond int
+	// CacheRecordings, if true, keeps recordings in memory once they have been
+	// loaded, so that they aren't read from disk again each time they are
+	// played back. Recordings saved by the RoundTripper replace cached ones,
+	// but changes made to the files by other means aren't seen.
+	CacheRecordings bool
+	// CacheSize, if greater than zero, limits the total size of the bodies of
+	// cached recordings, in bytes. The least recently used recordings are
+	// removed from the cache first.
+	CacheSize int64
+	// VerifyHeaders is the set of response headers compared in ModeVerify, in
+	// addition to the status code and body.
+	VerifyHeaders StringSet
+	// NormalizeBody, if not nil, is applied to the bodies of the recorded and
+	// live responses before they are compared in ModeVerify, e.g. to remove
+	// fields that change on every request. See NormalizeJSON.
+	NormalizeBody func(res *http.Response, body []byte) []byte
+	// OnDrift, if not nil, is called in ModeVerify for each request whose
+	// live response differs from its recording. It is called like OnReplay.
+	OnDrift func(req *http.Request, drift *Drift)
+	// SaveHandled, if true, causes the recordings returned by handlers
+	// registered with Handle to be saved, unless the Mode is
+	// ModePlaybackOnly or ModeVerify. They are saved like live responses,
+	// after OmitResponseHeaders, FilterResponse and RecordBodyRewrites are
+	// applied.
+	SaveHandled bool
+	// ManifestPath, if not empty, is the path of a manifest, as written by
+	// WriteManifest, that is updated each time a recording is saved. Paths in
+	// the manifest are relative to its directory, which is usually Dir.
+	// Requests are reconstructed in the layout of the PathGenerator, and left
+	// out if KeyFunc or Pather is set.
+	ManifestPath string
+	// Logger, if not nil, is used to log what RoundTrip does with each
+	// request. Messages and their attributes are:
+	//	"replay path" (debug): method, url, path, checksum
+	//	"replay passthrough" (debug): method, url
+	//	"replay hit" (debug): path, generic
+	//	"replay miss" (info): method, url, paths
+	//	"replay live" (info): method, url
+	//	"replay saved" (info): path, bytes
+	//	"replay not saved" (info): path, status
+	//	"replay too large" (warn): path, limit
+	//	"replay rerecord" (info): path, status
+	//	"replay rerecord corrupt" (warn): path, error
+	//	"replay handled" (debug): pattern
+	// where path is the path of the recording with the checksum for "replay
+	// path", and the path it was loaded from or saved to otherwise, status is
+	// the status code of a recording replaced because of ReRecordOn, or of a
+	// response that wasn't saved because of ShouldRecord, RecordStatuses or
+	// MaxReplays, error is why a recording replaced because of
+	// ReRecordCorrupt is corrupt, generic reports whether that is the path
+	// without a checksum, bytes is the size of the saved body, limit is
+	// MaxBodySize, and pattern is that of the handler registered with Handle
+	// that responded.
+	Logger *slog.Logger
+
+	counters counters
+	defaults sync.Once
+	mu       sync.Mutex
+	locks    map[string]*pathLock
+	used     StringSet
+	cache    *recordingCache
+	drifts   []Drift
+	// onMiss, if not nil, is called with the paths that were searched when a
+	// recording isn't found in ModePlaybackOnly.
+	onMiss func(req *http.Request, paths []string)
+	// verifyAllUsed is set by WithVerifyAllUsed.
+	verifyAllUsed bool
+	// replays counts the replays of recordings with MaxReplays, by path,
+	// and usedUp is the set of paths whose replays are used up.
+	replays map[string]int
+	usedUp  StringSet
+	// keys maps the keys returned by KeyFunc to the requests they were
+	// returned for, if TrackUsage is true.
+	keys map[string]StringSet
+	// handlers are registered by Handle.
+	handlers []*handler
+	// manifestMu serializes updates to the manifest at ManifestPath.
+	manifestMu sync.Mutex
 }
 
 // RoundTrip wraps the underyling RoundTrip implementation in order to enable
 // loading or recording HTTP server responses.
 func (r *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	recordingPath, err := r.PathGenerator.RecordingPath(req)
+	r.defaults.Do(r.setDefaults)
+	if IsUpgradeRequest(req) || (r.Passthrough != nil && r.Passthrough(req)) {
+		if r.Logger != nil {
+			r.Logger.DebugContext(req.Context(), "replay passthrough",
+				"method", req.Method, "url", req.URL.String())
+		}
+		r.counters.passthrough.Add(1)
+		return r.RoundTripper.RoundTrip(req)
+	}
+	res, err := r.roundTrip(req)
+	if err != nil {
+		var recorded *RecordedError
+		var injected *InjectedError
+		if !errors.Is(err, ErrRecordingNotFound) && !errors.As(err, &recorded) &&
+			!errors.As(err, &injected) {
+			r.counters.errors.Add(1)
+		}
+	}
+	return res, err
+}
+
+// roundTrip plays back or records the response for req.
+func (r *RoundTripper) roundTrip(req *http.Request) (*http.Response, error) {
+	if !r.Mode.valid() {
+		return nil, &Error{Request: req, Err: fmt.Errorf("replay: invalid Mode %d", int(r.Mode))}
+	}
+	if err := req.Context().Err(); err != nil {
+		return nil, &Error{Request: req, Err: err}
+	}
+
+	recordingPath, err := r.recordingPath(req)
 	if err != nil {
 		return nil, &Error{Request: req, Err: err}
 	}
 
-	path := filepath.Join(r.Dir, recordingPath.Path())
-	genericPath := filepath.Join(r.Dir, recordingPath.GenericPath())
+	subdir := r.subdir(req)
+	// Recordings are searched for at each of paths in order, and new ones are
+	// saved to path.
+	path := filepath.Join(r.recordDir(subdir), recordingPath.Path())
+	var paths []string
+	for _, dir := range r.searchDirs() {
+		dir = filepath.Join(dir, subdir)
+		crcPath := filepath.Join(dir, recordingPath.Path())
+		genericPath := filepath.Join(dir, recordingPath.GenericPath())
+		paths = append(paths, crcPath)
+		if !r.StrictPath && genericPath != crcPath {
+			paths = append(paths, genericPath)
+		}
+	}
+	if r.AnyHostFallback {
+		for _, dir := range r.searchDirs() {
+			dir = filepath.Join(dir, subdir)
+			crcPath, ok := recordingPath.AnyHostPath(false)
+			if !ok {
+				break
+			}
+			genericPath, _ := recordingPath.AnyHostPath(true)
+			paths = append(paths, filepath.Join(dir, crcPath))
+			if !r.StrictPath && genericPath != crcPath {
+				paths = append(paths, filepath.Join(dir, genericPath))
+			}
+		}
+	}
+	if r.Logger != nil {
+		r.Logger.DebugContext(req.Context(), "replay path",
+			"method", req.Method, "url", req.URL.String(),
+			"path", paths[0], "checksum", recordingPath.checksum)
+	}
 
+	playbackOnly := r.Mode == ModePlaybackOnly || r.Mode == ModeVerify
 	if r.Mode != ModeRecordOnly {
-		rec, err := LoadRecording(path)
-		if !r.StrictPath && genericPath != path && os.IsNotExist(err) {
-			rec, err = LoadRecording(genericPath)
+		if h := r.handler(recordingPath); h != nil {
+			res, err := r.handle(req, h, path)
+			if err != errReplaysUsedUp {
+				return res, err
+			}
 		}
-		if err == nil {
-			return rec.Response(), nil
+		res, loaded, err := r.load(req, paths, recordingPath.checksum)
+		var notFound *NotFoundError
+		isNotFound := errors.As(err, &notFound)
+		if r.Mode == ModeVerify && loaded != "" {
+			return r.verify(req, loaded, res, err)
+		}
+		if playbackOnly && isNotFound {
+			r.counters.misses.Add(1)
+			if r.Logger != nil {
+				r.Logger.InfoContext(req.Context(), "replay miss",
+					"method", req.Method, "url", req.URL.String(),
+					"paths", notFound.Paths)
+			}
+			if r.OnMiss != nil {
+				if herr := r.callHook(req, "OnMiss", func() {
+					r.OnMiss(req, notFound)
+				}); herr != nil {
+					return nil, herr
+				}
+			}
+			if r.MissingHandler != nil {
+				return r.missing(req, notFound)
+			}
+			if r.onMiss != nil {
+				r.onMiss(req, notFound.Paths)
+			}
+		}
+		if playbackOnly || !(isNotFound || err == errReRecord) {
+			return res, err
+		}
+	}
+
+	// Only one request records a given path at a time. If Coalesce is true,
+	// any others that were waiting replay the new recording, so concurrent
+	// identical requests result in a single upstream request.
+	unlock := r.lockPath(path)
+	if r.Coalesce && r.Mode == ModeRecordIfMissing {
+		res, _, err := r.load(req, paths, recordingPath.checksum)
+		if !errors.Is(err, ErrRecordingNotFound) && err != errReRecord {
+			unlock()
+			return res, err
 		}
-		if r.Mode == ModePlaybackOnly || !os.IsNotExist(err) {
+	}
+
+	return r.record(req, path, unlock)
+}
+
+// setDefaults sets the PathGenerator to NewPathGenerator() and the wrapped
+// RoundTripper to http.DefaultTransport if they are nil, so that a RoundTripper
+// can be used without setting them.
+func (r *RoundTripper) setDefaults() {
+	if r.PathGenerator == nil {
+		r.PathGenerator = NewPathGenerator()
+	}
+	if r.RoundTripper == nil {
+		r.RoundTripper = http.DefaultTransport
+	}
+}
+
+// ReRecordErrorsOlderThan returns a function that can be used as the ReRecordOn
+// field of RoundTripper, which replaces recordings of responses with 4xx or 5xx
+// status codes, or of transport errors, that were saved more than age ago.
+func ReRecordErrorsOlderThan(age time.Duration) func(*Recording) bool {
+	return func(rec *Recording) bool {
+		isError := rec.Error != nil || rec.StatusCode >= 400
+		return isError && !rec.ModTime().IsZero() && time.Since(rec.ModTime()) > age
+	}
+}
+
+// IsUpgradeRequest reports whether req asks to switch protocols, e.g. to
+// WebSocket, with the Connection and Upgrade headers.
+func IsUpgradeRequest(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header["Connection"] {
+		for _, token := range splitHeaderList(v) {
+			if strings.EqualFold(token, "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// searchDirs returns the directories that recordings are read from, in order.
+// New recordings are saved to the first, unless RecordDir is set, or it is
+// BaseDir.
+func (r *RoundTripper) searchDirs() []string {
+	dirs := r.dirs()
+	if r.OverlayDir == "" && r.BaseDir == "" {
+		return dirs
+	}
+	if len(dirs) == 1 && dirs[0] == "" {
+		// Dir is only searched along with the layers if it is set.
+		dirs = nil
+	}
+	if r.OverlayDir != "" {
+		dirs = append([]string{r.OverlayDir}, dirs...)
+	}
+	if r.BaseDir != "" {
+		dirs = append(dirs, r.BaseDir)
+	}
+	return dirs
+}
+
+// dirs returns Dir, or PlaybackDir if it is set, followed by Dirs.
+func (r *RoundTripper) dirs() []string {
+	dir := r.Dir
+	if r.PlaybackDir != "" {
+		dir = r.PlaybackDir
+	}
+	if len(r.Dirs) == 0 {
+		return []string{dir}
+	}
+	if dir == "" {
+		return r.Dirs
+	}
+	return append([]string{dir}, r.Dirs...)
+}
+
+// subdir returns the result of SubdirFunc for req, or "" if it is nil.
+func (r *RoundTripper) subdir(req *http.Request) string {
+	if r.SubdirFunc == nil {
+		return ""
+	}
+	return r.SubdirFunc(req)
+}
+
+// recordDir returns the directory that new recordings are saved to, including
+// subdir: RecordDir, or else OverlayDir, or else the first directory searched
+// other than BaseDir.
+func (r *RoundTripper) recordDir(subdir string) string {
+	dir := r.RecordDir
+	if dir == "" {
+		dir = r.OverlayDir
+	}
+	if dir == "" {
+		dir = r.dirs()[0]
+	}
+	return filepath.Join(dir, subdir)
+}
+
+// missing returns the result of MissingHandler for req.
+func (r *RoundTripper) missing(req *http.Request, err *NotFoundError) (*http.Response, error) {
+	res, herr := r.MissingHandler(req, err)
+	if res != nil && res.Request == nil {
+		res.Request = req
+	}
+	return res, herr
+}
+
+// StatusRecordingNotFound is the status code of the responses returned by
+// MissingRecordingResponse. It is outside the range of standard status codes,
+// so that it can't be mistaken for a response from a real server.
+const StatusRecordingNotFound = 599
+
+// MissingRecordingResponse returns a plain text response with the status
+// StatusRecordingNotFound and a body describing err, which names the paths that
+// were searched. It can be used as the MissingHandler of a RoundTripper.
+func MissingRecordingResponse(req *http.Request, err *NotFoundError) (*http.Response, error) {
+	body := err.Error() + "\n"
+	return &http.Response{
+		Status:     fmt.Sprintf("%d Recording Not Found", StatusRecordingNotFound),
+		StatusCode: StatusRecordingNotFound,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":   {"text/plain; charset=utf-8"},
+			"Content-Length": {strconv.Itoa(len(body))},
+		},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		Request:       req,
+	}, nil
+}
+
+// recordingPath returns the recording path for req, generated from the request
+// returned by RewriteRequest if it is set, with KeyFunc if it returns a key.
+func (r *RoundTripper) recordingPath(req *http.Request) (*RecordingPath, error) {
+	req, err := r.rewrittenRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	key, err := r.key(req)
+	if err != nil {
+		return nil, err
+	} else if key != "" {
+		r.noteKey(key, req)
+		return r.PathGenerator.keyPath(key), nil
+	}
+	if r.Pather != nil {
+		return r.Pather.RecordingPath(req)
+	}
+	return r.PathGenerator.RecordingPath(req)
+}
+
+// key returns the result of KeyFunc for req, or "" if it is nil.
+func (r *RoundTripper) key(req *http.Request) (string, error) {
+	if r.KeyFunc == nil {
+		return "", nil
+	}
+	return r.KeyFunc(req)
+}
+
+// explain returns the Explanation of the path of req, after RewriteRequest is
+// applied.
+func (r *RoundTripper) explain(req *http.Request) (Explanation, error) {
+	req, err := r.rewrittenRequest(req)
+	if err != nil {
+		return Explanation{}, err
+	}
+	key, err := r.key(req)
+	if err != nil {
+		return Explanation{}, err
+	} else if key != "" {
+		e := explainPath(req, r.PathGenerator.keyPath(key))
+		e.Key = key
+		return e, nil
+	}
+	if r.Pather != nil {
+		rp, err := r.Pather.RecordingPath(req)
+		if err != nil {
+			return Explanation{}, err
+		}
+		return explainPath(req, rp), nil
+	}
+	return r.PathGenerator.Explain(req)
+}
+
+// fingerprint returns the fingerprint of req, after RewriteRequest is applied.
+func (r *RoundTripper) fingerprint(req *http.Request) (*RecordedRequest, error) {
+	req, err := r.rewrittenRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return r.PathGenerator.RequestFingerprint(req)
+}
+
+// rewrittenRequest returns the result of applying RewriteRequest to a clone of
+// req, or req itself if RewriteRequest is nil.
+func (r *RoundTripper) rewrittenRequest(req *http.Request) (*http.Request, error) {
+	if r.RewriteRequest == nil {
+		return req, nil
+	}
+	clone := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if err := bufferBody(req); err != nil {
 			return nil, err
 		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			clone.Body = body
+		}
+	}
+	return r.RewriteRequest(clone), nil
+}
+
+// errReRecord is returned by load if ReRecordOn returns true for the recording.
+var errReRecord = errors.New("replay: recording must be replaced")
+
+// errReplaysUsedUp is returned by loadOnce if another request used up the
+// replays of the recording it loaded first.
+var errReplaysUsedUp = errors.New("replay: replays of recording used up")
+
+// load returns the response for req from the first of paths that exists, and
+// the path it was loaded from. Recordings whose MaxReplays are used up are
+// treated as if they didn't exist. See loadOnce.
+func (r *RoundTripper) load(
+	req *http.Request, paths []string, checksum string,
+) (*http.Response, string, error) {
+	for {
+		// The recording whose replays were used up is skipped next time.
+		res, path, err := r.loadOnce(req, paths, checksum)
+		if err != errReplaysUsedUp {
+			return res, path, err
+		}
 	}
+}
 
-	res, err := r.RoundTripper.RoundTrip(req)
+// loadOnce returns the response for req from the first of paths that exists, and
+// the path it was loaded from. Errors loading the recording are returned as an
+// *Error, which wraps a *NotFoundError if none of the paths exist. The checksum
+// calculated for req is included in the *NotFoundError. An error recorded with
+// RecordErrors, or errReRecord, is returned as is, along with the path. If the
+// context of req is done while waiting for the DelayMS of the recording, a
+// *delayError is returned. A replay of a recording with MaxReplays is only
+// counted once it has been accepted, and errReplaysUsedUp is returned if there
+// are none left by then.
+func (r *RoundTripper) loadOnce(
+	req *http.Request, paths []string, checksum string,
+) (*http.Response, string, error) {
+	var (
+		path string
+		rec  *Recording
+		body io.ReadCloser
+		size int64
+		err  error
+	)
+	if r.MatchVariants {
+		path, rec, body, size, err = r.loadVariant(req, paths)
+		if err != nil {
+			return nil, "", &Error{Request: req, Err: err, Path: path}
+		}
+	}
+	for i := 0; rec == nil && i < len(paths); i++ {
+		path = paths[i]
+		// Unless CacheRecordings is true, the body is streamed from the
+		// file, so large recordings aren't loaded into memory.
+		rec, body, size, err = r.loadRecording(path)
+		if err == nil && (r.MatchVariants && rec.Match != nil || r.replaysUsedUp(path)) {
+			// Variants that match were found by loadVariant.
+			body.Close()
+			rec, err = nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+		if !os.IsNotExist(err) {
+			break
+		}
+	}
+	if os.IsNotExist(err) {
+		err = &NotFoundError{
+			Method:   req.Method,
+			URL:      req.URL.String(),
+			Paths:    paths,
+			Checksum: checksum,
+			Err:      err,
+		}
+		if r.Verbose {
+			if explanation, explainErr := r.explain(req); explainErr == nil {
+				err.(*NotFoundError).Explanation = &explanation
+			}
+		}
+		// There is no single path to report.
+		path = ""
+	}
+	if err != nil && r.Mode == ModeRecordIfMissing && r.ReRecordCorrupt &&
+		errors.Is(err, ErrCorruptRecording) {
+		if r.Logger != nil {
+			r.Logger.WarnContext(req.Context(), "replay rerecord corrupt",
+				"path", path, "error", err)
+		}
+		return nil, path, errReRecord
+	}
 	if err != nil {
+		return nil, "", &Error{Request: req, Err: err, Path: path}
+	}
+	// Reading the body stops if the request is cancelled.
+	body = newContextBody(req, path, body)
+	if r.Mode == ModeRecordIfMissing && r.ReRecordOn != nil && r.ReRecordOn(rec) {
+		body.Close()
+		if r.Logger != nil {
+			r.Logger.InfoContext(req.Context(), "replay rerecord",
+				"path", path, "status", rec.StatusCode)
+		}
+		return nil, path, errReRecord
+	}
+	if r.VerifyRequest {
+		if err = r.verifyRequest(req, path, rec); err != nil {
+			body.Close()
+			return nil, "", err
+		}
+	}
+	return r.replay(req, path, rec, body, size,
+		filepath.Base(path) != filepath.Base(paths[0]))
+}
+
+// replay returns the response for req played back from rec, loaded from path,
+// or returned by a handler for it, with the given body and size. generic
+// reports whether path is the generic path, without a checksum. It returns
+// errReplaysUsedUp if rec can't be played back again because of MaxReplays.
+func (r *RoundTripper) replay(
+	req *http.Request, path string, rec *Recording, body io.ReadCloser, size int64,
+	generic bool,
+) (*http.Response, string, error) {
+	var err error
+	if !r.claimReplay(path, rec) {
+		body.Close()
+		return nil, path, errReplaysUsedUp
+	}
+	r.markUsed(path)
+	r.counters.replayed.Add(1)
+	if r.Logger != nil {
+		r.Logger.DebugContext(req.Context(), "replay hit", "path", path,
+			"generic", generic)
+	}
+	if r.OnReplay != nil {
+		if err = r.callHook(req, "OnReplay", func() {
+			r.OnReplay(req, path, rec)
+		}); err != nil {
+			body.Close()
+			return nil, "", err
+		}
+	}
+	if r.IgnoreFaults {
+		rec.InjectError, rec.DelayMS = nil, 0
+	}
+	if rec.DelayMS > 0 {
+		if err = delay(req.Context(), time.Duration(rec.DelayMS)*time.Millisecond, path); err != nil {
+			body.Close()
+			return nil, "", err
+		}
+	}
+	if rec.InjectError != nil {
+		body.Close()
+		return nil, path, rec.InjectError
+	}
+	if rec.Error != nil {
+		body.Close()
+		return nil, path, rec.Error
+	}
+	if r.EnableTemplates {
+		if body, size, err = executeTemplates(path, rec, body); err != nil {
+			return nil, "", &Error{Request: req, Err: err, Path: path}
+		}
+	}
+	if len(r.BodyRewrites) > 0 && len(rec.Chunks) == 0 {
+		if body, size, err = r.rewritePlaybackBody(rec, body, size); err != nil {
+			return nil, "", &Error{Request: req, Err: err, Path: path}
+		}
+	}
+	if len(rec.Chunks) > 0 {
+		body.Close()
+		body = newChunkBody(req.Context(), rec.Chunks)
+		size = chunksSize(rec.Chunks)
+	}
+	if err := rec.bodyError(); err != nil && !r.IgnoreFaults {
+		body = newFaultyBody(body, rec.TruncateBodyAt, err)
+	}
+	if r.BytesPerSecond > 0 {
+		body = newThrottledBody(req.Context(), body, r.BytesPerSecond)
+	}
+	if req.Method == http.MethodHead {
+		// Recordings made before NoBody was added may have a body.
+		rec.NoBody = true
+	}
+	res := rec.response(body, size)
+	// The request is needed to resolve relative Location headers.
+	res.Request = req
+	if r.CookieRewrite != nil && len(res.Header["Set-Cookie"]) > 0 {
+		res.Header = res.Header.Clone()
+		r.CookieRewrite.Rewrite(res.Header)
+	}
+	if len(r.RewriteLocation) > 0 {
+		r.rewriteLocation(res)
+	}
+	if r.FreshenDate || r.FreshenHeaders != nil {
+		res.Header = res.Header.Clone()
+		if res.Header == nil {
+			res.Header = make(http.Header)
+		}
+		if r.FreshenDate {
+			res.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		}
+		if r.FreshenHeaders != nil {
+			r.FreshenHeaders(res.Header)
+		}
+	}
+	if req.URL.Scheme == "https" {
+		res.TLS = rec.TLS.ConnectionState(req)
+	}
+	return res, path, nil
+}
+
+// rewriteLocation rewrites the hosts in the Location and Content-Location
+// headers of res according to RewriteLocation.
+func (r *RoundTripper) rewriteLocation(res *http.Response) {
+	cloned := false
+	for _, name := range []string{"Location", "Content-Location"} {
+		values := res.Header[name]
+		for i, v := range values {
+			u, err := url.Parse(v)
+			if err != nil || !u.IsAbs() {
+				continue
+			}
+			to, ok := r.RewriteLocation[u.Host]
+			if !ok {
+				continue
+			}
+			if i := strings.Index(to, "://"); i >= 0 {
+				u.Scheme, to = to[:i], to[i+3:]
+			}
+			u.Host = to
+			if !cloned {
+				res.Header = res.Header.Clone()
+				values = res.Header[name]
+				cloned = true
+			}
+			values[i] = u.String()
+		}
+	}
+}
+
+// record fetches the response for req with the wrapped RoundTripper and saves
+// it to path. It calls unlock once the recording has been saved, or has failed.
+func (r *RoundTripper) record(req *http.Request, path string, unlock func()) (*http.Response, error) {
+	streaming := false
+	defer func() {
+		if !streaming {
+			unlock()
+		}
+	}()
+
+	statuses, err := parseStatusRanges(r.RecordStatuses)
+	if err != nil {
+		return nil, &Error{Request: req, Err: err}
+	}
+	if r.Logger != nil {
+		r.Logger.InfoContext(req.Context(), "replay live",
+			"method", req.Method, "url", req.URL.String())
+	}
+	var fingerprint *RecordedRequest
+	if r.SaveRequest {
+		if fingerprint, err = r.fingerprint(req); err != nil {
+			return nil, &Error{Request: req, Err: err}
+		}
+	}
+	var res *http.Response
+	if r.CollapseRedirects {
+		res, err = r.followRedirects(req)
+	} else {
+		res, err = r.RoundTripper.RoundTrip(req)
+	}
+	// A recording whose replays are used up is treated as missing, but
+	// isn't replaced, since it is usually written by hand.
+	usedUp := r.replaysUsedUp(path)
+	if err != nil {
+		if r.RecordErrors && !usedUp && !isContextError(req, err) {
+			rec := &Recording{Error: NewRecordedError(err), Request: fingerprint}
+			_, saveErr := r.saveTo(path, rec, bytes.NewReader(nil))
+			r.uncache(path)
+			if saveErr != nil {
+				return nil, &Error{Request: req, Err: saveErr, Path: path}
+			}
+			r.markUsed(path)
+			r.logSaved(req, path, 0)
+			if herr := r.recorded(req, path, rec); herr != nil {
+				return nil, herr
+			}
+		}
+		return nil, err
+	}
+	if usedUp || !r.shouldRecord(req, res, statuses) {
+		if r.Logger != nil {
+			r.Logger.InfoContext(req.Context(), "replay not saved",
+				"path", path, "status", res.StatusCode)
+		}
+		r.counters.passthrough.Add(1)
+		return res, nil
+	}
+	if r.StreamRecord && !(r.MaxBodySize > 0 && res.ContentLength > r.MaxBodySize) {
+		res, err = r.streamRecording(req, res, path, fingerprint, unlock)
+		streaming = err == nil
+		return res, err
+	}
+	chunked := !r.StreamRecord && r.RecordChunks != nil && r.RecordChunks(res)
+	rec, err := newLimitedRecording(res, chunked, r.MaxBodySize)
+	if err != nil {
+		return nil, &Error{Request: req, Response: res, Err: err, Path: path}
+	}
+	if rec == nil {
+		if err = r.tooLarge(req, res, path); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		return res, nil
+	}
+	rec.Request = fingerprint
+	if err = r.saveRecording(req, res, rec, path, nil); err != nil {
 		return nil, err
 	}
-	rec, err := NewRecording(res)
+	return res, nil
+}
+
+// shouldRecord reports whether res, the live response to req, is to be
+// recorded, according to statuses, parsed from RecordStatuses, and
+// ShouldRecord.
+func (r *RoundTripper) shouldRecord(req *http.Request, res *http.Response, statuses []statusRange) bool {
+	if len(statuses) > 0 && !matchStatus(statuses, res.StatusCode) {
+		return false
+	}
+	return r.ShouldRecord == nil || r.ShouldRecord(req, res)
+}
+
+// saveRecording saves rec for req and res to path. If body is not nil, the body
+// is read from it instead of rec.Body. res is nil for recordings returned by
+// handlers.
+func (r *RoundTripper) saveRecording(
+	req *http.Request, res *http.Response, rec *Recording, path string, body io.Reader,
+) error {
+	if r.RecordTLS && res != nil && res.TLS != nil {
+		rec.TLS = NewRecordedTLS(res.TLS)
+	}
+	// Copy the headers, so that filtering doesn't affect the live response.
+	rec.Headers = rec.Headers.Clone()
+	rec.Trailers = rec.Trailers.Clone()
+	for name := range r.OmitResponseHeaders {
+		rec.Headers.Del(name)
+		rec.Trailers.Del(name)
+	}
+	if r.FilterResponse != nil {
+		r.FilterResponse(rec)
+	}
+	if len(r.RecordBodyRewrites) > 0 && len(rec.Chunks) == 0 {
+		var err error
+		if body, err = r.rewriteRecordedBody(rec, body); err != nil {
+			return &Error{Request: req, Response: res, Err: err, Path: path}
+		}
+	}
+	if body == nil {
+		body = bytes.NewReader(rec.Body)
+	}
+	n, err := r.saveTo(path, rec, newContextReader(req.Context(), body))
+	r.uncache(path)
+	if err != nil {
+		return &Error{Request: req, Response: res, Err: err, Path: path}
+	}
+	r.markUsed(path)
+	r.logSaved(req, path, n)
+	return r.recorded(req, path, rec)
+}
+
+// isContextError reports whether err, returned for req, was caused by the
+// context of req being canceled or reaching its deadline.
+func isContextError(req *http.Request, err error) bool {
+	return req.Context().Err() != nil || errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// logSaved counts and logs the recording of req saved to path, with a body of n
+// bytes.
+func (r *RoundTripper) logSaved(req *http.Request, path string, n int64) {
+	r.counters.recorded.Add(1)
+	if r.Logger != nil {
+		r.Logger.InfoContext(req.Context(), "replay saved", "path", path, "bytes", n)
+	}
+}
+
+// recorded updates the manifest, if ManifestPath is set, and calls OnRecord,
+// if it is set, for the recording of req saved to path.
+func (r *RoundTripper) recorded(req *http.Request, path string, rec *Recording) error {
+	if err := r.updateManifest(req, path); err != nil {
+		return err
+	}
+	if r.OnRecord == nil {
+		return nil
+	}
+	return r.callHook(req, "OnRecord", func() {
+		r.OnRecord(req, path, rec)
+	})
+}
+
+// callHook calls f, which calls the named hook, and returns an *Error if it
+// panics.
+func (r *RoundTripper) callHook(req *http.Request, name string, f func()) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &Error{Request: req, Err: fmt.Errorf("replay: %s panicked: %v", name, v)}
+		}
+	}()
+	f()
+	return nil
+}
+
+// claimReplay reports whether rec, loaded from path, can be played back, and
+// counts the replay if it has a MaxReplays. Once its replays are used up, path
+// is reported by replaysUsedUp.
+func (r *RoundTripper) claimReplay(path string, rec *Recording) bool {
+	if rec.MaxReplays <= 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.replays == nil {
+		r.replays = make(map[string]int)
+		r.usedUp = NewStringSet()
+	}
+	if _, ok := r.usedUp[path]; ok {
+		return false
+	}
+	r.replays[path]++
+	if r.replays[path] >= rec.MaxReplays {
+		r.usedUp.Add(path)
+	}
+	return true
+}
+
+// replaysUsedUp reports whether the MaxReplays of the recording at path have
+// been used up, so that it is treated as if it didn't exist, and isn't
+// replaced by a new recording.
+func (r *RoundTripper) replaysUsedUp(path string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.usedUp[path]
+	return ok
+}
+
+func (r *RoundTripper) markUsed(path string) {
+	if !r.TrackUsage {
+		return
+	}
+	r.mu.Lock()
+	if r.used == nil {
+		r.used = NewStringSet()
+	}
+	r.used.Add(path)
+	r.mu.Unlock()
+}
+
+// UsedRecordings returns the paths of the recordings that have been played
+// back or recorded, in sorted order. Paths include Dir. Usage is only tracked
+// if TrackUsage is true.
+func (r *RoundTripper) UsedRecordings() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	used := make([]string, 0, len(r.used))
+	for path := range r.used {
+		used = append(used, path)
+	}
+	sort.Strings(used)
+	return used
+}
+
+// UnusedRecordings returns the paths of the recordings under Dir, or OverlayDir
+// if it is set, that haven't been played back or recorded, in sorted order. It
+// is only useful if TrackUsage is true.
+func (r *RoundTripper) UnusedRecordings() ([]string, error) {
+	dir := r.Dir
+	if r.OverlayDir != "" {
+		dir = r.OverlayDir
+	}
+	return ReportUnused(dir, r.UsedRecordings())
+}
+
+// VerifyAllUsed returns an error listing the recordings under Dir, or
+// OverlayDir if it is set, that haven't been played back or recorded, if there
+// are any. TrackUsage must be true.
+func (r *RoundTripper) VerifyAllUsed() error {
+	if !r.TrackUsage {
+		return errors.New("replay: VerifyAllUsed requires TrackUsage")
+	}
+	unused, err := r.UnusedRecordings()
 	if err != nil {
-		return nil, &Error{Request: req, Response: res, Err: err}
+		return err
+	}
+	if len(unused) > 0 {
+		return fmt.Errorf("replay: %d recordings were not used:\n\t%s",
+			len(unused), strings.Join(unused, "\n\t"))
+	}
+	return nil
+}
+
+// ReportUnused returns the paths of the recordings under dir that aren't in
+// used, in sorted order. Paths in used and the returned paths include dir. If
+// dir doesn't exist, there are no unused recordings.
+func ReportUnused(dir string, used []string) ([]string, error) {
+	usedSet := NewStringSet()
+	for _, path := range used {
+		usedSet.Add(filepath.Clean(path))
 	}
-	if err = rec.Save(path); err != nil {
-		return nil, &Error{Request: req, Response: res, Err: err}
+	var unused []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isRecordingFile(info.Name()) {
+			return err
+		}
+		if _, ok := usedSet[filepath.Clean(path)]; !ok {
+			unused = append(unused, path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		if _, statErr := os.Stat(dir); os.IsNotExist(statErr) {
+			err = nil
+		}
+	}
+	return unused, err
+}
+
+// followRedirects fetches the response for req with the wrapped RoundTripper,
+// following any redirects in the same way as an *http.Client.
+func (r *RoundTripper) followRedirects(req *http.Request) (*http.Response, error) {
+	client := &http.Client{Transport: r.RoundTripper}
+	res, err := client.Do(req)
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
 	}
 	return res, err
 }
 
+// lockPath acquires a lock for the given recording path, and returns a
+// function that releases it. Locks are removed once no goroutine holds or is
+// waiting for them.
+func (r *RoundTripper) lockPath(path string) func() {
+	r.mu.Lock()
+	if r.locks == nil {
+		r.locks = make(map[string]*pathLock)
+	}
+	l := r.locks[path]
+	if l == nil {
+		l = &pathLock{}
+		r.locks[path] = l
+	}
+	l.refs++
+	r.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		r.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(r.locks, path)
+		}
+		r.mu.Unlock()
+	}
+}
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
 // NewClient returns an *http.Client which will return pre-recorded responses if
 // the exists, or create new recordings if they are missing..
 func NewClient(dir string) *http.Client {
-	return &http.Client{
-		Transport: &RoundTripper{
-			Dir:           dir,
-			RoundTripper:  http.DefaultTransport,
-			PathGenerator: NewPathGenerator(),
-		},
-	}
+	return NewClientWithOptions(dir)
+}
+
+// NewOverlayClient returns an *http.Client like that returned by NewClient,
+// which plays back recordings from overlayDir, or from baseDir if they aren't
+// in overlayDir, and saves new recordings to overlayDir only. baseDir is never
+// modified, so it can be a read-only tree of shared recordings, with
+// overlayDir holding additions and overrides.
+func NewOverlayClient(baseDir, overlayDir string) *http.Client {
+	client := NewClient("")
+	rt := client.Transport.(*RoundTripper)
+	rt.BaseDir, rt.OverlayDir = baseDir, overlayDir
+	return client
 }
 
 // NewPlaybackOnlyClient returns an *http.Client which will only return pre-
 // recorded responses. If no response is found, an error is returned.
 func NewPlaybackOnlyClient(dir string) *http.Client {
-	client := NewClient(dir)
-	client.Transport.(*RoundTripper).Mode = ModePlaybackOnly
-	return client
+	return NewClientWithOptions(dir, WithMode(ModePlaybackOnly))
 }
 
 // NewRecordOnlyClient returns an *http.Client which will record new responses,
 // even if a pre-recorded response exists.
 func NewRecordOnlyClient(dir string) *http.Client {
-	client := NewClient(dir)
-	client.Transport.(*RoundTripper).Mode = ModeRecordOnly
-	return client
+	return NewClientWithOptions(dir, WithMode(ModeRecordOnly))
+}
+
+// ModeFromEnv returns the mode named by the environment variable key, such as
+// ModeEnv, as parsed by ParseMode. If the variable is unset or empty,
+// ModePlaybackOnly is returned, so that live requests are never made unless
+// asked for, e.g. in CI. An error is returned for any other value.
+func ModeFromEnv(key string) (Mode, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return ModePlaybackOnly, nil
+	}
+	mode, err := ParseMode(value)
+	if err != nil {
+		return 0, fmt.Errorf("replay: invalid %s %q", key, value)
+	}
+	return mode, nil
+}
+
+// NewClientFromEnv returns an *http.Client like NewClient, with the mode read
+// by ModeFromEnv from the ModeEnv environment variable, REPLAY_MODE, which
+// defaults to ModePlaybackOnly. It panics if the variable has an invalid
+// value, rather than making live requests unexpectedly.
+func NewClientFromEnv(dir string) *http.Client {
+	mode, err := ModeFromEnv(ModeEnv)
+	if err != nil {
+		panic(err)
+	}
+	return NewClientWithOptions(dir, WithMode(mode))
 }
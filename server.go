@@ -0,0 +1,65 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+)
+
+// NewServerHandler returns an http.Handler that serves responses for requests
+// as if they had been made to upstream, which is a URL with a scheme and host,
+// e.g. "https://api.example.com". Requests are rewritten to use the scheme and
+// host of upstream, and then passed to rt, so that their responses are played
+// back or recorded according to its Mode. If no recording exists and rt
+// doesn't record, a 404 Not Found response is returned with a body explaining
+// which recording was searched for. Other errors result in a 502 Bad Gateway
+// response.
+//
+// This allows using recordings with code that can't be given an *http.Client,
+// but can be given a base URL.
+func NewServerHandler(rt *RoundTripper, upstream *url.URL) http.Handler {
+	return &serverHandler{rt: rt, upstream: upstream}
+}
+
+// NewServer starts and returns a new *httptest.Server that plays back the
+// recordings in dir that were made for requests to upstream. See
+// NewServerHandler for details. The caller should call Close when finished,
+// to shut it down. NewServer panics if upstream can't be parsed.
+func NewServer(dir, upstream string) *httptest.Server {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		panic(fmt.Sprintf("replay: failed to parse upstream URL: %v", err))
+	}
+	rt := NewPlaybackOnlyClient(dir).Transport.(*RoundTripper)
+	return httptest.NewServer(NewServerHandler(rt, u))
+}
+
+type serverHandler struct {
+	rt       *RoundTripper
+	upstream *url.URL
+}
+
+func (s *serverHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	out.Host = ""
+	out.URL.Scheme = s.upstream.Scheme
+	out.URL.Host = s.upstream.Host
+	if req.ContentLength == 0 {
+		out.Body = nil
+	}
+	removeHopHeaders(out.Header)
+	res, err := s.rt.RoundTrip(out)
+	if errors.Is(err, ErrRecordingNotFound) {
+		http.Error(w, fmt.Sprintf("replay: no recording for %s %s: %v",
+			out.Method, out.URL, err), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeResponse(w, res)
+}
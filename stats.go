@@ -0,0 +1,57 @@
+package replay
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Stats are counts of what a RoundTripper has done with requests, since it was
+// created or since Reset was last called.
+type Stats struct {
+	// Replayed is the number of responses, or recorded errors, played back.
+	Replayed int64
+	// Recorded is the number of recordings saved.
+	Recorded int64
+	// LivePassthrough is the number of requests passed through to the
+	// wrapped RoundTripper without being played back or recorded, including
+	// those whose responses weren't recorded because of ShouldRecord or
+	// RecordStatuses.
+	LivePassthrough int64
+	// Misses is the number of requests without recordings in
+	// ModePlaybackOnly.
+	Misses int64
+	// Errors is the number of requests that failed for any other reason,
+	// e.g. a transport error while recording, or an invalid recording.
+	Errors int64
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("replayed %d, recorded %d, passed through %d, misses %d, errors %d",
+		s.Replayed, s.Recorded, s.LivePassthrough, s.Misses, s.Errors)
+}
+
+// counters are the counters behind Stats.
+type counters struct {
+	replayed, recorded, passthrough, misses, errors atomic.Int64
+}
+
+// Stats returns counts of what r has done with requests so far. It is safe to
+// call while requests are in progress.
+func (r *RoundTripper) Stats() Stats {
+	return Stats{
+		Replayed:        r.counters.replayed.Load(),
+		Recorded:        r.counters.recorded.Load(),
+		LivePassthrough: r.counters.passthrough.Load(),
+		Misses:          r.counters.misses.Load(),
+		Errors:          r.counters.errors.Load(),
+	}
+}
+
+// Reset sets the counts returned by Stats to zero.
+func (r *RoundTripper) Reset() {
+	r.counters.replayed.Store(0)
+	r.counters.recorded.Store(0)
+	r.counters.passthrough.Store(0)
+	r.counters.misses.Store(0)
+	r.counters.errors.Store(0)
+}
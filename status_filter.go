@@ -0,0 +1,68 @@
+package replay
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// statusRange is an inclusive range of status codes.
+type statusRange struct {
+	min, max int
+}
+
+// parseStatusRanges parses patterns as for RecordStatuses: a status code, such
+// as "404", a class of status codes, such as "2xx", or an inclusive range, such
+// as "500-503".
+func parseStatusRanges(patterns []string) ([]statusRange, error) {
+	ranges := make([]statusRange, 0, len(patterns))
+	for _, pattern := range patterns {
+		sr, ok := parseStatusRange(strings.TrimSpace(pattern))
+		if !ok {
+			return nil, fmt.Errorf("replay: invalid status %q in RecordStatuses", pattern)
+		}
+		ranges = append(ranges, sr)
+	}
+	return ranges, nil
+}
+
+func parseStatusRange(pattern string) (statusRange, bool) {
+	if len(pattern) == 3 && strings.EqualFold(pattern[1:], "xx") {
+		class := int(pattern[0] - '0')
+		if class < 1 || class > 5 {
+			return statusRange{}, false
+		}
+		return statusRange{class * 100, class*100 + 99}, true
+	}
+	from, to, isRange := strings.Cut(pattern, "-")
+	min, ok := parseStatusCode(from)
+	if !ok {
+		return statusRange{}, false
+	}
+	max := min
+	if isRange {
+		if max, ok = parseStatusCode(to); !ok || max < min {
+			return statusRange{}, false
+		}
+	}
+	return statusRange{min, max}, true
+}
+
+// parseStatusCode parses a three-digit status code.
+func parseStatusCode(s string) (int, bool) {
+	code, err := strconv.Atoi(s)
+	if err != nil || len(s) != 3 || code < 100 {
+		return 0, false
+	}
+	return code, true
+}
+
+// matchStatus reports whether code is in any of ranges.
+func matchStatus(ranges []statusRange, code int) bool {
+	for _, sr := range ranges {
+		if code >= sr.min && code <= sr.max {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package replay
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// streamRecording replaces the body of res with one that copies the body to a
+// temporary file as it is read, and saves the recording to path, with the
+// request fingerprint, if it isn't nil, once it has been read completely.
+// unlock is called once the recording has been saved or discarded. The
+// recording is discarded once the body exceeds MaxBodySize, if it is set.
+func (r *RoundTripper) streamRecording(
+	req *http.Request, res *http.Response, path string,
+	fingerprint *RecordedRequest, unlock func(),
+) (*http.Response, error) {
+	tmp, err := ioutil.TempFile("", "replay-body-*")
+	if err != nil {
+		res.Body.Close()
+		return nil, &Error{Request: req, Response: res, Err: err, Path: path}
+	}
+	res.Body = &recordingBody{
+		rt:          r,
+		req:         req,
+		res:         res,
+		body:        res.Body,
+		tmp:         tmp,
+		path:        path,
+		fingerprint: fingerprint,
+		unlock:      unlock,
+	}
+	return res, nil
+}
+
+// recordingBody is the response body returned when StreamRecord is true.
+type recordingBody struct {
+	rt   *RoundTripper
+	req  *http.Request
+	res  *http.Response
+	body io.ReadCloser
+	tmp  *os.File
+	path string
+	// fingerprint is saved with the recording.
+	fingerprint *RecordedRequest
+	unlock      func()
+
+	once sync.Once
+	err  error
+	// written is the number of bytes written to tmp, and tooLarge is set
+	// once the body has exceeded MaxBodySize, so that it is no longer
+	// copied.
+	written  int64
+	tooLarge bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.body.Read(p)
+	if max := b.rt.MaxBodySize; n > 0 && !b.tooLarge && max > 0 && b.written+int64(n) > max {
+		b.tooLarge = true
+		b.discard()
+		if herr := b.rt.tooLarge(b.req, b.res, b.path); herr != nil {
+			b.err = herr
+			return n, herr
+		}
+	}
+	if n > 0 && !b.tooLarge {
+		b.written += int64(n)
+		if _, werr := b.tmp.Write(p[:n]); werr != nil {
+			b.discard()
+			b.err = &Error{Request: b.req, Response: b.res, Err: werr, Path: b.path}
+			return n, b.err
+		}
+	}
+	if err == io.EOF && !b.tooLarge {
+		if ferr := b.finish(); ferr != nil {
+			err = ferr
+		}
+	}
+	if err != nil {
+		b.discard()
+		b.err = err
+	}
+	return n, err
+}
+
+// Close closes the upstream body. The recording is discarded if the body
+// hasn't been read completely. A body whose length is known is complete once
+// that many bytes have been read, even if EOF wasn't, as when a json.Decoder
+// stops reading at the end of a value.
+func (b *recordingBody) Close() error {
+	var ferr error
+	if b.err == nil && !b.tooLarge && b.res.ContentLength >= 0 &&
+		b.written == b.res.ContentLength {
+		ferr = b.finish()
+	}
+	err := b.body.Close()
+	b.discard()
+	if ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// finish saves the recording from the temporary file.
+func (b *recordingBody) finish() error {
+	var err error
+	b.once.Do(func() {
+		defer b.cleanup()
+		// Trailers are available now that the body has been read.
+		rec := newRecording(b.res)
+		rec.Request = b.fingerprint
+		if _, err = b.tmp.Seek(0, io.SeekStart); err != nil {
+			err = &Error{Request: b.req, Response: b.res, Err: err, Path: b.path}
+			return
+		}
+		err = b.rt.saveRecording(b.req, b.res, rec, b.path, b.tmp)
+	})
+	return err
+}
+
+// discard abandons the recording, if it hasn't been saved.
+func (b *recordingBody) discard() {
+	b.once.Do(b.cleanup)
+}
+
+func (b *recordingBody) cleanup() {
+	b.tmp.Close()
+	os.Remove(b.tmp.Name())
+	b.unlock()
+}
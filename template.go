@@ -0,0 +1,83 @@
+package replay
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateTime is the type of the time returned by the now template function.
+// Its Add method takes a duration string, e.g. {{ now.Add "1h" }}.
+type templateTime struct {
+	time.Time
+}
+
+func (t templateTime) Add(d string) (templateTime, error) {
+	dur, err := time.ParseDuration(d)
+	if err != nil {
+		return t, err
+	}
+	return templateTime{t.Time.Add(dur)}, nil
+}
+
+// templateFuncs are the functions available in templates in recordings. See
+// RoundTripper.EnableTemplates.
+var templateFuncs = template.FuncMap{
+	"now": func() templateTime {
+		return templateTime{time.Now()}
+	},
+	"rfc3339": func(t templateTime) string {
+		return t.UTC().Format(time.RFC3339)
+	},
+	"unix": func(t templateTime) int64 {
+		return t.Unix()
+	},
+	"env": os.Getenv,
+}
+
+// executeTemplates executes the templates in the header values of rec, and in
+// body, which is read and closed, if it is text that isn't compressed, as
+// reported by isRewritable. It returns the result of executing the body, and
+// its size. The templates are named after path, which is the path of the
+// recording.
+func executeTemplates(path string, rec *Recording, body io.ReadCloser) (io.ReadCloser, int64, error) {
+	content, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+	if isRewritable(rec.Headers) && bytes.Contains(content, []byte("{{")) {
+		if content, err = executeTemplate(path, string(content)); err != nil {
+			return nil, 0, err
+		}
+	}
+	for name, values := range rec.Headers {
+		for i, v := range values {
+			if !strings.Contains(v, "{{") {
+				continue
+			}
+			out, err := executeTemplate(path+":"+name, v)
+			if err != nil {
+				return nil, 0, err
+			}
+			values[i] = string(out)
+		}
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), int64(len(content)), nil
+}
+
+func executeTemplate(name, text string) ([]byte, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,94 @@
+package replay
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// WithVerifyAllUsed enables TrackUsage, and causes the test using a client
+// returned by NewTestClient to fail if any recordings in its directory weren't
+// used by the time it finishes. See RoundTripper.VerifyAllUsed.
+func WithVerifyAllUsed() Option {
+	return func(r *RoundTripper) {
+		r.TrackUsage = true
+		r.verifyAllUsed = true
+	}
+}
+
+// ModeEnv is the environment variable that NewTestClient and NewClientFromEnv
+// read the mode from. See ModeFromEnv for its values.
+const ModeEnv = "REPLAY_MODE"
+
+// NewTestClient returns an *http.Client for use in the test t. Recordings are
+// kept in the directory returned by DirForTest("testdata", t), i.e.
+// testdata/<test name>, with one subdirectory per subtest.
+//
+// The mode defaults to ModePlaybackOnly, so that tests never make live
+// requests unexpectedly, e.g. in CI. It is set to ModeRecordIfMissing if the
+// test binary defines a boolean -record flag that is true, or from the
+// REPLAY_MODE environment variable. Options are applied afterwards, so they
+// take precedence.
+//
+// If a recording is missing in ModePlaybackOnly, the test fails with an error
+// that includes the request method and URL and the paths that were searched,
+// and the request returns an error. A cleanup function registered with
+// t.Cleanup checks that every recording used by the test can be loaded, and
+// logs the Stats of the RoundTripper.
+func NewTestClient(t testing.TB, opts ...Option) *http.Client {
+	t.Helper()
+	rt := NewRoundTripper(DirForTest("testdata", t), WithMode(ModePlaybackOnly))
+	rt.TrackUsage = true
+	if f := flag.Lookup("record"); f != nil && f.Value.String() == "true" {
+		rt.Mode = ModeRecordIfMissing
+	}
+	if os.Getenv(ModeEnv) != "" {
+		mode, err := ModeFromEnv(ModeEnv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt.Mode = mode
+	}
+	for _, opt := range opts {
+		opt(rt)
+	}
+	client := &http.Client{Transport: rt}
+	rt.onMiss = func(req *http.Request, paths []string) {
+		// FailNow must only be called from the test's goroutine, and
+		// requests may be made from others, so Errorf is used instead.
+		t.Errorf("replay: no recording for %s %s (searched %s); "+
+			"run with %s=record-if-missing to record it",
+			req.Method, req.URL, strings.Join(paths, ", "), ModeEnv)
+	}
+
+	t.Cleanup(func() {
+		client.CloseIdleConnections()
+		t.Logf("replay: %v", rt.Stats())
+		for _, path := range rt.UsedRecordings() {
+			if _, err := LoadRecording(path); err != nil {
+				t.Errorf("replay: invalid recording %s: %v", path, err)
+			}
+		}
+		if rt.verifyAllUsed {
+			if err := rt.VerifyAllUsed(); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	return client
+}
+
+// DirForTest returns a directory under base for the recordings of t, with one
+// subdirectory per subtest, e.g. base/TestName/subtest. Each part of the test
+// name is escaped in the same way as the components of recording paths, so
+// that it is a valid filename on every platform.
+func DirForTest(base string, t testing.TB) string {
+	parts := strings.Split(t.Name(), "/")
+	for i := range parts {
+		parts[i] = escapePathComponent(parts[i])
+	}
+	return filepath.Join(append([]string{base}, parts...)...)
+}
@@ -0,0 +1,50 @@
+package replay
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// throttledBody is a response body that is read at no more than a given rate.
+type throttledBody struct {
+	io.ReadCloser
+	ctx   context.Context
+	rate  int
+	start time.Time
+	read  int64
+}
+
+// newThrottledBody returns body limited to rate bytes per second. Reads stop
+// waiting, and return the error of ctx, once ctx is done.
+func newThrottledBody(ctx context.Context, body io.ReadCloser, rate int) *throttledBody {
+	return &throttledBody{ReadCloser: body, ctx: ctx, rate: rate, start: time.Now()}
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	// Read at most a tenth of a second's worth at a time, so that data
+	// arrives steadily rather than in bursts.
+	max := b.rate / 10
+	if max < 1 {
+		max = 1
+	}
+	if len(p) > max {
+		p = p[:max]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	due := b.start.Add(time.Duration(b.read) * time.Second / time.Duration(b.rate))
+	if wait := time.Until(due); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-b.ctx.Done():
+			return n, b.ctx.Err()
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,219 @@
+package replay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RecordedTLS holds details of the TLS connection a response was received
+// over. It is saved in a Recording when the RecordTLS field of RoundTripper is
+// true, and used to populate the TLS field of replayed HTTPS responses.
+type RecordedTLS struct {
+	// Version is the negotiated TLS version name, e.g. "TLS 1.3".
+	Version string `json:"version,omitempty"`
+	// CipherSuite is the negotiated cipher suite name, as returned by
+	// tls.CipherSuiteName.
+	CipherSuite string `json:"cipher_suite,omitempty"`
+	// ServerName is the server name requested by the client.
+	ServerName string `json:"server_name,omitempty"`
+	// PeerCertificates describes the certificates presented by the server.
+	PeerCertificates []RecordedCertificate `json:"peer_certificates,omitempty"`
+}
+
+// RecordedCertificate describes a peer certificate. Only identifying fields
+// are kept, so replayed certificates can't be used for verification.
+// Subject is the distinguished name, as formatted by pkix.Name.String, which
+// is parsed back into the Subject of the replayed certificate.
+type RecordedCertificate struct {
+	Subject    string   `json:"subject,omitempty"`
+	CommonName string   `json:"common_name,omitempty"`
+	DNSNames   []string `json:"dns_names,omitempty"`
+}
+
+// NewRecordedTLS returns a RecordedTLS describing cs.
+func NewRecordedTLS(cs *tls.ConnectionState) *RecordedTLS {
+	t := &RecordedTLS{
+		Version:     tls.VersionName(cs.Version),
+		CipherSuite: tls.CipherSuiteName(cs.CipherSuite),
+		ServerName:  cs.ServerName,
+	}
+	for _, cert := range cs.PeerCertificates {
+		t.PeerCertificates = append(t.PeerCertificates, RecordedCertificate{
+			Subject:    cert.Subject.String(),
+			CommonName: cert.Subject.CommonName,
+			DNSNames:   cert.DNSNames,
+		})
+	}
+	return t
+}
+
+// ConnectionState returns a *tls.ConnectionState populated from t. Fields that
+// weren't recorded get placeholder values: TLS 1.3 with the
+// TLS_AES_128_GCM_SHA256 cipher suite, and the host of req as the server name.
+func (t *RecordedTLS) ConnectionState(req *http.Request) *tls.ConnectionState {
+	cs := &tls.ConnectionState{
+		Version:           tls.VersionTLS13,
+		HandshakeComplete: true,
+		CipherSuite:       tls.TLS_AES_128_GCM_SHA256,
+	}
+	if req != nil && req.URL != nil {
+		cs.ServerName = req.URL.Hostname()
+		if net.ParseIP(cs.ServerName) != nil {
+			cs.ServerName = ""
+		}
+	}
+	if t == nil {
+		return cs
+	}
+	if v, ok := tlsVersions[t.Version]; ok {
+		cs.Version = v
+	}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == t.CipherSuite {
+			cs.CipherSuite = suite.ID
+		}
+	}
+	if t.ServerName != "" {
+		cs.ServerName = t.ServerName
+	}
+	for _, cert := range t.PeerCertificates {
+		subject, err := parseDistinguishedName(cert.Subject)
+		if err != nil || cert.Subject == "" {
+			// Only the common name is known, e.g. in a recording that
+			// was edited by hand.
+			subject = pkix.Name{CommonName: cert.CommonName}
+		}
+		cs.PeerCertificates = append(cs.PeerCertificates, &x509.Certificate{
+			Subject:  subject,
+			DNSNames: cert.DNSNames,
+		})
+	}
+	return cs
+}
+
+// attributeTypes maps the attribute types that pkix.Name.String abbreviates to
+// their OIDs.
+var attributeTypes = map[string]asn1.ObjectIdentifier{
+	"C":            {2, 5, 4, 6},
+	"O":            {2, 5, 4, 10},
+	"OU":           {2, 5, 4, 11},
+	"CN":           {2, 5, 4, 3},
+	"SERIALNUMBER": {2, 5, 4, 5},
+	"L":            {2, 5, 4, 7},
+	"ST":           {2, 5, 4, 8},
+	"STREET":       {2, 5, 4, 9},
+	"POSTALCODE":   {2, 5, 4, 17},
+}
+
+// parseDistinguishedName parses s, a distinguished name as formatted by
+// pkix.Name.String, in the string representation of RFC 4514.
+func parseDistinguishedName(s string) (pkix.Name, error) {
+	var name pkix.Name
+	var seq pkix.RDNSequence
+	var rdn pkix.RelativeDistinguishedNameSET
+	for s != "" {
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			return name, fmt.Errorf("invalid distinguished name: missing '=' in %q", s)
+		}
+		oid, err := parseAttributeType(s[:i])
+		if err != nil {
+			return name, err
+		}
+		value, rest, sep, err := parseAttributeValue(s[i+1:])
+		if err != nil {
+			return name, err
+		}
+		rdn = append(rdn, pkix.AttributeTypeAndValue{Type: oid, Value: value})
+		if sep != '+' {
+			seq = append(seq, rdn)
+			rdn = nil
+		}
+		s = rest
+	}
+	// The relative distinguished names are formatted in reverse order.
+	for i, j := 0, len(seq)-1; i < j; i, j = i+1, j-1 {
+		seq[i], seq[j] = seq[j], seq[i]
+	}
+	name.FillFromRDNSequence(&seq)
+	return name, nil
+}
+
+// parseAttributeType returns the OID of an attribute type, which is either one
+// of attributeTypes or a dotted OID.
+func parseAttributeType(s string) (asn1.ObjectIdentifier, error) {
+	if oid, ok := attributeTypes[s]; ok {
+		return oid, nil
+	}
+	var oid asn1.ObjectIdentifier
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid distinguished name: unknown attribute type %q", s)
+		}
+		oid = append(oid, n)
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("invalid distinguished name: unknown attribute type %q", s)
+	}
+	return oid, nil
+}
+
+// parseAttributeValue parses the attribute value at the start of s, up to an
+// unescaped ',' or '+', and returns it with the rest of s after the separator,
+// and the separator, or 0 at the end of s. A value starting with '#' is the
+// hex encoding of its DER encoding.
+func parseAttributeValue(s string) (value interface{}, rest string, sep byte, err error) {
+	var b strings.Builder
+	i := 0
+	for ; i < len(s) && s[i] != ',' && s[i] != '+'; i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return nil, "", 0, errors.New("invalid distinguished name: trailing backslash")
+		}
+		if i+1 < len(s) && isHex(s[i]) && isHex(s[i+1]) {
+			c, _ := strconv.ParseUint(s[i:i+2], 16, 8)
+			b.WriteByte(byte(c))
+			i++
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	if i < len(s) {
+		sep, rest = s[i], s[i+1:]
+	}
+	if !strings.HasPrefix(s, "#") {
+		return b.String(), rest, sep, nil
+	}
+	der, err := hex.DecodeString(s[1:i])
+	if err == nil {
+		var v interface{}
+		if _, err = asn1.Unmarshal(der, &v); err == nil {
+			return v, rest, sep, nil
+		}
+	}
+	return nil, "", 0, fmt.Errorf("invalid distinguished name: %v", err)
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+var tlsVersions = map[string]uint16{
+	tls.VersionName(tls.VersionTLS10): tls.VersionTLS10,
+	tls.VersionName(tls.VersionTLS11): tls.VersionTLS11,
+	tls.VersionName(tls.VersionTLS12): tls.VersionTLS12,
+	tls.VersionName(tls.VersionTLS13): tls.VersionTLS13,
+}
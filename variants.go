@@ -0,0 +1,85 @@
+package replay
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// RecordingMatch is a set of conditions on requests, which makes a Recording
+// one of several variants of the response for a path. See
+// RoundTripper.MatchVariants. Match blocks are written by hand; recordings are
+// saved without one.
+type RecordingMatch struct {
+	// Headers maps header names to the values they must have. An empty value
+	// matches a request without the header.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Query maps query string parameters to the values they must have. An
+	// empty value matches a request without the parameter.
+	Query map[string]string `json:"query,omitempty"`
+}
+
+// Matches reports whether req satisfies all of the conditions of m. A nil
+// *RecordingMatch matches every request.
+func (m *RecordingMatch) Matches(req *http.Request) bool {
+	if m == nil {
+		return true
+	}
+	for name, value := range m.Headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	if len(m.Query) > 0 {
+		query := req.URL.Query()
+		for name, value := range m.Query {
+			if query.Get(name) != value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// loadVariant returns the first recording with a Match that req satisfies, in
+// filename order, in each of the directories of paths in turn, along with its
+// path, body and body size. It returns a nil Recording if there isn't one. If a
+// recording can't be loaded, its path is returned with the error.
+func (r *RoundTripper) loadVariant(
+	req *http.Request, paths []string,
+) (string, *Recording, io.ReadCloser, int64, error) {
+	searched := make(map[string]bool)
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if searched[dir] {
+			continue
+		}
+		searched[dir] = true
+		// ReadDir returns the entries sorted by filename.
+		entries, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", nil, nil, 0, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !isRecordingFile(entry.Name()) {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			rec, body, size, err := r.loadRecording(path)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return path, nil, nil, 0, err
+			}
+			if rec.Match != nil && rec.Match.Matches(req) && !r.replaysUsedUp(path) {
+				return path, rec, body, size, nil
+			}
+			body.Close()
+		}
+	}
+	return "", nil, nil, 0, nil
+}
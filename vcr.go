@@ -0,0 +1,233 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// vcrCassette is the subset of the go-vcr (github.com/dnaeon/go-vcr) cassette
+// format used by FromVCRCassette and ToVCRCassette. Versions 1 and 2 of the
+// format are compatible for these fields.
+type vcrCassette struct {
+	Version      int              `yaml:"version"`
+	Interactions []vcrInteraction `yaml:"interactions"`
+}
+
+type vcrInteraction struct {
+	Request  vcrRequest  `yaml:"request"`
+	Response vcrResponse `yaml:"response"`
+}
+
+type vcrRequest struct {
+	Body    string      `yaml:"body"`
+	Form    url.Values  `yaml:"form"`
+	Headers http.Header `yaml:"headers"`
+	URL     string      `yaml:"url"`
+	Method  string      `yaml:"method"`
+}
+
+type vcrResponse struct {
+	Body       string      `yaml:"body"`
+	Headers    http.Header `yaml:"headers"`
+	Status     string      `yaml:"status"`
+	Code       int         `yaml:"code"`
+	Proto      string      `yaml:"proto,omitempty"`
+	ProtoMajor int         `yaml:"proto_major,omitempty"`
+	ProtoMinor int         `yaml:"proto_minor,omitempty"`
+	Duration   string      `yaml:"duration"`
+}
+
+// FromVCRCassette converts the go-vcr cassette at path into recordings under
+// dir, at the paths generated by NewPathGenerator. See
+// FromVCRCassetteWithGenerator.
+func FromVCRCassette(path, dir string) (int, error) {
+	return FromVCRCassetteWithGenerator(path, dir, nil)
+}
+
+// FromVCRCassetteWithGenerator converts the go-vcr cassette at path into
+// recordings under dir, at the paths generated for each interaction's request
+// by gen. If gen is nil, NewPathGenerator is used. Interactions whose requests
+// differ only in content excluded by gen would map to the same path, so the
+// second and later of them are saved with the recording names "request-2",
+// "request-3" and so on, and can be replayed in turn by making the requests
+// with those names set by WithRecordingName. The paths of all of the
+// interactions are generated before any recording is saved, so an error in
+// one of them leaves dir unchanged. It returns the number of recordings that
+// were saved.
+func FromVCRCassetteWithGenerator(path, dir string, gen *PathGenerator) (int, error) {
+	if gen == nil {
+		gen = NewPathGenerator()
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var cassette vcrCassette
+	if err = yaml.Unmarshal(data, &cassette); err != nil {
+		return 0, fmt.Errorf("%s: %v", path, err)
+	}
+	paths := make([]string, len(cassette.Interactions))
+	seen := make(map[string]int)
+	// count is the number of interactions seen so far whose requests map to
+	// each path.
+	count := make(map[string]int)
+	for i, interaction := range cassette.Interactions {
+		req, err := interaction.Request.httpRequest()
+		if err != nil {
+			return 0, fmt.Errorf("interaction %d: %v", i, err)
+		}
+		recordingPath, err := gen.RecordingPath(req)
+		if err != nil {
+			return 0, fmt.Errorf("interaction %d: %v", i, err)
+		}
+		recPath := filepath.Join(dir, recordingPath.Path())
+		count[recPath]++
+		if n := count[recPath]; n > 1 {
+			name := fmt.Sprintf("request-%d", n)
+			req = req.WithContext(WithRecordingName(req.Context(), name))
+			if recordingPath, err = gen.RecordingPath(req); err != nil {
+				return 0, fmt.Errorf("interaction %d: %v", i, err)
+			}
+			recPath = filepath.Join(dir, recordingPath.Path())
+		}
+		if first, ok := seen[recPath]; ok {
+			// A FileName function of gen may ignore the recording name.
+			return 0, fmt.Errorf("interactions %d and %d map to the same recording %s", first, i, recPath)
+		}
+		seen[recPath] = i
+		paths[i] = recPath
+	}
+	n := 0
+	for i, interaction := range cassette.Interactions {
+		res := &interaction.Response
+		rec := &Recording{
+			Status:     res.Status,
+			StatusCode: res.Code,
+			Proto:      res.Proto,
+			ProtoMajor: res.ProtoMajor,
+			ProtoMinor: res.ProtoMinor,
+			Headers:    res.Headers,
+			Body:       []byte(res.Body),
+		}
+		if err = rec.Save(paths[i]); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (r *vcrRequest) httpRequest() (*http.Request, error) {
+	body := r.Body
+	if body == "" && len(r.Form) > 0 {
+		body = r.Form.Encode()
+	}
+	req, err := http.NewRequest(r.Method, r.URL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == "" {
+		req.Body, req.GetBody = nil, nil
+	}
+	for k, v := range r.Headers {
+		req.Header[k] = v
+	}
+	return req, nil
+}
+
+// ToVCRCassette writes the recordings under dir, in the layout generated by
+// NewPathGenerator, to a go-vcr cassette at path. See
+// ToVCRCassetteWithGenerator.
+func ToVCRCassette(dir, path string) error {
+	return ToVCRCassetteWithGenerator(dir, path, nil)
+}
+
+// ToVCRCassetteWithGenerator writes the recordings under dir to a go-vcr
+// cassette at path. Recordings don't store the requests they were made for, so each request is
+// reconstructed from the recording's path, which must be in the layout
+// generated by gen, or by NewPathGenerator if gen is nil. The scheme, host,
+// method and URL path are restored, but headers and bodies are not, and query
+// parameters are only restored if they were added to the path by QueryInPath.
+// If gen has IgnoreScheme set, the URLs are scheme-relative, and if it has a
+// PathTemplate, an error is returned. Recordings of transport errors are
+// skipped.
+func ToVCRCassetteWithGenerator(dir, path string, gen *PathGenerator) error {
+	if gen == nil {
+		gen = NewPathGenerator()
+	}
+	cassette := vcrCassette{Version: 1}
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isRecordingFile(info.Name()) {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		method, u, err := requestFromPath(rel, gen)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		rec, err := LoadRecording(file)
+		if err != nil {
+			return err
+		}
+		if rec.Error != nil {
+			return nil
+		}
+		cassette.Interactions = append(cassette.Interactions, vcrInteraction{
+			Request: vcrRequest{
+				Form:    url.Values{},
+				Headers: http.Header{},
+				URL:     u.String(),
+				Method:  method,
+			},
+			Response: vcrResponse{
+				Body:       string(rec.Body),
+				Headers:    rec.Headers,
+				Status:     rec.Status,
+				Code:       rec.StatusCode,
+				Proto:      rec.Proto,
+				ProtoMajor: rec.ProtoMajor,
+				ProtoMinor: rec.ProtoMinor,
+			},
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(&cassette)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append([]byte("---\n"), data...), 0644)
+}
+
+// errPathTemplate is returned by requestFromPath for a PathGenerator with a
+// PathTemplate, whose paths can't be converted back to requests.
+var errPathTemplate = errors.New("paths generated by a PathTemplate can't be converted to requests")
+
+// requestFromPath returns the method and URL of the request for the recording
+// at path, relative to the recording directory, which must be in the layout
+// generated by gen. Query parameters are only restored if they were added to
+// the path by QueryInPath, and the scheme is left out if gen has IgnoreScheme
+// set.
+func requestFromPath(path string, gen *PathGenerator) (string, *url.URL, error) {
+	if gen.PathTemplate != nil {
+		return "", nil, errPathTemplate
+	}
+	info, err := parseRecordingPath(path, gen.IgnoreScheme)
+	if err != nil {
+		return "", nil, err
+	}
+	return info.Method, info.URL(), nil
+}
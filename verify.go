@@ -0,0 +1,140 @@
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Drift describes the differences between a recorded response and the live
+// response to the same request, found in ModeVerify.
+type Drift struct {
+	// Method is the method of the request.
+	Method string
+	// URL is the URL of the request.
+	URL string
+	// Path is the path of the recording.
+	Path string
+	// Differences describes each difference that was found.
+	Differences []string
+}
+
+func (d *Drift) String() string {
+	return fmt.Sprintf("%s %s (%s): %s",
+		d.Method, d.URL, d.Path, strings.Join(d.Differences, "; "))
+}
+
+// Drifts returns the differences found so far in ModeVerify, in the order they
+// were found.
+func (r *RoundTripper) Drifts() []Drift {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Drift(nil), r.drifts...)
+}
+
+// verify sends req with the wrapped RoundTripper, and compares the response
+// with res, which was played back from the recording at path, or with err, if
+// the recording is of an error. The recorded response or error is returned.
+func (r *RoundTripper) verify(
+	req *http.Request, path string, res *http.Response, err error,
+) (*http.Response, error) {
+	var recErr *RecordedError
+	if err != nil && !errors.As(err, &recErr) {
+		return res, err
+	}
+	var recorded []byte
+	if res != nil {
+		recorded, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, &Error{Request: req, Response: res, Err: err, Path: path}
+		}
+		res.Body = ioutil.NopCloser(bytes.NewReader(recorded))
+	}
+
+	live, liveErr := r.RoundTripper.RoundTrip(req)
+	var diffs []string
+	switch {
+	case liveErr != nil && recErr != nil:
+	case liveErr != nil:
+		diffs = append(diffs, fmt.Sprintf("live request failed: %v", liveErr))
+	case recErr != nil:
+		live.Body.Close()
+		diffs = append(diffs, fmt.Sprintf("recorded error %q, live status %d",
+			recErr.Message, live.StatusCode))
+	default:
+		if diffs, err = r.compare(res, recorded, live); err != nil {
+			diffs = append(diffs, fmt.Sprintf("reading live body failed: %v", err))
+		}
+	}
+	if len(diffs) == 0 {
+		return res, recErr.orNil()
+	}
+
+	drift := Drift{Method: req.Method, URL: req.URL.String(), Path: path, Differences: diffs}
+	r.mu.Lock()
+	r.drifts = append(r.drifts, drift)
+	r.mu.Unlock()
+	if r.OnDrift != nil {
+		if herr := r.callHook(req, "OnDrift", func() {
+			r.OnDrift(req, &drift)
+		}); herr != nil {
+			if res != nil {
+				res.Body.Close()
+			}
+			return nil, herr
+		}
+	}
+	return res, recErr.orNil()
+}
+
+// compare returns the differences between the recorded response res, with the
+// given body, and live. The body of live is read and closed.
+func (r *RoundTripper) compare(res *http.Response, recorded []byte, live *http.Response) ([]string, error) {
+	defer live.Body.Close()
+	var diffs []string
+	if res.StatusCode != live.StatusCode {
+		diffs = append(diffs, fmt.Sprintf("status: recorded %d, live %d",
+			res.StatusCode, live.StatusCode))
+	}
+	// Headers are compared in order, so that differences are reported in
+	// the same order every time.
+	names := make([]string, 0, len(r.VerifyHeaders))
+	for name := range r.VerifyHeaders.fold(http.CanonicalHeaderKey) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		recValues, liveValues := res.Header.Values(name), live.Header.Values(name)
+		if strings.Join(recValues, "\n") != strings.Join(liveValues, "\n") {
+			diffs = append(diffs, fmt.Sprintf("header %s: recorded %q, live %q",
+				name, recValues, liveValues))
+		}
+	}
+	body, err := ioutil.ReadAll(live.Body)
+	if err != nil {
+		return diffs, err
+	}
+	if r.NormalizeBody != nil {
+		recorded = r.NormalizeBody(res, recorded)
+		body = r.NormalizeBody(live, body)
+	}
+	if !bytes.Equal(recorded, body) {
+		diffs = append(diffs, fmt.Sprintf("body: recorded %d bytes, live %d bytes differ",
+			len(recorded), len(body)))
+	}
+	return diffs, nil
+}
+
+// orNil returns e as an error, or nil if e is nil, so that a nil *RecordedError
+// isn't returned as a non-nil error.
+func (e *RecordedError) orNil() error {
+	if e == nil {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,130 @@
+package replay
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RecordingInfo describes a recording found by Walk, with the components of
+// its path, which are unescaped.
+type RecordingInfo struct {
+	// FilePath is the path of the recording, including the directory passed
+	// to Walk.
+	FilePath string
+	Scheme   string
+	Host     string
+	Method   string
+	// PathSegments are the segments of the URL path. The last is empty if
+	// the path had a trailing slash preserved by PreserveTrailingSlash.
+	PathSegments []string
+	// RawQuery is the query string, if it was added to the path by
+	// QueryInPath.
+	RawQuery string
+	// CRC is the checksum in the filename, or empty for a generic recording.
+	CRC string
+	// Err is set if the path isn't in the layout generated by
+	// PathGenerator, in which case the components above are empty, or if the
+	// recording can't be loaded.
+	Err error
+}
+
+// URL returns the URL of the request for the recording, as far as it can be
+// reconstructed from the path, or nil if the path isn't in the layout
+// generated by PathGenerator.
+func (info *RecordingInfo) URL() *url.URL {
+	if info.Method == "" {
+		return nil
+	}
+	return &url.URL{
+		Scheme:   info.Scheme,
+		Host:     info.Host,
+		Path:     "/" + strings.Join(info.PathSegments, "/"),
+		RawQuery: info.RawQuery,
+	}
+}
+
+// Walk calls fn for each recording under dir, in lexical order, with its info
+// and the recording. If info.Err is set because the recording can't be loaded,
+// rec is nil. If fn returns an error, Walk stops and returns it. See
+// WalkHeaders.
+func Walk(dir string, fn func(info RecordingInfo, rec *Recording) error) error {
+	return walk(dir, fn, true)
+}
+
+// WalkHeaders is like Walk, but the bodies of the recordings aren't loaded,
+// which is faster.
+func WalkHeaders(dir string, fn func(info RecordingInfo, rec *Recording) error) error {
+	return walk(dir, fn, false)
+}
+
+func walk(dir string, fn func(info RecordingInfo, rec *Recording) error, bodies bool) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !isRecordingFile(fi.Name()) {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := parseRecordingPath(rel, false)
+		info.FilePath = path
+		info.Err = err
+		var rec *Recording
+		if bodies {
+			rec, err = LoadRecording(path)
+		} else {
+			var body io.ReadCloser
+			if rec, body, _, err = loadRecordingStream(path); err == nil {
+				body.Close()
+			}
+		}
+		if err != nil {
+			info.Err = err
+		}
+		return fn(info, rec)
+	})
+}
+
+// parseRecordingPath parses path, relative to the recording directory, which
+// should be in the layout generated by PathGenerator. If ignoreScheme is true,
+// the layout is that generated with IgnoreScheme, and the scheme is left empty.
+func parseRecordingPath(path string, ignoreScheme bool) (RecordingInfo, error) {
+	var info RecordingInfo
+	parts := strings.Split(filepath.Dir(path), string(os.PathSeparator))
+	if ignoreScheme {
+		parts = append([]string{""}, parts...)
+	}
+	if len(parts) < 3 {
+		return info, errors.New("not a recording path")
+	}
+	// A final directory containing '=' is a query string, from QueryInPath.
+	// Escaped path segments can't contain one.
+	var rawQuery string
+	if last := parts[len(parts)-1]; len(parts) > 3 && strings.Contains(last, "=") {
+		rawQuery = last
+		parts = parts[:len(parts)-1]
+	}
+	for i := range parts {
+		var err error
+		if parts[i], err = url.QueryUnescape(parts[i]); err != nil {
+			return info, err
+		}
+	}
+	segments := parts[3:]
+	if n := len(segments); n > 0 && segments[n-1] == "/" {
+		// A trailing slash, from PreserveTrailingSlash.
+		segments[n-1] = ""
+	}
+	info.Scheme, info.Host, info.Method = parts[0], parts[1], parts[2]
+	info.PathSegments = segments
+	info.RawQuery = rawQuery
+	name := strings.TrimSuffix(filepath.Base(path), ".json")
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		info.CRC = name[i+1:]
+	}
+	return info, nil
+}
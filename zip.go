@@ -0,0 +1,145 @@
+package replay
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ErrReadOnlyStore is returned by the Save method of a Store that can't save
+// recordings, such as a *ZipStore.
+var ErrReadOnlyStore = errors.New("replay: store is read-only")
+
+// zipModTime is the modification time of every entry written by ZipDir, so
+// that the archive is reproducible. It is the earliest time zip files can
+// represent.
+var zipModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ZipStore is a read-only Store of the recordings in a zip archive, which are
+// laid out as under a recording directory, as written by ZipDir. The names of
+// the entries are their keys. It is safe for concurrent use.
+type ZipStore struct {
+	path    string
+	zip     *zip.ReadCloser
+	entries map[string]*zip.File
+}
+
+// OpenZip opens the zip archive at path as a *ZipStore, for playback with the
+// Store field of RoundTripper. It must be closed when it is no longer needed.
+func OpenZip(path string) (*ZipStore, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+	return &ZipStore{path: path, zip: zr, entries: entries}, nil
+}
+
+// Load returns the recording with the given key. It implements Store. Errors
+// are as for LoadRecording, with paths of the form "archive.zip#key".
+func (z *ZipStore) Load(key string) (*Recording, error) {
+	path := z.path + "#" + key
+	f, ok := z.entries[key]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	rec, body, _, err := decodeRecording(bytes.NewReader(data), int64(len(data)), path)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Body, err = ioutil.ReadAll(body); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Save returns ErrReadOnlyStore. Recordings can't be added to a zip archive;
+// record into a directory and use ZipDir instead.
+func (z *ZipStore) Save(key string, rec *Recording) error {
+	return ErrReadOnlyStore
+}
+
+// Keys returns the names of the recordings in the archive, sorted.
+func (z *ZipStore) Keys() []string {
+	keys := make([]string, 0, len(z.entries))
+	for key := range z.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Close closes the archive.
+func (z *ZipStore) Close() error {
+	return z.zip.Close()
+}
+
+// ZipDir writes the recordings under dir to a new zip archive at zipPath,
+// replacing any existing file, with their paths relative to dir, with forward
+// slashes, as names. Entries are sorted by name and have a fixed modification
+// time, so that the same recordings always produce the same archive.
+func ZipDir(dir, zipPath string) error {
+	var names []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isRecordingFile(info.Name()) {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	return writeFileAtomic(zipPath, func(w io.Writer) error {
+		zw := zip.NewWriter(w)
+		for _, name := range names {
+			if err := addZipEntry(zw, name, filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	})
+}
+
+// addZipEntry adds the file at path to zw with the given name.
+func addZipEntry(zw *zip.Writer, name, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: zipModTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	return err
+}